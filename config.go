@@ -37,6 +37,7 @@ type HTTPConfig struct {
 		BindInterface    string `json:"bind_interface" yaml:"bind_interface"`
 		PreferIpv6       bool   `json:"prefer_ipv6" yaml:"prefer_ipv6"`
 		Websocket        string `json:"websocket" yaml:"websocket"`
+		Trojan           bool   `json:"trojan" yaml:"trojan"`
 		Log              bool   `json:"log" yaml:"log"`
 		LogInterval      int64  `json:"log_interval" yaml:"log_interval"`
 	} `json:"forward" yaml:"forward"`
@@ -64,6 +65,14 @@ type HTTPConfig struct {
 			SetHeaders        string `json:"set_headers" yaml:"set_headers"`
 			DumpFailure       bool   `json:"dump_failure" yaml:"dump_failure"`
 		} `json:"proxy" yaml:"proxy"`
+		Tunnel struct {
+			Enabled    bool   `json:"enabled" yaml:"enabled"`
+			DialerName string `json:"dialer_name" yaml:"dialer_name"`
+		} `json:"tunnel" yaml:"tunnel"`
+		Doh struct {
+			Enabled bool   `json:"enabled" yaml:"enabled"`
+			Policy  string `json:"policy" yaml:"policy"`
+		} `json:"doh" yaml:"doh"`
 	} `json:"web" yaml:"web"`
 }
 
@@ -81,6 +90,56 @@ type SocksConfig struct {
 	} `json:"forward" yaml:"forward"`
 }
 
+type RedirConfig struct {
+	Listen      []string `json:"listen" yaml:"listen"`
+	Transparent bool     `json:"transparent" yaml:"transparent"`
+	Sniff       bool     `json:"sniff" yaml:"sniff"`
+	Mark        int      `json:"mark" yaml:"mark"`
+	Forward     struct {
+		Policy     string `json:"policy" yaml:"policy"`
+		Dialer     string `json:"dialer" yaml:"dialer"`
+		SpeedLimit int64  `json:"speed_limit" yaml:"speed_limit"`
+		Log        bool   `json:"log" yaml:"log"`
+	} `json:"forward" yaml:"forward"`
+}
+
+type ShadowsocksConfig struct {
+	Listen   []string `json:"listen" yaml:"listen"`
+	Method   string   `json:"method" yaml:"method"`
+	Password string   `json:"password" yaml:"password"`
+	Forward  struct {
+		Policy     string `json:"policy" yaml:"policy"`
+		AuthTable  string `json:"auth_table" yaml:"auth_table"`
+		Dialer     string `json:"dialer" yaml:"dialer"`
+		SpeedLimit int64  `json:"speed_limit" yaml:"speed_limit"`
+		Log        bool   `json:"log" yaml:"log"`
+	} `json:"forward" yaml:"forward"`
+}
+
+type SSHConfig struct {
+	Listen         []string `json:"listen" yaml:"listen"`
+	HostKey        string   `json:"host_key" yaml:"host_key"`
+	AuthorizedKeys string   `json:"authorized_keys" yaml:"authorized_keys"`
+	Forward        struct {
+		Policy     string `json:"policy" yaml:"policy"`
+		AuthTable  string `json:"auth_table" yaml:"auth_table"`
+		Dialer     string `json:"dialer" yaml:"dialer"`
+		SpeedLimit int64  `json:"speed_limit" yaml:"speed_limit"`
+		Log        bool   `json:"log" yaml:"log"`
+	} `json:"forward" yaml:"forward"`
+}
+
+type DnsConfig struct {
+	Listen     []string `json:"listen" yaml:"listen"`
+	TlsListen  []string `json:"tls_listen" yaml:"tls_listen"`
+	ServerName []string `json:"server_name" yaml:"server_name"`
+	Keyfile    string   `json:"keyfile" yaml:"keyfile"`
+	Certfile   string   `json:"certfile" yaml:"certfile"`
+	Policy     string   `json:"policy" yaml:"policy"`
+	Log        bool     `json:"log" yaml:"log"`
+	FakeIP     bool     `json:"fake_ip" yaml:"fake_ip"`
+}
+
 type StreamConfig struct {
 	Listen      []string `json:"listen" yaml:"listen"`
 	Keyfile     string   `json:"keyfile" yaml:"keyfile"`
@@ -94,13 +153,31 @@ type StreamConfig struct {
 
 type TunnelConfig struct {
 	Server struct {
-		Listen string `json:"listen" yaml:"listen"`
-		Key    string `json:"key" yaml:"key"`
+		Listen     string            `json:"listen" yaml:"listen"`
+		Key        string            `json:"key" yaml:"key"`
+		Keys       map[string]string `json:"keys" yaml:"keys"`
+		ServerName string            `json:"server_name" yaml:"server_name"`
+		Keyfile    string            `json:"keyfile" yaml:"keyfile"`
+		Certfile   string            `json:"certfile" yaml:"certfile"`
+		KeepAlive  int               `json:"keepalive" yaml:"keepalive"`
+		DialerName string            `json:"dialer_name" yaml:"dialer_name"`
+		Insecure   bool              `json:"insecure" yaml:"insecure"`
+		Expose     []struct {
+			Listen  string `json:"listen" yaml:"listen"`
+			Client  string `json:"client" yaml:"client"`
+			Service string `json:"service" yaml:"service"`
+		} `json:"expose" yaml:"expose"`
 	} `json:"server" yaml:"server"`
 	Client struct {
-		RemoteAddr string `json:"remote_addr" yaml:"remote_addr"`
-		LocalAddr  string `json:"local_addr" yaml:"local_addr"`
-		Key        string `json:"key" yaml:"key"`
+		Name        string            `json:"name" yaml:"name"`
+		RemoteAddr  string            `json:"remote_addr" yaml:"remote_addr"`
+		LocalAddr   string            `json:"local_addr" yaml:"local_addr"`
+		Services    map[string]string `json:"services" yaml:"services"`
+		Key         string            `json:"key" yaml:"key"`
+		KeepAlive   int               `json:"keepalive" yaml:"keepalive"`
+		Dialer      string            `json:"dialer" yaml:"dialer"`
+		MaxBackoff  int               `json:"max_backoff" yaml:"max_backoff"`
+		AllowEgress bool              `json:"allow_egress" yaml:"allow_egress"`
 	} `json:"client" yaml:"client"`
 }
 
@@ -114,22 +191,52 @@ type Config struct {
 		DialTimeout      int    `json:"dial_timeout" yaml:"dial_timeout"`
 		DialReadBuffer   int    `json:"dial_read_buffer" yaml:"dial_read_buffer"`
 		DialWriteBuffer  int    `json:"dial_write_buffer" yaml:"dial_write_buffer"`
+		DialConcurrency  int    `json:"dial_concurrency" yaml:"dial_concurrency"`
+		DialAttemptDelay int    `json:"dial_attempt_delay" yaml:"dial_attempt_delay"`
+		DialFamilyTTL    int    `json:"dial_family_ttl" yaml:"dial_family_ttl"`
 		DnsServer        string `json:"dns_server" yaml:"dns_server"`
 		DnsCacheDuration string `json:"dns_cache_duration" yaml:"dns_cache_duration"`
-		IdleConnTimeout  int    `json:"idle_conn_timeout" yaml:"idle_conn_timeout"`
-		MaxIdleConns     int    `json:"max_idle_conns" yaml:"max_idle_conns"`
-		TcpBrutalRate    uint64 `json:"tcp_brutal_rate" yaml:"tcp_brutal_rate"`
+		DnsMinTTL        string `json:"dns_min_ttl" yaml:"dns_min_ttl"`
+		DnsMaxTTL        string `json:"dns_max_ttl" yaml:"dns_max_ttl"`
+		DnsNegativeTTL   string `json:"dns_negative_ttl" yaml:"dns_negative_ttl"`
+		DnsStaleTTL      string `json:"dns_stale_ttl" yaml:"dns_stale_ttl"`
+		DnsRules         []struct {
+			Domains       []string `json:"domains" yaml:"domains"`
+			Geosite       []string `json:"geosite" yaml:"geosite"`
+			Server        []string `json:"server" yaml:"server"`
+			CacheDuration string   `json:"cache_duration" yaml:"cache_duration"`
+			Trusted       bool     `json:"trusted" yaml:"trusted"`
+		} `json:"dns_rules" yaml:"dns_rules"`
+		DnsPoisonedIPs  string            `json:"dns_poisoned_ips" yaml:"dns_poisoned_ips"`
+		DnsFakeIP       []string          `json:"dns_fake_ip" yaml:"dns_fake_ip"`
+		DnsFakeIPFilter []string          `json:"dns_fake_ip_filter" yaml:"dns_fake_ip_filter"`
+		DnsFakeIPSize   int               `json:"dns_fake_ip_size" yaml:"dns_fake_ip_size"`
+		Hosts           map[string]string `json:"hosts" yaml:"hosts"`
+		HostsFile       string            `json:"hosts_file" yaml:"hosts_file"`
+		Geosite         struct {
+			Sources   []string `json:"sources" yaml:"sources"`
+			CacheFile string   `json:"cache_file" yaml:"cache_file"`
+			Checksum  string   `json:"checksum" yaml:"checksum"`
+			Refresh   string   `json:"refresh" yaml:"refresh"`
+		} `json:"geosite" yaml:"geosite"`
+		IdleConnTimeout int    `json:"idle_conn_timeout" yaml:"idle_conn_timeout"`
+		MaxIdleConns    int    `json:"max_idle_conns" yaml:"max_idle_conns"`
+		TcpBrutalRate   uint64 `json:"tcp_brutal_rate" yaml:"tcp_brutal_rate"`
 	} `json:"global" yaml:"global"`
 	Cron []struct {
 		Spec    string `json:"spec" yaml:"spec"`
 		Command string `json:"command" yaml:"command"`
 	} `json:"cron" yaml:"cron"`
-	Dialer map[string]string `json:"dialer" yaml:"dialer"`
-	Https  []HTTPConfig      `json:"https" yaml:"https"`
-	Http   []HTTPConfig      `json:"http" yaml:"http"`
-	Socks  []SocksConfig     `json:"socks" yaml:"socks"`
-	Stream []StreamConfig    `json:"stream" yaml:"stream"`
-	Tunnel []TunnelConfig    `json:"tunnel" yaml:"tunnel"`
+	Dialer      map[string]string   `json:"dialer" yaml:"dialer"`
+	Https       []HTTPConfig        `json:"https" yaml:"https"`
+	Http        []HTTPConfig        `json:"http" yaml:"http"`
+	Socks       []SocksConfig       `json:"socks" yaml:"socks"`
+	Redir       []RedirConfig       `json:"redir" yaml:"redir"`
+	Shadowsocks []ShadowsocksConfig `json:"shadowsocks" yaml:"shadowsocks"`
+	Ssh         []SSHConfig         `json:"ssh" yaml:"ssh"`
+	Dns         []DnsConfig         `json:"dns" yaml:"dns"`
+	Stream      []StreamConfig      `json:"stream" yaml:"stream"`
+	Tunnel      []TunnelConfig      `json:"tunnel" yaml:"tunnel"`
 }
 
 func NewConfig(filename string) (*Config, error) {
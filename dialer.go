@@ -1,6 +1,7 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
 	"errors"
@@ -9,6 +10,8 @@ import (
 	"slices"
 	"strconv"
 	"time"
+
+	"github.com/phuslu/lru"
 )
 
 type Dialer interface {
@@ -20,11 +23,20 @@ var _ Dialer = (*LocalDialer)(nil)
 type LocalDialer struct {
 	Resolver *Resolver
 
-	BindInterface   string
+	BindInterface string
+	// Mark is the SO_MARK of connections, so that they could be routed by policy routing, linux only.
+	Mark            int
 	PreferIPv6      bool
 	ForbidLocalAddr bool
+	TCPFastOpen     bool
 	Concurrency     int
 
+	// AttemptDelay is the Connection Attempt Delay of Happy Eyeballs v2, default to 250ms.
+	AttemptDelay time.Duration
+	// FamilyCache remembers the address family which succeeded for a host, it is preferred in next dials.
+	FamilyCache    *lru.TTLCache[string, bool]
+	FamilyCacheTTL time.Duration
+
 	DialTimeout   time.Duration
 	TCPKeepAlive  time.Duration
 	ReadBuffSize  int
@@ -47,6 +59,8 @@ func (d *LocalDialer) dialContext(ctx context.Context, network, address string,
 	switch network {
 	case "tcp", "tcp6", "tcp4":
 		break
+	case "udp", "udp6", "udp4":
+		return d.dialUDP(ctx, network, address)
 	default:
 		return (&net.Dialer{}).DialContext(ctx, network, address)
 	}
@@ -56,7 +70,11 @@ func (d *LocalDialer) dialContext(ctx context.Context, network, address string,
 		return nil, err
 	}
 
-	ips, err := d.Resolver.LookupNetIP(ctx, "ip", host)
+	if host, err = d.Resolver.FakeIP.Resolve(host); err != nil {
+		return nil, err
+	}
+
+	ips, late, err := d.lookupNetIP(ctx, network, host)
 	if err != nil {
 		return nil, err
 	}
@@ -67,29 +85,13 @@ func (d *LocalDialer) dialContext(ctx context.Context, network, address string,
 	case 1:
 		break
 	default:
-		slices.SortFunc(ips, func(a, b netip.Addr) int {
-			switch {
-			case a.Is6() && b.Is4():
-				if d.PreferIPv6 {
-					return -1
-				} else {
-					return 1
-				}
-			case a.Is4() && b.Is6():
-				if d.PreferIPv6 {
-					return 1
-				} else {
-					return -1
-				}
-			default:
-				return 0
-			}
-		})
-		if d.PreferIPv6 {
-			if i := slices.IndexFunc(ips, func(a netip.Addr) bool { return a.Is4() }); i > 0 {
-				ips = ips[:i]
+		prefer6 := d.PreferIPv6
+		if d.FamilyCache != nil {
+			if is6, ok := d.FamilyCache.Get(host); ok {
+				prefer6 = is6
 			}
 		}
+		ips = interleaveAddrs(ips, prefer6)
 	}
 
 	port, _ := strconv.Atoi(portStr)
@@ -112,8 +114,146 @@ func (d *LocalDialer) dialContext(ctx context.Context, network, address string,
 		if len(ips) == 1 {
 			ips = append(ips, ips[0])
 		}
-		return d.dialParallel(ctx, network, host, ips, uint16(port), tlsConfig)
+		return d.dialParallel(ctx, network, host, ips, late, uint16(port), tlsConfig)
+	}
+}
+
+// dialUDP resolves address by Resolver like tcp, and connects to the first address of preferred family.
+func (d *LocalDialer) dialUDP(ctx context.Context, network, address string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if host, err = d.Resolver.FakeIP.Resolve(host); err != nil {
+		return nil, err
+	}
+
+	// udp, udp4 and udp6 => ip, ip4 and ip6
+	ips, err := d.Resolver.LookupNetIP(ctx, "ip"+network[3:], host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, net.InvalidAddrError("invaid dns record: " + address)
+	}
+
+	ip := interleaveAddrs(ips, d.PreferIPv6)[0]
+	if d.ForbidLocalAddr && (ip.IsLoopback() || ip.IsPrivate()) {
+		return nil, net.InvalidAddrError("intranet address is rejected: " + ip.String())
 	}
+
+	port, _ := strconv.Atoi(portStr)
+
+	dailer := &net.Dialer{}
+	if d.BindInterface != "" || d.Mark != 0 {
+		dailer.Control = (&DailerController{BindInterface: d.BindInterface, Mark: d.Mark}).Control
+	}
+
+	return dailer.DialContext(ctx, network, netip.AddrPortFrom(ip, uint16(port)).String())
+}
+
+// lookupNetIP queries A and AAAA records in parallel. Like RFC 8305, it returns at once after AAAA records arrive,
+// and waits the Resolution Delay of 50ms for AAAA records after A records arrive. The records of the other family
+// which are not arrived yet are sent to the returned channel later.
+func (d *LocalDialer) lookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, <-chan []netip.Addr, error) {
+	var ips []netip.Addr
+	var err error
+
+	switch network {
+	case "tcp4":
+		ips, err = d.Resolver.LookupNetIP(ctx, "ip4", host)
+		return ips, nil, err
+	case "tcp6":
+		ips, err = d.Resolver.LookupNetIP(ctx, "ip6", host)
+		return ips, nil, err
+	}
+
+	if _, err := netip.ParseAddr(host); err == nil || d.Concurrency <= 1 {
+		ips, err = d.Resolver.LookupNetIP(ctx, "ip", host)
+		return ips, nil, err
+	}
+
+	type lookupResult struct {
+		IPs []netip.Addr
+		Err error
+		Is6 bool
+	}
+
+	lane := make(chan lookupResult, 2)
+	for _, is6 := range []bool{true, false} {
+		go func(is6 bool) {
+			network := "ip4"
+			if is6 {
+				network = "ip6"
+			}
+			ips, err := d.Resolver.LookupNetIP(ctx, network, host)
+			lane <- lookupResult{ips, err, is6}
+		}(is6)
+	}
+
+	late := func() <-chan []netip.Addr {
+		c := make(chan []netip.Addr, 1)
+		go func() {
+			r := <-lane
+			c <- r.IPs
+		}()
+		return c
+	}
+
+	var timeout <-chan time.Time
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-lane:
+			if r.Err != nil {
+				err = r.Err
+				continue
+			}
+			ips = append(ips, r.IPs...)
+			if i == 0 && len(r.IPs) > 0 {
+				if r.Is6 {
+					return ips, late(), nil
+				}
+				timer := time.NewTimer(50 * time.Millisecond)
+				defer timer.Stop()
+				timeout = timer.C
+			}
+		case <-timeout:
+			return ips, late(), nil
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+
+	if len(ips) == 0 && err != nil {
+		return nil, nil, err
+	}
+
+	return ips, nil, nil
+}
+
+// interleaveAddrs sorts addresses by alternating families, starting with the preferred family.
+func interleaveAddrs(ips []netip.Addr, prefer6 bool) []netip.Addr {
+	var first, second []netip.Addr
+	for _, ip := range ips {
+		if ip.Unmap().Is6() == prefer6 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+
+	result := make([]netip.Addr, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			result = append(result, first[i])
+		}
+		if i < len(second) {
+			result = append(result, second[i])
+		}
+	}
+
+	return result
 }
 
 func (d *LocalDialer) dialSerial(ctx context.Context, network, hostname string, ips []netip.Addr, port uint16, tlsConfig *tls.Config) (conn net.Conn, err error) {
@@ -123,8 +263,8 @@ func (d *LocalDialer) dialSerial(ctx context.Context, network, hostname string,
 		}
 
 		dailer := &net.Dialer{}
-		if d.BindInterface != "" {
-			dailer.Control = (&DailerController{BindInterface: d.BindInterface}).Control
+		if d.BindInterface != "" || d.TCPFastOpen || d.Mark != 0 {
+			dailer.Control = (&DailerController{BindInterface: d.BindInterface, FastOpen: d.TCPFastOpen, Mark: d.Mark}).Control
 		}
 		conn, err = dailer.DialContext(ctx, network, netip.AddrPortFrom(ip, port).String())
 		if err != nil {
@@ -154,88 +294,130 @@ func (d *LocalDialer) dialSerial(ctx context.Context, network, hostname string,
 	return nil, err
 }
 
-func (d *LocalDialer) dialParallel(ctx context.Context, network, hostname string, ips []netip.Addr, port uint16, tlsConfig *tls.Config) (net.Conn, error) {
+// dialParallel races connection attempts like Happy Eyeballs v2 of RFC 8305, a new attempt starts after
+// AttemptDelay or the failure of previous attempt, and at most Concurrency attempts are in flight.
+// The addresses of late, which are resolved after the first attempt, are interleaved with the pending ones.
+func (d *LocalDialer) dialParallel(ctx context.Context, network, hostname string, ips []netip.Addr, late <-chan []netip.Addr, port uint16, tlsConfig *tls.Config) (net.Conn, error) {
 	type dialResult struct {
 		Conn net.Conn
+		IP   netip.Addr
 		Err  error
 	}
 
-	level := len(ips)
-	if level > d.Concurrency {
-		level = d.Concurrency
-		ips = ips[:level]
-	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	lane := make(chan dialResult, level)
-	for i := 0; i < level; i++ {
-		go func(ip netip.Addr, port uint16, tlsConfig *tls.Config) {
-			if d.ForbidLocalAddr && (ip.IsLoopback() || ip.IsPrivate()) {
-				lane <- dialResult{nil, net.InvalidAddrError("intranet address is rejected: " + ip.String())}
-				return
-			}
+	delay := cmp.Or(d.AttemptDelay, 250*time.Millisecond)
+	var timeout <-chan time.Time
 
-			dailer := &net.Dialer{}
-			if d.BindInterface != "" {
-				dailer.Control = (&DailerController{BindInterface: d.BindInterface}).Control
-			}
-			conn, err := dailer.DialContext(ctx, network, netip.AddrPortFrom(ip, port).String())
-			if err != nil {
-				lane <- dialResult{nil, err}
-				return
-			}
+	lane := make(chan dialResult, len(ips))
+	dial := func(ip netip.Addr) {
+		if d.ForbidLocalAddr && (ip.IsLoopback() || ip.IsPrivate()) {
+			lane <- dialResult{nil, ip, net.InvalidAddrError("intranet address is rejected: " + ip.String())}
+			return
+		}
 
-			if d.TCPKeepAlive > 0 {
-				if tc, ok := conn.(*net.TCPConn); ok {
-					tc.SetKeepAlive(true)
-					tc.SetKeepAlivePeriod(d.TCPKeepAlive)
-				}
-			}
+		dailer := &net.Dialer{}
+		if d.BindInterface != "" || d.TCPFastOpen || d.Mark != 0 {
+			dailer.Control = (&DailerController{BindInterface: d.BindInterface, FastOpen: d.TCPFastOpen, Mark: d.Mark}).Control
+		}
+		conn, err := dailer.DialContext(ctx, network, netip.AddrPortFrom(ip, port).String())
+		if err != nil {
+			lane <- dialResult{nil, ip, err}
+			return
+		}
 
-			if d.ReadBuffSize > 0 {
-				if tc, ok := conn.(*net.TCPConn); ok {
-					tc.SetReadBuffer(d.ReadBuffSize)
-				}
+		if d.TCPKeepAlive > 0 {
+			if tc, ok := conn.(*net.TCPConn); ok {
+				tc.SetKeepAlive(true)
+				tc.SetKeepAlivePeriod(d.TCPKeepAlive)
 			}
+		}
 
-			if d.WriteBuffSize > 0 {
-				if tc, ok := conn.(*net.TCPConn); ok {
-					tc.SetReadBuffer(d.WriteBuffSize)
-				}
+		if d.ReadBuffSize > 0 {
+			if tc, ok := conn.(*net.TCPConn); ok {
+				tc.SetReadBuffer(d.ReadBuffSize)
 			}
+		}
 
-			if tlsConfig == nil {
-				lane <- dialResult{conn, nil}
-				return
+		if d.WriteBuffSize > 0 {
+			if tc, ok := conn.(*net.TCPConn); ok {
+				tc.SetReadBuffer(d.WriteBuffSize)
 			}
+		}
+
+		if tlsConfig == nil {
+			lane <- dialResult{conn, ip, nil}
+			return
+		}
 
-			tlsConn := tls.Client(conn, tlsConfig)
-			err = tlsConn.HandshakeContext(ctx)
+		tlsConn := tls.Client(conn, tlsConfig)
+		err = tlsConn.HandshakeContext(ctx)
 
-			if err != nil {
-				lane <- dialResult{nil, err}
-				return
-			}
+		if err != nil {
+			conn.Close()
+			lane <- dialResult{nil, ip, err}
+			return
+		}
+
+		lane <- dialResult{tlsConn, ip, nil}
+	}
 
-			lane <- dialResult{tlsConn, nil}
-		}(ips[i], port, tlsConfig)
+	next, inflight := 0, 0
+	start := func() {
+		if next < len(ips) && inflight < d.Concurrency {
+			go dial(ips[next])
+			next++
+			inflight++
+			timeout = time.After(delay)
+		}
 	}
 
-	var r dialResult
-	for j := 0; j < level; j++ {
-		r = <-lane
-		if r.Err == nil {
+	start()
+
+	var err error
+	for inflight > 0 || late != nil {
+		// wait for late addresses after all attempts failed, unless ctx is done
+		var done <-chan struct{}
+		if inflight == 0 {
+			done = ctx.Done()
+		}
+
+		select {
+		case r := <-lane:
+			inflight--
+			if r.Err != nil {
+				err = r.Err
+				// the attempt failed, start the next one without waiting for AttemptDelay.
+				start()
+				continue
+			}
+			if d.FamilyCache != nil {
+				d.FamilyCache.Set(hostname, r.IP.Unmap().Is6(), cmp.Or(d.FamilyCacheTTL, 10*time.Minute))
+			}
 			go func(count int) {
-				var r1 dialResult
 				for ; count > 0; count-- {
-					r1 = <-lane
-					if r1.Conn != nil {
+					if r1 := <-lane; r1.Conn != nil {
 						r1.Conn.Close()
 					}
 				}
-			}(level - 1 - j)
+			}(inflight)
 			return r.Conn, nil
+		case more := <-late:
+			late = nil
+			// alternate with the family of the last attempt
+			prefer6 := next > 0 && !ips[next-1].Unmap().Is6()
+			ips = append(ips[:next:next], interleaveAddrs(append(slices.Clone(ips[next:]), more...), prefer6)...)
+			if inflight == 0 || timeout == nil {
+				start()
+			}
+		case <-timeout:
+			timeout = nil
+			start()
+		case <-done:
+			return nil, ctx.Err()
 		}
 	}
 
-	return nil, r.Err
+	return nil, err
 }
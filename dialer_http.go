@@ -12,7 +12,10 @@ import (
 	"net/http"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/phuslu/log"
 )
 
 var _ Dialer = (*HTTPDialer)(nil)
@@ -30,18 +33,35 @@ type HTTPDialer struct {
 	ClientCert string
 	Dialer     Dialer
 
-	mu        sync.Mutex
+	// TCPFastOpen enables TCP_FASTOPEN_CONNECT if Dialer is a LocalDialer.
+	TCPFastOpen bool
+	// PoolSize is the number of pre-established connections to the proxy, which are consumed and refilled by CONNECT requests.
+	PoolSize        int
+	PoolIdleTimeout time.Duration
+	// Pipelining sends data after CONNECT request without waiting for the response, the response is read by first Read.
+	Pipelining bool
+
+	once      sync.Once
+	initErr   error
 	tlsConfig *tls.Config
+	pool      chan httpPoolConn
+	filling   atomic.Bool
 }
 
-func (d *HTTPDialer) init() error {
-	if d.Dialer != nil && d.UserAgent != "" {
-		return nil
-	}
+type httpPoolConn struct {
+	net.Conn
+	// timer closes the connection when it is idle for PoolIdleTimeout
+	timer *time.Timer
+}
 
-	d.mu.Lock()
-	defer d.mu.Unlock()
+func (d *HTTPDialer) init() error {
+	d.once.Do(func() {
+		d.initErr = d.load()
+	})
+	return d.initErr
+}
 
+func (d *HTTPDialer) load() error {
 	if d.Dialer == nil {
 		d.Dialer = &LocalDialer{}
 	}
@@ -50,8 +70,15 @@ func (d *HTTPDialer) init() error {
 		d.UserAgent = DefaultUserAgent
 	}
 
+	if ld, ok := d.Dialer.(*LocalDialer); ok && d.TCPFastOpen && !ld.TCPFastOpen {
+		dialer := new(LocalDialer)
+		*dialer = *ld
+		dialer.TCPFastOpen = true
+		d.Dialer = dialer
+	}
+
 	if d.IsTLS {
-		d.tlsConfig = &tls.Config{
+		tlsConfig := &tls.Config{
 			InsecureSkipVerify: d.Insecure,
 			ServerName:         d.Host,
 			ClientSessionCache: tls.NewLRUClientSessionCache(1024),
@@ -67,15 +94,90 @@ func (d *HTTPDialer) init() error {
 				return err
 			}
 
-			d.tlsConfig.RootCAs = x509.NewCertPool()
-			d.tlsConfig.RootCAs.AppendCertsFromPEM(caData)
-			d.tlsConfig.Certificates = []tls.Certificate{cert}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			tlsConfig.RootCAs.AppendCertsFromPEM(caData)
+			tlsConfig.Certificates = []tls.Certificate{cert}
 		}
+		d.tlsConfig = tlsConfig
+	}
+
+	if d.PoolSize > 0 {
+		if d.PoolIdleTimeout == 0 {
+			d.PoolIdleTimeout = 30 * time.Second
+		}
+		d.pool = make(chan httpPoolConn, d.PoolSize)
 	}
 
 	return nil
 }
 
+// refill dials connections until the pool is full, it runs on demand after the pool is consumed, so an idle dialer does not dial.
+func (d *HTTPDialer) refill() {
+	if !d.filling.CompareAndSwap(false, true) {
+		return
+	}
+	defer d.filling.Store(false)
+
+	for len(d.pool) < cap(d.pool) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		conn, err := d.dial(ctx, "tcp")
+		cancel()
+		if err != nil {
+			log.Debug().Err(err).Str("http_proxy_host", d.Host).Msg("http dialer fill pool error")
+			return
+		}
+
+		pc := httpPoolConn{conn, time.AfterFunc(d.PoolIdleTimeout, func() { conn.Close() })}
+		select {
+		case d.pool <- pc:
+		default:
+			pc.timer.Stop()
+			conn.Close()
+			return
+		}
+	}
+}
+
+// get returns a pooled connection which is not closed by idle timer.
+func (d *HTTPDialer) get() net.Conn {
+	for {
+		select {
+		case pc := <-d.pool:
+			if pc.timer.Stop() {
+				return pc.Conn
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+func (d *HTTPDialer) dial(ctx context.Context, network string) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, net.JoinHostPort(d.Host, d.Port))
+	if err != nil {
+		return nil, err
+	}
+
+	if !d.IsTLS {
+		return conn, nil
+	}
+
+	if d.tlsConfig == nil {
+		conn.Close()
+		return nil, errors.New("empty tls config")
+	}
+
+	tlsConn := tls.Client(conn, d.tlsConfig)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	log.Debug().Str("http_proxy_host", d.Host).Bool("tls_did_resume", tlsConn.ConnectionState().DidResume).Msg("http dialer tls handshake ok")
+
+	return tlsConn, nil
+}
+
 var CRLFCRLF = []byte{'\r', '\n', '\r', '\n'}
 
 func (d *HTTPDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -89,10 +191,29 @@ func (d *HTTPDialer) DialContext(ctx context.Context, network, addr string) (net
 		return nil, errors.New("proxy: no support for HTTP proxy connections of type " + network)
 	}
 
-	conn, err := d.Dialer.DialContext(ctx, network, net.JoinHostPort(d.Host, d.Port))
+	if d.pool != nil && network == "tcp" {
+		conn := d.get()
+		go d.refill()
+		if conn != nil {
+			c, err := d.connect(ctx, conn, addr)
+			if err == nil {
+				return c, nil
+			}
+			// the pooled connection may be closed by proxy server, retry with a new connection.
+			log.Debug().Err(err).Str("http_proxy_host", d.Host).Msg("http dialer pooled connection error")
+		}
+	}
+
+	conn, err := d.dial(ctx, network)
 	if err != nil {
 		return nil, err
 	}
+
+	return d.connect(ctx, conn, addr)
+}
+
+// connect sends CONNECT request on the connection to proxy, the connection is closed on error.
+func (d *HTTPDialer) connect(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
 	closeConn := &conn
 	defer func() {
 		if closeConn != nil {
@@ -100,18 +221,6 @@ func (d *HTTPDialer) DialContext(ctx context.Context, network, addr string) (net
 		}
 	}()
 
-	if d.IsTLS {
-		if d.tlsConfig == nil {
-			return nil, errors.New("empty tls config")
-		}
-		tlsConn := tls.Client(conn, d.tlsConfig)
-		err = tlsConn.HandshakeContext(ctx)
-		if err != nil {
-			return nil, err
-		}
-		conn = tlsConn
-	}
-
 	buf := make([]byte, 0, 2048)
 
 	buf = fmt.Appendf(buf, "CONNECT %s HTTP/1.1\r\n", addr)
@@ -126,20 +235,32 @@ func (d *HTTPDialer) DialContext(ctx context.Context, network, addr string) (net
 		return nil, errors.New("proxy: failed to write greeting to HTTP proxy at " + d.Host + ": " + err.Error())
 	}
 
-	// see https://github.com/golang/go/issues/5373
-	buf = buf[:cap(buf)]
-	for i := range buf {
-		buf[i] = 0
+	if d.Pipelining {
+		closeConn = nil
+		return &httpPipelinedConn{Conn: conn, dialer: d, addr: addr}, nil
 	}
 
-	b := buf
-	total := 0
-
 	if deadline, ok := ctx.Deadline(); ok {
 		conn.SetDeadline(deadline)
 		defer conn.SetDeadline(time.Time{})
 	}
 
+	conn, err := d.readResponse(conn, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	closeConn = nil
+	return conn, nil
+}
+
+func (d *HTTPDialer) readResponse(conn net.Conn, addr string) (net.Conn, error) {
+	// see https://github.com/golang/go/issues/5373
+	buf := make([]byte, 2048)
+
+	b := buf
+	total := 0
+
 	for {
 		n, err := conn.Read(buf)
 		if err != nil {
@@ -171,6 +292,26 @@ func (d *HTTPDialer) DialContext(ctx context.Context, network, addr string) (net
 		return nil, fmt.Errorf("proxy: failed to connect %s via %s: %s", addr, d.Host, bytes.TrimRight(b, "\x00"))
 	}
 
-	closeConn = nil
 	return conn, nil
 }
+
+// httpPipelinedConn reads the response of CONNECT request lazily.
+type httpPipelinedConn struct {
+	net.Conn
+	dialer *HTTPDialer
+	addr   string
+
+	once sync.Once
+	conn net.Conn
+	err  error
+}
+
+func (c *httpPipelinedConn) Read(b []byte) (int, error) {
+	c.once.Do(func() {
+		c.conn, c.err = c.dialer.readResponse(c.Conn, c.addr)
+	})
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.conn.Read(b)
+}
@@ -3,15 +3,17 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"io"
 	"net"
 	"net/http"
-	"net/http/httptrace"
 	"net/url"
+	"os"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
@@ -20,75 +22,184 @@ import (
 var _ Dialer = (*HTTP3Dialer)(nil)
 
 type HTTP3Dialer struct {
-	Username  string
-	Password  string
-	Host      string
-	Port      string
-	UserAgent string
-	Resolver  *Resolver
+	Username   string
+	Password   string
+	Host       string
+	Port       string
+	UserAgent  string
+	Insecure   bool
+	CACert     string
+	ClientKey  string
+	ClientCert string
+	MaxClients int // the number of pooled quic connections, default to 8
+	Resolver   *Resolver
 
+	KeepAlivePeriod         time.Duration
+	MaxIdleTimeout          time.Duration
+	HandshakeIdleTimeout    time.Duration
+	DisablePathMTUDiscovery bool
+
+	// Fallback is used for a while after quic handshake fails, e.g. udp is blocked.
+	Fallback         *HTTP2Dialer
+	FallbackDuration time.Duration
+
+	mu        sync.Mutex
+	tlsConfig atomic.Pointer[tls.Config]
+	clients   [64]http3Client
+
+	fallbackUntil atomic.Int64
+}
+
+// http3Client is a pooled quic connection, it shares one udp socket when reconnecting.
+type http3Client struct {
 	mu        sync.Mutex
-	transport atomic.Value // *http3.RoundTripper
+	transport *quic.Transport
+	conn      quic.EarlyConnection
+	rt        *http3.SingleDestinationRoundTripper
 }
 
-func (d *HTTP3Dialer) init() {
-	if d.transport.Load() != nil {
-		return
+func (d *HTTP3Dialer) init() error {
+	if d.tlsConfig.Load() != nil {
+		return nil
 	}
 
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	if d.transport.Load() != nil {
-		return
-	}
-
-	d.transport.Store(&http3.RoundTripper{
-		DisableCompression: false,
-		EnableDatagrams:    false,
-		Dial: func(ctx context.Context, addr string, tlsConf *tls.Config, conf *quic.Config) (quic.EarlyConnection, error) {
-			host := d.Host
-			if d.Resolver != nil {
-				if ips, err := d.Resolver.LookupNetIP(ctx, "ip", host); err == nil && len(ips) != 0 {
-					host = ips[fastrandn(uint32(len(ips)))].String()
-				}
-			}
-			pconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
-			if err != nil {
-				return nil, err
-			}
-			raddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, d.Port))
-			if err != nil {
-				return nil, err
-			}
-			return quic.DialEarly(ctx,
-				pconn,
-				raddr,
-				&tls.Config{
-					NextProtos:         []string{"h3"},
-					InsecureSkipVerify: false,
-					ServerName:         d.Host,
-					ClientSessionCache: tls.NewLRUClientSessionCache(1024),
-				},
-				&quic.Config{
-					DisablePathMTUDiscovery: false,
-					EnableDatagrams:         false,
-					MaxIncomingUniStreams:   200,
-					MaxIncomingStreams:      200,
-					// MaxStreamReceiveWindow:     6 * 1024 * 1024,
-					// MaxConnectionReceiveWindow: 15 * 1024 * 1024,
-				},
-			)
-		},
-	})
+	if d.tlsConfig.Load() != nil {
+		return nil
+	}
 
 	if d.UserAgent == "" {
 		d.UserAgent = DefaultUserAgent
 	}
+
+	if d.FallbackDuration == 0 {
+		d.FallbackDuration = 5 * time.Minute
+	}
+
+	tlsConfig := &tls.Config{
+		NextProtos:         []string{"h3"},
+		InsecureSkipVerify: d.Insecure,
+		ServerName:         d.Host,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1024),
+	}
+	if d.CACert != "" && d.ClientKey != "" && d.ClientCert != "" {
+		caData, err := os.ReadFile(d.CACert)
+		if err != nil {
+			return err
+		}
+
+		cert, err := tls.LoadX509KeyPair(d.ClientCert, d.ClientKey)
+		if err != nil {
+			return err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AppendCertsFromPEM(caData)
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	d.tlsConfig.Store(tlsConfig)
+
+	return nil
+}
+
+func (d *HTTP3Dialer) connect(ctx context.Context, c *http3Client) (*http3.SingleDestinationRoundTripper, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.rt != nil && c.conn.Context().Err() == nil {
+		return c.rt, nil
+	}
+
+	if c.transport == nil {
+		pconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+		if err != nil {
+			return nil, err
+		}
+		c.transport = &quic.Transport{Conn: pconn}
+	}
+
+	host := d.Host
+	if d.Resolver != nil {
+		if ips, err := d.Resolver.LookupNetIP(ctx, "ip", host); err == nil && len(ips) != 0 {
+			host = ips[fastrandn(uint32(len(ips)))].String()
+		}
+	}
+	raddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, d.Port))
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := c.transport.DialEarly(ctx,
+		raddr,
+		d.tlsConfig.Load(),
+		&quic.Config{
+			HandshakeIdleTimeout:    d.HandshakeIdleTimeout,
+			MaxIdleTimeout:          d.MaxIdleTimeout,
+			KeepAlivePeriod:         d.KeepAlivePeriod,
+			DisablePathMTUDiscovery: d.DisablePathMTUDiscovery,
+			EnableDatagrams:         true,
+			MaxIncomingUniStreams:   200,
+			MaxIncomingStreams:      200,
+			// MaxStreamReceiveWindow:     6 * 1024 * 1024,
+			// MaxConnectionReceiveWindow: 15 * 1024 * 1024,
+		},
+	)
+	if err != nil {
+		if d.Fallback != nil && ctx.Err() == nil {
+			d.fallbackUntil.Store(time.Now().Add(d.FallbackDuration).UnixNano())
+		}
+		return nil, err
+	}
+
+	c.conn = conn
+	c.rt = &http3.SingleDestinationRoundTripper{
+		Connection:         conn,
+		EnableDatagrams:    true,
+		DisableCompression: true,
+	}
+
+	return c.rt, nil
 }
 
 func (d *HTTP3Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	d.init()
+	if err := d.init(); err != nil {
+		return nil, err
+	}
+
+	var udp bool
+	switch network {
+	case "tcp", "tcp6", "tcp4":
+	case "udp", "udp6", "udp4":
+		udp = true
+	default:
+		return nil, errors.New("proxy: no support for HTTP3 proxy connections of type " + network)
+	}
+
+	if d.Fallback != nil && !udp && time.Now().UnixNano() < d.fallbackUntil.Load() {
+		return d.Fallback.DialContext(ctx, network, addr)
+	}
+
+	maxClient := d.MaxClients
+	if maxClient == 0 {
+		maxClient = 8
+	}
+
+	n := 1
+	if 0 < maxClient && maxClient < len(d.clients) {
+		n = maxClient
+	}
+	n = int(fastrandn(uint32(n)))
+
+	rt, err := d.connect(ctx, &d.clients[n])
+	if err != nil {
+		if d.Fallback != nil && !udp && time.Now().UnixNano() < d.fallbackUntil.Load() {
+			return d.Fallback.DialContext(ctx, network, addr)
+		}
+		return nil, err
+	}
 
 	req := &http.Request{
 		ProtoMajor: 3,
@@ -102,46 +213,82 @@ func (d *HTTP3Dialer) DialContext(ctx context.Context, network, addr string) (ne
 			"content-type": []string{"application/octet-stream"},
 			"user-agent":   []string{d.UserAgent},
 		},
-		Body:          nil,
-		ContentLength: -1,
+	}
+
+	if udp {
+		// RFC 9298 CONNECT-UDP is an extended CONNECT, which is allowed after SETTINGS of server are received.
+		hconn := rt.Start()
+		select {
+		case <-hconn.ReceivedSettings():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if settings := hconn.Settings(); !settings.EnableExtendedConnect || !settings.EnableDatagrams {
+			return nil, errors.New("proxy: " + d.Host + " does not support connect-udp")
+		}
+
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Proto = "connect-udp"
+		req.URL.Host = net.JoinHostPort(d.Host, d.Port)
+		req.URL.Path, req.URL.RawPath = MasqueUDPPath(host, port)
+		req.Host = req.URL.Host
+		req.Header = http.Header{
+			"capsule-protocol": []string{"?1"},
+			"user-agent":       []string{d.UserAgent},
+		}
 	}
 
 	if d.Username != "" && d.Password != "" {
 		req.Header.Set("proxy-authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(d.Username+":"+d.Password)))
 	}
 
-	var remoteAddr, localAddr net.Addr
+	str, err := rt.OpenRequestStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		str.SetDeadline(deadline)
+		defer str.SetDeadline(time.Time{})
+	}
 
-	req = req.WithContext(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
-		GotConn: func(connInfo httptrace.GotConnInfo) {
-			remoteAddr, localAddr = connInfo.Conn.RemoteAddr(), connInfo.Conn.LocalAddr()
-		},
-	}))
+	if err := str.SendRequestHeader(req); err != nil {
+		str.CancelRead(0)
+		str.Close()
+		return nil, err
+	}
 
-	resp, err := d.transport.Load().(*http3.RoundTripper).RoundTripOpt(req, http3.RoundTripOpt{OnlyCachedConn: false})
+	resp, err := str.ReadResponse()
 	if err != nil {
+		str.CancelRead(0)
+		str.Close()
 		return nil, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		data, _ := io.ReadAll(resp.Body)
-		_ = resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(str, 4096))
+		str.CancelRead(0)
+		str.Close()
 		return nil, errors.New("proxy: read from " + d.Host + " error: " + resp.Status + ": " + string(data))
 	}
 
-	streamer, ok := resp.Body.(http3.HTTPStreamer)
-	if !ok {
-		return nil, errors.New("proxy: read from " + d.Host + " error: resp body not implemented http3.HTTPStreamer")
-	}
-
-	if remoteAddr == nil || localAddr == nil {
-		remoteAddr, localAddr = &net.UDPAddr{}, &net.UDPAddr{}
+	hconn := rt.Start()
+	if udp {
+		return &MasqueConn{
+			Stream:     str,
+			remoteAddr: hconn.RemoteAddr(),
+			localAddr:  hconn.LocalAddr(),
+		}, nil
 	}
 
 	return &http3Stream{
-		Stream:     streamer.HTTPStream(),
-		remoteAddr: remoteAddr,
-		localAddr:  localAddr,
+		Stream:     str,
+		remoteAddr: hconn.RemoteAddr(),
+		localAddr:  hconn.LocalAddr(),
 	}, nil
 }
 
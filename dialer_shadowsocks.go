@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var _ Dialer = (*ShadowsocksDialer)(nil)
+
+type ShadowsocksDialer struct {
+	Method   string
+	Password string
+	Host     string
+	Port     string
+	Dialer   Dialer
+
+	mu     sync.Mutex
+	cipher *ShadowsocksCipher
+	key    []byte
+}
+
+func (d *ShadowsocksDialer) init() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.cipher != nil {
+		return nil
+	}
+
+	c, ok := ShadowsocksCiphers[d.Method]
+	if !ok {
+		return errors.New("shadowsocks: unsupported method " + d.Method)
+	}
+
+	key, err := c.Key(d.Password)
+	if err != nil {
+		return err
+	}
+
+	d.cipher, d.key = c, key
+
+	return nil
+}
+
+func (d *ShadowsocksDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp6", "tcp4":
+	default:
+		return nil, errors.New("shadowsocks: no support for connections of type " + network)
+	}
+
+	if err := d.init(); err != nil {
+		return nil, err
+	}
+
+	conn, err := d.Dialer.DialContext(ctx, "tcp", net.JoinHostPort(d.Host, d.Port))
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	sc, err := ShadowsocksClient(conn, d.cipher, d.key, addr)
+	if err != nil {
+		conn.Close()
+		return nil, errors.New("shadowsocks: failed to write request to " + d.Host + ": " + err.Error())
+	}
+
+	return sc, nil
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"io"
 	"net"
 	"net/netip"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -23,9 +25,22 @@ type Socks5Dialer struct {
 }
 
 func (d *Socks5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	conn, err := d.Dialer.DialContext(ctx, network, net.JoinHostPort(d.Host, d.Port))
+	switch network {
+	case "tcp", "tcp6", "tcp4":
+		conn, _, err := d.request(ctx, SocksCommandConnectTCP, addr)
+		return conn, err
+	case "udp", "udp6", "udp4":
+		return d.dialUDP(ctx, network, addr)
+	default:
+		return nil, errors.New("proxy: no support for SOCKS5 proxy connections of type " + network)
+	}
+}
+
+// request connects to SOCKS5 proxy, authenticates and sends command, it returns the control connection and bound address of reply.
+func (d *Socks5Dialer) request(ctx context.Context, cmd byte, addr string) (net.Conn, string, error) {
+	conn, err := d.Dialer.DialContext(ctx, "tcp", net.JoinHostPort(d.Host, d.Port))
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	closeConn := &conn
 	defer func() {
@@ -36,18 +51,18 @@ func (d *Socks5Dialer) DialContext(ctx context.Context, network, addr string) (n
 
 	host, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	port, err := strconv.Atoi(portStr)
 	if err != nil {
-		return nil, errors.New("proxy: failed to parse port number: " + portStr)
+		return nil, "", errors.New("proxy: failed to parse port number: " + portStr)
 	}
-	if port < 1 || port > 0xffff {
-		return nil, errors.New("proxy: port number out of range: " + portStr)
+	if port < 0 || port > 0xffff || (port == 0 && cmd == SocksCommandConnectTCP) {
+		return nil, "", errors.New("proxy: port number out of range: " + portStr)
 	}
 
-	if !d.Socks5H && d.Resolver != nil {
+	if !d.Socks5H && d.Resolver != nil && host != "" {
 		ips, err := d.Resolver.LookupNetIP(ctx, "ip", host)
 		if err == nil && len(ips) > 0 {
 			host = ips[0].String()
@@ -64,18 +79,23 @@ func (d *Socks5Dialer) DialContext(ctx context.Context, network, addr string) (n
 		buf = append(buf, 1 /* num auth methods */, Socks5AuthMethodNone)
 	}
 
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
 	if _, err := conn.Write(buf); err != nil {
-		return nil, errors.New("proxy: failed to write greeting to SOCKS5 proxy at " + d.Host + ": " + err.Error())
+		return nil, "", errors.New("proxy: failed to write greeting to SOCKS5 proxy at " + d.Host + ": " + err.Error())
 	}
 
 	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-		return nil, errors.New("proxy: failed to read greeting from SOCKS5 proxy at " + d.Host + ": " + err.Error())
+		return nil, "", errors.New("proxy: failed to read greeting from SOCKS5 proxy at " + d.Host + ": " + err.Error())
 	}
 	if buf[0] != 5 {
-		return nil, errors.New("proxy: SOCKS5 proxy at " + d.Host + " has unexpected version " + strconv.Itoa(int(buf[0])))
+		return nil, "", errors.New("proxy: SOCKS5 proxy at " + d.Host + " has unexpected version " + strconv.Itoa(int(buf[0])))
 	}
 	if buf[1] == 0xff {
-		return nil, errors.New("proxy: SOCKS5 proxy at " + d.Host + " requires authentication")
+		return nil, "", errors.New("proxy: SOCKS5 proxy at " + d.Host + " requires authentication")
 	}
 
 	if buf[1] == byte(Socks5AuthMethodPassword) {
@@ -87,92 +107,200 @@ func (d *Socks5Dialer) DialContext(ctx context.Context, network, addr string) (n
 		buf = append(buf, d.Password...)
 
 		if _, err := conn.Write(buf); err != nil {
-			return nil, errors.New("proxy: failed to write authentication request to SOCKS5 proxy at " + d.Host + ": " + err.Error())
+			return nil, "", errors.New("proxy: failed to write authentication request to SOCKS5 proxy at " + d.Host + ": " + err.Error())
 		}
 
 		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-			return nil, errors.New("proxy: failed to read authentication reply from SOCKS5 proxy at " + d.Host + ": " + err.Error())
+			return nil, "", errors.New("proxy: failed to read authentication reply from SOCKS5 proxy at " + d.Host + ": " + err.Error())
 		}
 
 		if buf[1] != 0 {
-			return nil, errors.New("proxy: SOCKS5 proxy at " + d.Host + " rejected username/password")
+			return nil, "", errors.New("proxy: SOCKS5 proxy at " + d.Host + " rejected username/password")
 		}
 	}
 
-	buf = buf[:0]
-	switch network {
-	case "tcp", "tcp6", "tcp4":
-		buf = append(buf, VersionSocks5, SocksCommandConnectTCP, 0 /* reserved */)
-	case "udp", "udp6", "udp4":
-		buf = append(buf, VersionSocks5, SocksCommandConnectUDP, 0 /* reserved */)
-	default:
-		return nil, errors.New("proxy: no support for SOCKS5 proxy connections of type " + network)
+	buf = append(buf[:0], VersionSocks5, cmd, 0 /* reserved */)
+	if buf, err = AppendSocksAddr(buf, net.JoinHostPort(host, strconv.Itoa(port))); err != nil {
+		return nil, "", errors.New("proxy: " + err.Error())
 	}
 
-	if ip, err := netip.ParseAddr(host); err == nil {
-		if ip.Is4() {
-			buf = append(buf, Socks5IPv4Address)
-		} else {
-			buf = append(buf, Socks5IPv6Address)
-		}
-		buf = append(buf, ip.AsSlice()...)
-	} else {
-		if len(host) > 255 {
-			return nil, errors.New("proxy: destination hostname too long: " + host)
+	if _, err := conn.Write(buf); err != nil {
+		return nil, "", errors.New("proxy: failed to write connect request to SOCKS5 proxy at " + d.Host + ": " + err.Error())
+	}
+
+	bindAddr, err := d.readReply(conn)
+	if err != nil {
+		return nil, "", err
+	}
+
+	closeConn = nil
+	return conn, bindAddr, nil
+}
+
+func (d *Socks5Dialer) readReply(conn net.Conn) (string, error) {
+	var buf [3]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return "", errors.New("proxy: failed to read connect reply from SOCKS5 proxy at " + d.Host + ": " + err.Error())
+	}
+
+	if status := Socks5Status(buf[1]); status > 0 {
+		return "", errors.New("proxy: SOCKS5 proxy at " + d.Host + " failed to connect: " + status.String())
+	}
+
+	addr, err := ReadSocksAddr(conn)
+	if err != nil {
+		return "", errors.New("proxy: failed to read address from SOCKS5 proxy at " + d.Host + ": " + err.Error())
+	}
+
+	return addr, nil
+}
+
+func (d *Socks5Dialer) dialUDP(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !d.Socks5H && d.Resolver != nil {
+		ips, err := d.Resolver.LookupNetIP(ctx, "ip", host)
+		if err == nil && len(ips) > 0 {
+			host = ips[0].String()
 		}
-		buf = append(buf, Socks5DomainName)
-		buf = append(buf, byte(len(host)))
-		buf = append(buf, host...)
 	}
-	buf = append(buf, byte(port>>8), byte(port))
 
-	if deadline, ok := ctx.Deadline(); ok {
-		conn.SetDeadline(deadline)
-		defer conn.SetDeadline(time.Time{})
+	header := []byte{0, 0, 0 /* fragment */}
+	if header, err = AppendSocksAddr(header, net.JoinHostPort(host, portStr)); err != nil {
+		return nil, errors.New("proxy: " + err.Error())
 	}
 
-	if _, err := conn.Write(buf); err != nil {
-		return nil, errors.New("proxy: failed to write connect request to SOCKS5 proxy at " + d.Host + ": " + err.Error())
+	// the client address of udp associate is unknown before dialing the relay, so send an all-zero address
+	ctrl, relay, err := d.request(ctx, SocksCommandConnectUDP, "0.0.0.0:0")
+	if err != nil {
+		return nil, err
 	}
 
-	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
-		return nil, errors.New("proxy: failed to read connect reply from SOCKS5 proxy at " + d.Host + ": " + err.Error())
+	// the relay address may be unspecified, then the proxy host is used
+	relayHost, relayPort, _ := net.SplitHostPort(relay)
+	if ip, err := netip.ParseAddr(relayHost); err == nil && ip.IsUnspecified() {
+		relay = net.JoinHostPort(d.Host, relayPort)
 	}
 
-	if status := Socks5Status(buf[1]); status > 0 {
-		return nil, errors.New("proxy: SOCKS5 proxy at " + d.Host + " failed to connect: " + status.String())
+	conn, err := d.Dialer.DialContext(ctx, network, relay)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
 	}
 
-	bytesToDiscard := 0
-	switch buf[3] {
-	case Socks5IPv4Address:
-		bytesToDiscard = net.IPv4len
-	case Socks5IPv6Address:
-		bytesToDiscard = net.IPv6len
-	case Socks5DomainName:
-		_, err := io.ReadFull(conn, buf[:1])
+	c := &Socks5UDPConn{
+		Conn:   conn,
+		ctrl:   ctrl,
+		addr:   socks5Addr{"udp", net.JoinHostPort(host, portStr)},
+		header: header,
+	}
+
+	// the association terminates when the control connection closes
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		c.Close()
+	}()
+
+	return c, nil
+}
+
+var _ net.PacketConn = (*Socks5UDPConn)(nil)
+
+// Socks5UDPConn adds and strips SOCKS5 UDP request headers on a udp connection to the relay.
+// It implements net.PacketConn, so it works as a packet connection of net.Resolver.
+type Socks5UDPConn struct {
+	net.Conn
+
+	ctrl   net.Conn
+	addr   socks5Addr
+	header []byte
+
+	once sync.Once
+	mu   sync.Mutex
+	buf  []byte
+}
+
+func (c *Socks5UDPConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+func (c *Socks5UDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// the header is up to 262 bytes, 3 bytes of fragment and 259 bytes of domain address
+	if cap(c.buf) < len(b)+262 {
+		c.buf = make([]byte, len(b)+262)
+	}
+	buf := c.buf[:len(b)+262]
+
+	for {
+		n, err := c.Conn.Read(buf)
 		if err != nil {
-			return nil, errors.New("proxy: failed to read domain length from SOCKS5 proxy at " + d.Host + ": " + err.Error())
+			return 0, nil, err
 		}
-		bytesToDiscard = int(buf[0])
-	default:
-		return nil, errors.New("proxy: got unknown address type " + strconv.Itoa(int(buf[3])) + " from SOCKS5 proxy at " + d.Host)
+
+		// fragmented datagrams are dropped
+		if n < 3 || buf[2] != 0 {
+			continue
+		}
+
+		r := bytes.NewReader(buf[3:n])
+		addr, err := ReadSocksAddr(r)
+		if err != nil {
+			continue
+		}
+
+		return copy(b, buf[n-r.Len():n]), socks5Addr{"udp", addr}, nil
 	}
+}
 
-	if cap(buf) < bytesToDiscard {
-		buf = make([]byte, bytesToDiscard)
-	} else {
-		buf = buf[:bytesToDiscard]
+func (c *Socks5UDPConn) Write(b []byte) (int, error) {
+	buf := make([]byte, 0, len(c.header)+len(b))
+	buf = append(buf, c.header...)
+	buf = append(buf, b...)
+
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
 	}
-	if _, err := io.ReadFull(conn, buf); err != nil {
-		return nil, errors.New("proxy: failed to read address from SOCKS5 proxy at " + d.Host + ": " + err.Error())
+
+	return len(b), nil
+}
+
+func (c *Socks5UDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	header := []byte{0, 0, 0 /* fragment */}
+	header, err := AppendSocksAddr(header, addr.String())
+	if err != nil {
+		return 0, err
 	}
 
-	// Also need to discard the port number
-	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-		return nil, errors.New("proxy: failed to read port from SOCKS5 proxy at " + d.Host + ": " + err.Error())
+	if _, err := c.Conn.Write(append(header, b...)); err != nil {
+		return 0, err
 	}
 
-	closeConn = nil
-	return conn, nil
+	return len(b), nil
+}
+
+func (c *Socks5UDPConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *Socks5UDPConn) Close() (err error) {
+	c.once.Do(func() {
+		c.ctrl.Close()
+		err = c.Conn.Close()
+	})
+	return
 }
+
+type socks5Addr struct {
+	network string
+	addr    string
+}
+
+func (a socks5Addr) Network() string { return a.network }
+func (a socks5Addr) String() string  { return a.addr }
@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
 	"net"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
+	"github.com/phuslu/log"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/crypto/ssh/knownhosts"
 )
 
@@ -17,63 +21,289 @@ type SSHDialer struct {
 	Username              string
 	Password              string
 	PrivateKey            string
+	PrivateKeyFile        string // read on every connect, so a rotated key takes effect after reconnecting
+	Passphrase            string
+	Certificate           string // openssh certificate of private key, e.g. ~/.ssh/id_ed25519-cert.pub
+	Agent                 bool   // authenticate by keys of ssh-agent in SSH_AUTH_SOCK
 	Host                  string
 	Port                  string
 	StrictHostKeyChecking bool
 	UserKnownHostsFile    string
 	MaxClients            int
 	Timeout               time.Duration
+	KeepAliveInterval     time.Duration
+	KeepAliveCountMax     int
+	Jump                  string // name of another ssh dialer, it connects to this host like ProxyJump
 	Dialer                Dialer
 
 	mutexes [64]sync.Mutex
 	clients [64]*ssh.Client
 }
 
-func (d *SSHDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	connect := func() (*ssh.Client, error) {
-		config := &ssh.ClientConfig{
-			User: d.Username,
-			Auth: []ssh.AuthMethod{
-				ssh.Password(d.Password),
-			},
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-			Timeout:         d.Timeout,
+func (d *SSHDialer) signers() ([]ssh.Signer, error) {
+	key := []byte(d.PrivateKey)
+	if d.PrivateKeyFile != "" {
+		data, err := os.ReadFile(d.PrivateKeyFile)
+		if err != nil {
+			return nil, err
 		}
-		if d.PrivateKey != "" {
-			signer, err := ssh.ParsePrivateKey([]byte(d.PrivateKey))
-			if err != nil {
-				return nil, err
+		key = data
+	}
+	if len(key) == 0 {
+		return nil, nil
+	}
+
+	var signer ssh.Signer
+	var err error
+	if d.Passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(d.Passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if d.Certificate == "" {
+		return []ssh.Signer{signer}, nil
+	}
+
+	data, err := os.ReadFile(d.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("ssh: " + d.Certificate + " is not a certificate")
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	// certificate is preferred, the plain key is a fallback for servers without a trusted CA.
+	return []ssh.Signer{certSigner, signer}, nil
+}
+
+// sshKnownHostsMu serializes appending host keys to known_hosts files.
+var sshKnownHostsMu sync.Mutex
+
+func (d *SSHDialer) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	file := d.UserKnownHostsFile
+	if file == "" {
+		file = os.ExpandEnv("$HOME/.ssh/known_hosts")
+	}
+
+	if !d.StrictHostKeyChecking {
+		// the accepted host keys are recorded in a new file like openssh
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err == nil {
+			if f, err := os.OpenFile(file, os.O_RDONLY|os.O_CREATE, 0600); err == nil {
+				f.Close()
 			}
-			config.Auth = append([]ssh.AuthMethod{ssh.PublicKeys(signer)}, config.Auth...)
 		}
+	}
+
+	cb, err := knownhosts.New(file)
+	if err != nil {
 		if d.StrictHostKeyChecking {
-			file := d.UserKnownHostsFile
-			if file == "" {
-				file = os.ExpandEnv("$HOME/.ssh/known_hosts")
-			}
-			cb, err := knownhosts.New(file)
-			if err != nil {
-				return nil, err
-			}
-			config.HostKeyCallback = cb
+			return nil, err
 		}
-		dialer := d.Dialer
-		if dialer == nil {
-			dialer = &net.Dialer{Timeout: d.Timeout}
+		log.Warn().Err(err).Str("ssh_host", d.Host).Str("known_hosts", file).Msg("ssh read known_hosts error, host key is not verified")
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	if d.StrictHostKeyChecking {
+		return cb, nil
+	}
+
+	// like StrictHostKeyChecking=accept-new, unknown hosts are accepted and appended to the file, but changed host keys are rejected.
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := cb(hostname, remote, key)
+		var ke *knownhosts.KeyError
+		if !errors.As(err, &ke) || len(ke.Want) != 0 {
+			return err
 		}
-		ctx, cancel := context.WithTimeout(ctx, config.Timeout)
-		defer cancel()
-		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(d.Host, d.Port))
+
+		sshKnownHostsMu.Lock()
+		defer sshKnownHostsMu.Unlock()
+
+		// the host may be added by another connection
+		if cb, err := knownhosts.New(file); err == nil {
+			if err = cb(hostname, remote, key); !errors.As(err, &ke) || len(ke.Want) != 0 {
+				return err
+			}
+		}
+
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
 		if err != nil {
-			return nil, err
+			log.Warn().Err(err).Str("ssh_host", hostname).Str("known_hosts", file).Msg("ssh append known_hosts error, host key is accepted")
+			return nil
+		}
+		defer f.Close()
+
+		line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key) + "\n"
+		if data, _ := os.ReadFile(file); len(data) > 0 && data[len(data)-1] != '\n' {
+			line = "\n" + line
 		}
-		c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+		if _, err := f.WriteString(line); err != nil {
+			log.Warn().Err(err).Str("ssh_host", hostname).Str("known_hosts", file).Msg("ssh append known_hosts error, host key is accepted")
+			return nil
+		}
+
+		log.Info().Str("ssh_host", hostname).Str("known_hosts", file).Str("fingerprint", ssh.FingerprintSHA256(key)).Msg("ssh add host key to known_hosts")
+		return nil
+	}, nil
+}
+
+func (d *SSHDialer) connect(ctx context.Context) (*ssh.Client, error) {
+	signers, err := d.signers()
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := d.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ssh.ClientConfig{
+		User:            d.Username,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         d.Timeout,
+	}
+
+	if len(signers) != 0 {
+		config.Auth = append(config.Auth, ssh.PublicKeys(signers...))
+	}
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); d.Agent && sock != "" {
+		conn, err := net.Dial("unix", sock)
 		if err != nil {
 			return nil, err
 		}
-		return ssh.NewClient(c, chans, reqs), nil
+		defer conn.Close()
+		config.Auth = append(config.Auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
 	}
 
+	if d.Password != "" {
+		config.Auth = append(config.Auth, ssh.Password(d.Password))
+	}
+
+	dialer := d.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: d.Timeout}
+	}
+
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Timeout)
+		defer cancel()
+	}
+
+	address := net.JoinHostPort(d.Host, d.Port)
+
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, address, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+func (d *SSHDialer) client(ctx context.Context, n int) (*ssh.Client, error) {
+	d.mutexes[n].Lock()
+	defer d.mutexes[n].Unlock()
+
+	if c := d.clients[n]; c != nil {
+		return c, nil
+	}
+
+	c, err := d.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	d.clients[n] = c
+	if d.KeepAliveInterval > 0 {
+		go d.keepalive(n, c)
+	}
+
+	return c, nil
+}
+
+func (d *SSHDialer) evict(n int, c *ssh.Client) {
+	c.Close()
+
+	d.mutexes[n].Lock()
+	if d.clients[n] == c {
+		d.clients[n] = nil
+	}
+	d.mutexes[n].Unlock()
+}
+
+// keepalive sends keepalive@openssh.com requests like ServerAliveInterval, and evicts the client when it is dead.
+func (d *SSHDialer) keepalive(n int, c *ssh.Client) {
+	done := make(chan struct{})
+	go func() {
+		c.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(d.KeepAliveInterval)
+	defer ticker.Stop()
+
+	var failures int
+	for {
+		select {
+		case <-done:
+			d.evict(n, c)
+			return
+		case <-ticker.C:
+		}
+
+		errc := make(chan error, 1)
+		go func() {
+			_, _, err := c.SendRequest("keepalive@openssh.com", true, nil)
+			errc <- err
+		}()
+
+		select {
+		case err := <-errc:
+			if err == nil {
+				failures = 0
+				continue
+			}
+		case <-time.After(d.KeepAliveInterval):
+		case <-done:
+			d.evict(n, c)
+			return
+		}
+
+		if failures++; failures >= max(d.KeepAliveCountMax, 1) {
+			log.Warn().Str("ssh_host", d.Host).Str("ssh_port", d.Port).Int("ssh_client_index", n).Int("keepalive_failures", failures).Msg("ssh client keepalive timeout, evict it")
+			d.evict(n, c)
+			return
+		}
+	}
+}
+
+func (d *SSHDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	maxClient := d.MaxClients
 	if maxClient == 0 {
 		maxClient = 1
@@ -85,30 +315,29 @@ func (d *SSHDialer) DialContext(ctx context.Context, network, addr string) (net.
 	}
 	n = int(fastrandn(uint32(n)))
 
-	if d.clients[n] == nil {
-		d.mutexes[n].Lock()
-		c, err := connect()
-		if err != nil {
-			d.mutexes[n].Unlock()
-			return nil, err
-		}
-		d.clients[n] = c
-		d.mutexes[n].Unlock()
+	c, err := d.client(ctx, n)
+	if err != nil {
+		return nil, err
 	}
 
-	conn, err := d.clients[n].Dial(network, addr)
-	if err != nil {
-		time.Sleep(time.Duration(100+fastrandn(200)) * time.Millisecond)
-		old := d.clients[n]
-		d.mutexes[n].Lock()
-		if d.clients[n] == old {
-			d.clients[n], err = connect()
-		}
-		d.mutexes[n].Unlock()
-		if c := d.clients[n]; c != nil && c != old {
-			conn, err = c.Dial(network, addr)
-		}
+	conn, err := c.DialContext(ctx, network, addr)
+	if err == nil {
+		return conn, nil
+	}
+
+	// the remote host refused the channel, the client is healthy.
+	var oce *ssh.OpenChannelError
+	if errors.As(err, &oce) || ctx.Err() != nil {
+		return nil, err
+	}
+
+	// the client may be dead, reconnect it once.
+	d.evict(n, c)
+	time.Sleep(time.Duration(100+fastrandn(200)) * time.Millisecond)
+
+	if c, err = d.client(ctx, n); err != nil {
+		return nil, err
 	}
 
-	return conn, err
+	return c.DialContext(ctx, network, addr)
 }
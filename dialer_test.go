@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestInterleaveAddrs(t *testing.T) {
+	parse := func(ss ...string) (ips []netip.Addr) {
+		for _, s := range ss {
+			ips = append(ips, netip.MustParseAddr(s))
+		}
+		return
+	}
+
+	cases := []struct {
+		IPs     []netip.Addr
+		Prefer6 bool
+		Result  []netip.Addr
+	}{
+		{parse("1.1.1.1", "1.0.0.1", "2606:4700::1111", "2606:4700::1001"), true, parse("2606:4700::1111", "1.1.1.1", "2606:4700::1001", "1.0.0.1")},
+		{parse("1.1.1.1", "1.0.0.1", "2606:4700::1111", "2606:4700::1001"), false, parse("1.1.1.1", "2606:4700::1111", "1.0.0.1", "2606:4700::1001")},
+		{parse("1.1.1.1", "1.0.0.1", "2606:4700::1111"), true, parse("2606:4700::1111", "1.1.1.1", "1.0.0.1")},
+		{parse("1.1.1.1", "1.0.0.1"), true, parse("1.1.1.1", "1.0.0.1")},
+	}
+
+	for _, c := range cases {
+		if result := interleaveAddrs(c.IPs, c.Prefer6); !slices.Equal(result, c.Result) {
+			t.Errorf("interleaveAddrs(%v, %v) must return %v, not %v", c.IPs, c.Prefer6, c.Result, result)
+		}
+	}
+}
+
+// serveSocks5UDP serves a minimal SOCKS5 proxy without auth, which only supports UDP ASSOCIATE.
+func serveSocks5UDP(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				b := make([]byte, 256)
+				io.ReadFull(conn, b[:2])
+				io.ReadFull(conn, b[:b[1]])
+				conn.Write([]byte{VersionSocks5, 0})
+				io.ReadFull(conn, b[:3])
+				if _, err := ReadSocksAddr(conn); err != nil || b[1] != SocksCommandConnectUDP {
+					return
+				}
+
+				relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+				if err != nil {
+					return
+				}
+				defer relay.Close()
+
+				reply, _ := AppendSocksAddr([]byte{VersionSocks5, 0, 0}, relay.LocalAddr().String())
+				conn.Write(reply)
+
+				go func() {
+					var client net.Addr
+					buf := make([]byte, 2048)
+					for {
+						n, addr, err := relay.ReadFrom(buf)
+						if err != nil {
+							return
+						}
+						if client == nil || addr.String() == client.String() {
+							client = addr
+							r := bytes.NewReader(buf[3:n])
+							target, err := ReadSocksAddr(r)
+							if err != nil {
+								continue
+							}
+							if raddr, err := net.ResolveUDPAddr("udp", target); err == nil {
+								relay.WriteTo(buf[n-r.Len():n], raddr)
+							}
+						} else {
+							header, _ := AppendSocksAddr([]byte{0, 0, 0}, addr.String())
+							relay.WriteTo(append(header, buf[:n]...), client)
+						}
+					}
+				}()
+
+				io.Copy(io.Discard, conn)
+			}(conn)
+		}
+	}()
+
+	return ln
+}
+
+func TestSocks5DialerResolver(t *testing.T) {
+	// a dns server which answers 192.0.2.1 for every A query
+	dns, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dns.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := dns.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if msg.Unpack(buf[:n]) != nil || len(msg.Questions) == 0 {
+				continue
+			}
+			msg.Header.Response = true
+			if msg.Questions[0].Type == dnsmessage.TypeA {
+				msg.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: msg.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+				}}
+			}
+			if b, err := msg.Pack(); err == nil {
+				dns.WriteTo(b, addr)
+			}
+		}
+	}()
+
+	ln := serveSocks5UDP(t)
+	defer ln.Close()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	dialers := map[string]Dialer{
+		"socks": &Socks5Dialer{Host: host, Port: port, Dialer: &net.Dialer{}},
+	}
+
+	dial, err := NewResolverDialer("udp://"+dns.LocalAddr().String()+"?dialer=socks", dialers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ips, err := (&net.Resolver{PreferGo: true, Dial: dial}).LookupNetIP(ctx, "ip4", "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || ips[0] != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("lookup example.org via socks5 must return 192.0.2.1, not %v", ips)
+	}
+}
+
+func TestLocalDialerLookupNetIP(t *testing.T) {
+	cases := []struct {
+		Delay4 time.Duration
+		Delay6 time.Duration
+		IPs    string
+		Late   string
+	}{
+		// connect at once after AAAA records arrive
+		{300 * time.Millisecond, 0, "[2001:db8::1]", "[192.0.2.1]"},
+		// wait the resolution delay for AAAA records after A records arrive
+		{0, 10 * time.Millisecond, "[192.0.2.1 2001:db8::1]", ""},
+		{0, 300 * time.Millisecond, "[192.0.2.1]", "[2001:db8::1]"},
+	}
+
+	for _, c := range cases {
+		answer := func(q dnsmessage.Question) (dnsmessage.RCode, []dnsmessage.Resource) {
+			header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60}
+			switch q.Type {
+			case dnsmessage.TypeA:
+				time.Sleep(c.Delay4)
+				return dnsmessage.RCodeSuccess, []dnsmessage.Resource{{Header: header, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}}}
+			case dnsmessage.TypeAAAA:
+				time.Sleep(c.Delay6)
+				return dnsmessage.RCodeSuccess, []dnsmessage.Resource{{Header: header, Body: &dnsmessage.AAAAResource{AAAA: netip.MustParseAddr("2001:db8::1").As16()}}}
+			}
+			return dnsmessage.RCodeSuccess, nil
+		}
+
+		var queries atomic.Int32
+		d := &LocalDialer{
+			Resolver:     &Resolver{Resolver: &net.Resolver{PreferGo: true, Dial: fakeDNSDial(answer, &queries)}},
+			Concurrency:  2,
+			AttemptDelay: time.Second,
+		}
+
+		start := time.Now()
+		ips, late, err := d.lookupNetIP(context.Background(), "tcp", "a.example.org")
+		if err != nil {
+			t.Fatalf("lookupNetIP(%+v) error: %+v", c, err)
+		}
+		if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+			t.Errorf("lookupNetIP(%+v) must not wait for the other family, elapsed %v", c, elapsed)
+		}
+		if fmt.Sprint(ips) != c.IPs {
+			t.Errorf("lookupNetIP(%+v) must return %v, not %v", c, c.IPs, ips)
+		}
+		switch {
+		case c.Late == "" && late != nil:
+			t.Errorf("lookupNetIP(%+v) must not return late addresses", c)
+		case c.Late != "":
+			if more := <-late; fmt.Sprint(more) != c.Late {
+				t.Errorf("lookupNetIP(%+v) must return late addresses %v, not %v", c, c.Late, more)
+			}
+		}
+	}
+}
+
+func TestLocalDialerDialParallelLate(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+
+	// nothing listens on ::1, the late address of A record is attempted after the failure
+	late := make(chan []netip.Addr, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		late <- []netip.Addr{netip.MustParseAddr("127.0.0.1")}
+	}()
+
+	d := &LocalDialer{Concurrency: 2, AttemptDelay: time.Second}
+	conn, err := d.dialParallel(context.Background(), "tcp", "localhost", []netip.Addr{netip.MustParseAddr("::1")}, late, port, nil)
+	if err != nil {
+		t.Fatalf("dialParallel must connect to the late address, error: %+v", err)
+	}
+	defer conn.Close()
+
+	if addr := conn.RemoteAddr().String(); addr != ln.Addr().String() {
+		t.Errorf("dialParallel must connect to %v, not %v", ln.Addr(), addr)
+	}
+}
+
+func TestSSHDialerHostKeyCallback(t *testing.T) {
+	newKey := func() ssh.PublicKey {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	file := filepath.Join(t.TempDir(), ".ssh", "known_hosts")
+	d := &SSHDialer{UserKnownHostsFile: file}
+	remote := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}
+	key := newKey()
+
+	// the unknown host key is accepted and appended to the new file
+	cb, err := d.hostKeyCallback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cb("example.org:22", remote, key); err != nil {
+		t.Fatalf("hostKeyCallback must accept new host key, error: %+v", err)
+	}
+	if data, _ := os.ReadFile(file); !bytes.Contains(data, []byte("example.org "+key.Type())) {
+		t.Errorf("hostKeyCallback must append host key to %s, not %q", file, data)
+	}
+
+	// the changed host key is rejected
+	cb, err = d.hostKeyCallback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cb("example.org:22", remote, key); err != nil {
+		t.Errorf("hostKeyCallback must accept known host key, error: %+v", err)
+	}
+	if err := cb("example.org:22", remote, newKey()); err == nil {
+		t.Errorf("hostKeyCallback must reject changed host key")
+	}
+
+	// the unknown host key is rejected by strict checking
+	d.StrictHostKeyChecking = true
+	if cb, err = d.hostKeyCallback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cb("example.net:22", remote, newKey()); err == nil {
+		t.Errorf("hostKeyCallback must reject unknown host key of strict checking")
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var _ Dialer = (*TunnelDialer)(nil)
+
+// TunnelDialer dials through a connected tunnel client which has allow_egress enabled.
+type TunnelDialer struct {
+	Client string
+	Server string
+	Tunnel *TunnelHandler
+}
+
+func (d *TunnelDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.Tunnel == nil {
+		return nil, errors.New("tunnel: no tunnel server for client " + d.Client)
+	}
+
+	return d.Tunnel.DialEgress(ctx, d.Client, network, addr)
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"crypto/sha1"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
@@ -14,6 +13,8 @@ import (
 	"strconv"
 	"sync"
 	"time"
+
+	"golang.org/x/net/http2"
 )
 
 var _ Dialer = (*WebsocketDialer)(nil)
@@ -24,10 +25,12 @@ type WebsocketDialer struct {
 	Password       string
 	UserAgent      string
 	Insecure       bool
+	HTTP2          bool // RFC 8441 extended CONNECT over HTTP/2
 	Dialer         Dialer
 
-	mu        sync.Mutex
-	transport *http.Transport
+	mu          sync.Mutex
+	transport   *http.Transport
+	h2transport *http2.Transport
 }
 
 func (d *WebsocketDialer) init() error {
@@ -47,6 +50,31 @@ func (d *WebsocketDialer) init() error {
 		return err
 	}
 
+	if d.HTTP2 {
+		d.h2transport = &http2.Transport{
+			MaxReadFrameSize:   1024 * 1024,
+			DisableCompression: false,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := d.Dialer.DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				tlsConn := tls.Client(conn, cfg)
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return tlsConn, nil
+			},
+			TLSClientConfig: &tls.Config{
+				NextProtos:         []string{"h2"},
+				InsecureSkipVerify: d.Insecure,
+				ServerName:         u.Hostname(),
+				ClientSessionCache: tls.NewLRUClientSessionCache(1024),
+			},
+		}
+	}
+
 	d.transport = &http.Transport{
 		DisableCompression: false,
 		DialContext:        d.Dialer.DialContext,
@@ -81,6 +109,10 @@ func (d *WebsocketDialer) DialContext(ctx context.Context, network, addr string)
 		return nil, err
 	}
 
+	if d.HTTP2 {
+		return d.dialHTTP2(ctx, fmt.Sprintf(d.EndpointFormat, host, port))
+	}
+
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(d.EndpointFormat, host, port), nil)
 	if err != nil {
 		return nil, err
@@ -93,8 +125,7 @@ func (d *WebsocketDialer) DialContext(ctx context.Context, network, addr string)
 		req.Header.Set("user-agent", d.UserAgent)
 	}
 
-	secWebsocketKey := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%x%x\n", fastrandn(1<<32-1), fastrandn(1<<32-1))))
-	secWebsocketAccept := sha1.Sum([]byte(secWebsocketKey + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	secWebsocketKey := NewWebsocketKey()
 
 	req.Header.Set("Connection", "Upgrade")
 	req.Header.Set("Upgrade", "websocket")
@@ -107,11 +138,13 @@ func (d *WebsocketDialer) DialContext(ctx context.Context, network, addr string)
 	}
 
 	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
 		return nil, fmt.Errorf("proxy: failed to get greeting to HTTP proxy at %s: %d", host, resp.StatusCode)
 	}
 
-	if s := resp.Header.Get("Sec-WebSocket-Accept"); s != "" && s != base64.StdEncoding.EncodeToString(secWebsocketAccept[:]) {
-		return nil, fmt.Errorf("proxy: failed to get sec-websocket-accept to HTTP proxy at " + host + ": " + s)
+	if s := resp.Header.Get("Sec-WebSocket-Accept"); s != WebsocketAcceptKey(secWebsocketKey) {
+		resp.Body.Close()
+		return nil, errors.New("proxy: failed to get sec-websocket-accept to HTTP proxy at " + host + ": " + s)
 	}
 
 	rwc, ok := resp.Body.(io.ReadWriteCloser)
@@ -119,16 +152,64 @@ func (d *WebsocketDialer) DialContext(ctx context.Context, network, addr string)
 		return nil, fmt.Errorf("proxy: failed to get io.ReadWriteCloser")
 	}
 
-	conn := &websocketStream{
-		rwc:    rwc,
-		local:  &net.TCPAddr{},
-		remote: &net.TCPAddr{},
+	conn := &WebsocketConn{
+		Conn: &websocketStream{
+			rwc:    rwc,
+			local:  &net.TCPAddr{},
+			remote: &net.TCPAddr{},
+		},
+		Client: true,
 	}
 
 	return conn, nil
+}
+
+// dialHTTP2 opens a websocket by extended CONNECT of RFC 8441, the server answers 200 and frames data on the stream.
+func (d *WebsocketDialer) dialHTTP2(ctx context.Context, endpoint string) (net.Conn, error) {
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodConnect, endpoint, pr)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = -1
+
+	if d.Username != "" && d.Password != "" {
+		req.Header.Set("proxy-authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(d.Username+":"+d.Password)))
+	}
+	if d.UserAgent != "" {
+		req.Header.Set("user-agent", d.UserAgent)
+	}
+
+	req.Header.Set(":protocol", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
 
+	resp, err := d.h2transport.RoundTrip(req)
+	if err != nil {
+		pw.Close()
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		pw.Close()
+		return nil, fmt.Errorf("proxy: failed to get greeting to HTTP proxy at %s: %d", req.URL.Host, resp.StatusCode)
+	}
+
+	conn := &WebsocketConn{
+		Conn: &http2Stream{
+			r:          resp.Body,
+			w:          pw,
+			closed:     make(chan struct{}),
+			remoteAddr: &net.TCPAddr{},
+			localAddr:  &net.TCPAddr{},
+		},
+		Client: true,
+	}
+
+	return conn, nil
 }
 
+// websocketStream adapts the body of a upgraded response or a extended CONNECT request to net.Conn.
 type websocketStream struct {
 	rwc    io.ReadWriteCloser
 	local  net.Addr
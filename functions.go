@@ -1,15 +1,28 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/netip"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"text/template"
 	"time"
 
@@ -21,44 +34,78 @@ import (
 
 type Functions struct {
 	RegionResolver *RegionResolver
+	PoisonedIPs    *PoisonedIPs
 	GeoSite        *geosite.DomainListCommunity
 	Singleflight   *singleflight_Group[string, string]
 	IPListCache    *lru.TTLCache[string, *string]
 	GeoSiteCache   *lru.TTLCache[string, *string]
 	RegexpCache    *xsync.MapOf[string, *regexp.Regexp]
 
+	// GeoSiteSources are local paths and urls of domain-list-community tarballs, the first loaded one is used.
+	// Urls are loaded from GeoSiteCacheFile at startup, they are fetched at once if no source is loaded.
+	GeoSiteSources []string
+	// GeoSiteCacheFile keeps the last good tarball fetched from urls.
+	GeoSiteCacheFile string
+	// GeoSiteChecksum is the sha256 hex of tarballs, or a path or an url of sha256sum file. The cache file is verified too.
+	// A sha256 hex could not be pinned to a branch url, e.g. geosite.OnlineTarball.
+	GeoSiteChecksum string
+	// GeoSiteRefresh is the interval of fetching urls, zero disables it.
+	GeoSiteRefresh time.Duration
+
+	// geoSiteLists indexes the includes of lists, so that "cn" matches the sites of geolocation-cn.
+	geoSiteLists atomic.Pointer[GeoSiteLists]
+
 	FuncMap template.FuncMap
 }
 
 func (f *Functions) Load() error {
-	if names, _ := filepath.Glob("*domain-list-community*.tar.gz"); len(names) > 0 {
-		for _, name := range names {
-			if err := f.GeoSite.Load(context.Background(), name); err != nil {
-				return err
-			}
+	if len(f.GeoSiteSources) == 0 {
+		names, _ := filepath.Glob("*domain-list-community*.tar.gz")
+		f.GeoSiteSources = append(names, geosite.OnlineTarball)
+	}
+
+	if isGeoSiteChecksum(f.GeoSiteChecksum) {
+		// a branch is moved by every commit, its tarball never matches a pinned checksum
+		if i := slices.IndexFunc(f.GeoSiteSources, func(s string) bool { return isGeoSiteURL(s) && strings.Contains(s, "/refs/heads/") }); i >= 0 {
+			return errors.New("geosite: pinned checksum never matches the branch url " + f.GeoSiteSources[i] + ", pin a tag or a commit in the url, or use a sha256sum file as checksum")
 		}
-	} else {
-		if err := f.GeoSite.Load(context.Background(), geosite.InlineTarball); err != nil {
+	}
+
+	loaded, err := f.loadGeoSite(context.Background())
+	if err != nil {
+		log.Warn().Err(err).Strs("geosite_sources", f.GeoSiteSources).Msg("geosite load error, fallback to inline tarball")
+		if err := f.loadGeoSiteData(context.Background(), []byte(geosite.InlineTarball)); err != nil {
 			return err
 		}
 	}
 
-	go func() {
-		for range time.Tick(time.Hour) {
-			if err := f.GeoSite.Load(context.Background(), geosite.OnlineTarball); err != nil {
-				log.Error().Err(err).Str("geosite_online_tarball", geosite.OnlineTarball).Msg("geosite load error")
+	if slices.ContainsFunc(f.GeoSiteSources, isGeoSiteURL) {
+		go func() {
+			// fetch urls at once if no source is loaded, e.g. the cache is absent
+			if loaded == "" {
+				f.refreshGeoSite(context.Background())
 			}
-		}
-	}()
+			if f.GeoSiteRefresh <= 0 {
+				return
+			}
+			for range time.Tick(f.GeoSiteRefresh) {
+				f.refreshGeoSite(context.Background())
+			}
+		}()
+	}
 
 	f.FuncMap = template.FuncMap{}
+	f.FuncMap["asn"] = f.asn
 	f.FuncMap["city"] = f.city
+	f.FuncMap["continent"] = f.continent
 	f.FuncMap["country"] = f.country
 	f.FuncMap["geoip"] = f.geoip
 	f.FuncMap["geosite"] = f.geosite
 	f.FuncMap["greased"] = f.greased
 	f.FuncMap["host"] = f.host
 	f.FuncMap["iplist"] = f.iplist
+	f.FuncMap["iptype"] = f.iptype
+	f.FuncMap["isp"] = f.isp
 	f.FuncMap["readfile"] = f.readfile
 	f.FuncMap["region"] = f.region
 
@@ -75,6 +122,166 @@ func (f *Functions) Load() error {
 	return nil
 }
 
+func isGeoSiteURL(s string) bool {
+	return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://")
+}
+
+// loadGeoSite loads the first available source at startup, urls are replaced by the cache file. It returns the loaded source.
+func (f *Functions) loadGeoSite(ctx context.Context) (string, error) {
+	var err error
+	for _, source := range f.GeoSiteSources {
+		filename := source
+		if isGeoSiteURL(source) {
+			if f.GeoSiteCacheFile == "" {
+				continue
+			}
+			filename = f.GeoSiteCacheFile
+		}
+
+		var data []byte
+		if data, err = os.ReadFile(filename); err != nil {
+			continue
+		}
+		if err = f.verifyGeoSite(ctx, data); err != nil {
+			continue
+		}
+
+		if err = f.loadGeoSiteData(ctx, data); err == nil {
+			log.Info().Str("geosite_source", source).Str("geosite_file", filename).Int("geosite_size", len(data)).Msg("geosite load ok")
+			return source, nil
+		}
+	}
+
+	if err == nil {
+		err = errors.New("geosite: no available source")
+	}
+
+	return "", err
+}
+
+// loadGeoSiteData loads a tarball to GeoSite and indexes its lists.
+func (f *Functions) loadGeoSiteData(ctx context.Context, data []byte) error {
+	lists, err := ParseGeoSiteLists(data)
+	if err != nil {
+		return err
+	}
+
+	if err := f.GeoSite.Load(ctx, string(data)); err != nil {
+		return err
+	}
+
+	f.geoSiteLists.Store(lists)
+
+	return nil
+}
+
+// refreshGeoSite fetches urls of sources in order, the first good tarball is loaded and saved to the cache file.
+func (f *Functions) refreshGeoSite(ctx context.Context) {
+	for _, source := range f.GeoSiteSources {
+		if !isGeoSiteURL(source) {
+			continue
+		}
+
+		err := func() error {
+			ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+			defer cancel()
+
+			data, err := f.fetchGeoSite(ctx, source)
+			if err != nil {
+				return err
+			}
+
+			if err = f.verifyGeoSite(ctx, data); err != nil {
+				return err
+			}
+
+			if err = f.loadGeoSiteData(ctx, data); err != nil {
+				return err
+			}
+
+			if f.GeoSiteCacheFile != "" {
+				// write to a temporary file and rename it, so that the cache is never partial
+				tmp := f.GeoSiteCacheFile + ".tmp"
+				if err = os.WriteFile(tmp, data, 0644); err == nil {
+					err = os.Rename(tmp, f.GeoSiteCacheFile)
+				}
+				if err != nil {
+					log.Error().Err(err).Str("geosite_cache_file", f.GeoSiteCacheFile).Msg("geosite save cache error")
+				}
+			}
+
+			log.Info().Str("geosite_source", source).Int("geosite_size", len(data)).Msg("geosite refresh ok")
+			return nil
+		}()
+		if err == nil {
+			return
+		}
+
+		log.Error().Err(err).Str("geosite_source", source).Msg("geosite refresh error")
+	}
+}
+
+func (f *Functions) fetchGeoSite(ctx context.Context, url string) ([]byte, error) {
+	transport := f.GeoSite.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("geosite: fetch " + url + " error: " + resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// isGeoSiteChecksum reports whether s is a sha256 hex, other than a path or an url of sha256sum file.
+func isGeoSiteChecksum(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && len(s) == sha256.Size*2
+}
+
+// verifyGeoSite checks the sha256 of data against GeoSiteChecksum, if any.
+func (f *Functions) verifyGeoSite(ctx context.Context, data []byte) error {
+	checksum := f.GeoSiteChecksum
+	if checksum == "" {
+		return nil
+	}
+
+	if !isGeoSiteChecksum(checksum) {
+		// the first field of sha256sum file
+		var body []byte
+		var err error
+		if isGeoSiteURL(checksum) {
+			body, err = f.fetchGeoSite(ctx, checksum)
+		} else {
+			body, err = os.ReadFile(checksum)
+		}
+		if err != nil {
+			return err
+		}
+		if fields := strings.Fields(string(body)); len(fields) != 0 {
+			checksum = fields[0]
+		}
+	}
+
+	if sum := sha256.Sum256(data); !strings.EqualFold(hex.EncodeToString(sum[:]), checksum) {
+		return errors.New("geosite: checksum mismatch, expected " + checksum + ", got " + hex.EncodeToString(sum[:]))
+	}
+
+	return nil
+}
+
 func (f *Functions) host(hostport string) string {
 	if host, _, err := net.SplitHostPort(hostport); err == nil {
 		return host
@@ -83,52 +290,114 @@ func (f *Functions) host(hostport string) string {
 }
 
 type GeoipInfo struct {
-	Country string
-	Region  string
-	City    string
+	Country   string
+	Region    string
+	City      string
+	Continent string
+	ASN       uint
+	ISP       string
 }
 
-func (f *Functions) geoip(ip string) GeoipInfo {
-	if s, _, err := net.SplitHostPort(ip); err == nil {
-		ip = s
+func (f *Functions) geoip(host string) GeoipInfo {
+	ip := f.geoipAddr(host)
+	if ip == nil {
+		return GeoipInfo{Country: "ZZ"}
 	}
 
-	if net.ParseIP(ip) == nil {
-		ips, _ := f.RegionResolver.Resolver.LookupNetIP(context.Background(), "ip", ip)
+	info := f.geoipCity(ip)
+	info.ASN, _, _ = f.RegionResolver.LookupASN(context.Background(), ip)
+	info.ISP, _ = f.RegionResolver.LookupISP(context.Background(), ip)
+
+	log.Debug().IPAddr("ip", ip).Str("country", info.Country).Str("region", info.Region).Str("city", info.City).Str("continent", info.Continent).Uint("asn", info.ASN).Str("isp", info.ISP).Msg("get city by ip")
+
+	return info
+}
+
+// geoipAddr returns the ip of host, a domain is resolved to its first address. It returns nil for poisoned addresses.
+func (f *Functions) geoipAddr(host string) net.IP {
+	if s, _, err := net.SplitHostPort(host); err == nil {
+		host = s
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		ips, _ := f.RegionResolver.Resolver.LookupNetIP(context.Background(), "ip", host)
 		if len(ips) == 0 {
-			return GeoipInfo{Country: "ZZ"}
+			return nil
 		}
-		ip = ips[0].String()
+		addr = ips[0]
 	}
 
-	var country, region, city string
-	if f.RegionResolver.MaxmindReader != nil {
-		country, region, city, _ = f.RegionResolver.LookupCity(context.Background(), net.ParseIP(ip))
+	if f.PoisonedIPs.Contains(addr) {
+		return nil
 	}
 
-	if country == "CN" && IsBogusChinaIP(net.ParseIP(ip)) {
+	return net.IP(addr.Unmap().AsSlice())
+}
+
+// geoipCity decodes the city record of ip once, the asn and isp are not looked up.
+func (f *Functions) geoipCity(ip net.IP) (info GeoipInfo) {
+	if ip == nil {
 		return GeoipInfo{Country: "ZZ"}
 	}
 
-	log.Debug().Str("ip", ip).Str("country", country).Str("region", region).Str("city", city).Msg("get city by ip")
+	if f.RegionResolver.CityReader == nil {
+		return
+	}
+
+	record, _ := f.RegionResolver.lookupCity(ip)
 
-	return GeoipInfo{
-		Country: country,
-		Region:  region,
-		City:    city,
+	info.Country = record.Country.ISOCode
+	if len(record.Subdivisions) != 0 {
+		info.Region = record.Subdivisions[0].Names.EN
 	}
+	info.City = record.City.Names.EN
+	info.Continent = record.Continent.Code
+
+	return
 }
 
 func (f *Functions) country(ip string) string {
-	return f.geoip(ip).Country
+	return f.geoipCity(f.geoipAddr(ip)).Country
 }
 
 func (f *Functions) region(ip string) string {
-	return f.geoip(ip).Region
+	return f.geoipCity(f.geoipAddr(ip)).Region
 }
 
 func (f *Functions) city(ip string) string {
-	return f.geoip(ip).City
+	return f.geoipCity(f.geoipAddr(ip)).City
+}
+
+func (f *Functions) continent(ip string) string {
+	return f.geoipCity(f.geoipAddr(ip)).Continent
+}
+
+func (f *Functions) asn(ip string) uint {
+	asn, _, _ := f.RegionResolver.LookupASN(context.Background(), f.geoipAddr(ip))
+	return asn
+}
+
+func (f *Functions) isp(ip string) string {
+	isp, _ := f.RegionResolver.LookupISP(context.Background(), f.geoipAddr(ip))
+	return isp
+}
+
+func (f *Functions) iptype(ip string) string {
+	if s, _, err := net.SplitHostPort(ip); err == nil {
+		ip = s
+	}
+
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		return IPType(addr)
+	}
+
+	ips, _ := f.RegionResolver.Resolver.LookupNetIP(context.Background(), "ip", ip)
+	if len(ips) == 0 {
+		return ""
+	}
+
+	return IPType(ips[0])
 }
 
 func (f *Functions) greased(info *tls.ClientHelloInfo) bool {
@@ -179,20 +448,131 @@ func (f *Functions) iplist(iplistUrl string) string {
 	return data
 }
 
-func (f *Functions) geosite(domain string) string {
+// geosite returns the site of domain. If filters are given, e.g. "cn", "google@cn", "@ads" and "openai",
+// it returns the first filter which matches the site and attributes of domain, or an empty string.
+// The name of a filter matches the site itself and the lists which include it, e.g. "cn" matches baidu.com and www.gov.cn.
+func (f *Functions) geosite(domain string, filters ...string) string {
 	if host, _, err := net.SplitHostPort(domain); err == nil {
 		domain = host
 	}
 
-	if v, _ := f.GeoSiteCache.Get(domain); v != nil {
-		return *v
+	// cached as site@attr1@attr2
+	v, _ := f.GeoSiteCache.Get(domain)
+	if v == nil {
+		site, attrs := f.GeoSite.SiteAttrs(domain)
+		s := strings.Join(append([]string{site}, attrs...), "@")
+		v = &s
+		f.GeoSiteCache.Set(domain, v, 24*time.Hour)
+	}
+
+	site, attrs, _ := strings.Cut(*v, "@")
+	if len(filters) == 0 {
+		return site
+	}
+
+	lists := f.geoSiteLists.Load()
+	for _, filter := range filters {
+		name, attr, _ := strings.Cut(filter, "@")
+		if name != "" && name != site && (lists == nil || !lists.Contains(name, site, domain)) {
+			continue
+		}
+		if attr != "" && !slices.Contains(strings.Split(attrs, "@"), attr) {
+			continue
+		}
+		return filter
+	}
+
+	return ""
+}
+
+// GeoSiteLists indexes the includes and top level domains of domain-list-community lists, which are skipped by geosite.DomainListCommunity.
+type GeoSiteLists struct {
+	// Parents maps a list to the lists which include it, directly or indirectly.
+	Parents map[string][]string
+	// TLDs maps a top level domain to the lists which contain it, e.g. "cn" of tld-cn.
+	TLDs map[string][]string
+}
+
+func ParseGeoSiteLists(tarball []byte) (*GeoSiteLists, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(tarball))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	includes := make(map[string][]string)
+	lists := &GeoSiteLists{
+		Parents: make(map[string][]string),
+		TLDs:    make(map[string][]string),
+	}
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg || path.Base(path.Dir(header.Name)) != "data" {
+			continue
+		}
+
+		name := path.Base(header.Name)
+		scanner := bufio.NewScanner(tr)
+		for scanner.Scan() {
+			line, _, _ := strings.Cut(scanner.Text(), "#")
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			switch s := fields[0]; {
+			case strings.HasPrefix(s, "include:"):
+				child := strings.TrimPrefix(s, "include:")
+				includes[child] = append(includes[child], name)
+			case !strings.ContainsAny(s, ".:"):
+				lists.TLDs[s] = append(lists.TLDs[s], name)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
 	}
 
-	site := f.GeoSite.Site(domain)
+	// includes may be nested and even cyclic
+	for child := range includes {
+		seen := map[string]bool{child: true}
+		queue := slices.Clone(includes[child])
+		for len(queue) > 0 {
+			name := queue[0]
+			queue = queue[1:]
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			lists.Parents[child] = append(lists.Parents[child], name)
+			queue = append(queue, includes[name]...)
+		}
+	}
 
-	f.GeoSiteCache.Set(domain, &site, 24*time.Hour)
+	return lists, nil
+}
 
-	return site
+// Contains reports whether the list contains the site or the top level domain of domain.
+func (lists *GeoSiteLists) Contains(list, site, domain string) bool {
+	if site != "" && (site == list || slices.Contains(lists.Parents[site], list)) {
+		return true
+	}
+
+	tld := domain[strings.LastIndexByte(domain, '.')+1:]
+	for _, name := range lists.TLDs[tld] {
+		if name == list || slices.Contains(lists.Parents[name], list) {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (f *Functions) readfile(filename string) string {
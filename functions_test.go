@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/phuslu/geosite"
+	"github.com/phuslu/lru"
+)
+
+func TestFunctionsGeoSite(t *testing.T) {
+	f := &Functions{
+		GeoSite:      &geosite.DomainListCommunity{},
+		GeoSiteCache: lru.NewTTLCache[string, *string](128),
+	}
+	if err := f.loadGeoSiteData(context.Background(), []byte(geosite.InlineTarball)); err != nil {
+		t.Fatalf("Functions.loadGeoSiteData(geosite.InlineTarball) error: %+v", err)
+	}
+
+	cases := []struct {
+		Domain  string
+		Filters []string
+		Result  string
+	}{
+		{"www.google.com:443", nil, "google"},
+		{"www.google.com", []string{"google"}, "google"},
+		{"www.google.com", []string{"google@cn"}, ""},
+		{"www.google.cn", []string{"google@cn"}, "google@cn"},
+		{"www.google.cn", []string{"@cn"}, "@cn"},
+		{"www.google.cn", []string{"openai", "@ads", "google@cn"}, "google@cn"},
+		{"www.apple.com", []string{"apple@cn"}, "apple@cn"},
+		{"apple.com", []string{"apple@cn", "apple"}, "apple"},
+		{"baidu.com", []string{"cn"}, "cn"},
+		{"baidu.com", []string{"cn@ads"}, ""},
+		{"www.gov.cn", []string{"cn"}, "cn"},
+		{"www.gov.cn", []string{"@cn"}, ""},
+		{"example.invalid", []string{"cn", "@cn"}, ""},
+	}
+
+	for _, c := range cases {
+		if result := f.geosite(c.Domain, c.Filters...); result != c.Result {
+			t.Errorf("geosite(%#v, %#v) must return %#v, not %#v", c.Domain, c.Filters, c.Result, result)
+		}
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/phuslu/log"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type DnsRequest struct {
+	RemoteAddr string
+	RemoteIP   string
+	ServerAddr string
+	Proto      string
+	Domain     string
+	QType      string
+	TraceID    log.XID
+}
+
+type DnsHandler struct {
+	Config         DnsConfig
+	ForwardLogger  log.Logger
+	RegionResolver *RegionResolver
+	Resolver       *Resolver
+	Functions      template.FuncMap
+
+	PolicyTemplate *template.Template
+
+	// upstream dials the dns server of resolver, it is used by queries other than A and AAAA.
+	upstream func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+func (h *DnsHandler) Load() error {
+	var err error
+
+	if s := h.Config.Policy; s != "" {
+		if h.PolicyTemplate, err = template.New(s).Funcs(h.Functions).Parse(s); err != nil {
+			return err
+		}
+	}
+
+	if h.Config.FakeIP && h.Resolver.FakeIP == nil {
+		return errors.New("dns: fake_ip requires global dns_fake_ip")
+	}
+
+	h.upstream = h.Resolver.Resolver.Dial
+	if h.upstream == nil {
+		// the system resolver, use the first nameserver of resolv.conf
+		addr := "127.0.0.1:53"
+		if file, err := os.Open("/etc/resolv.conf"); err == nil {
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				if fields := strings.Fields(scanner.Text()); len(fields) >= 2 && fields[0] == "nameserver" {
+					addr = net.JoinHostPort(fields[1], "53")
+					break
+				}
+			}
+			file.Close()
+		}
+		// the nameserver is this handler if resolv.conf points to it, then queries loop back until timeout
+		for _, listen := range h.Config.Listen {
+			if dnsIsListenAddr(addr, listen) {
+				return errors.New("dns: nameserver " + addr + " of /etc/resolv.conf is the listener " + listen + ", set global dns_server")
+			}
+		}
+		dialer := &net.Dialer{Timeout: 2 * time.Second}
+		h.upstream = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "udp", addr)
+		}
+	}
+
+	return nil
+}
+
+// dnsIsListenAddr reports whether the nameserver addr is served by the listen address, an unspecified listen
+// address serves the loopback and interface addresses.
+func dnsIsListenAddr(addr, listen string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	lhost, lport, err := net.SplitHostPort(listen)
+	if err != nil || port != lport {
+		return false
+	}
+
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+
+	if lhost == "localhost" {
+		return ip.IsLoopback()
+	}
+	if lhost != "" {
+		lip, err := netip.ParseAddr(lhost)
+		if err != nil {
+			return false
+		}
+		if lip = lip.Unmap(); !lip.IsUnspecified() {
+			return lip == ip
+		}
+	}
+
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if prefix, err := netip.ParsePrefix(a.String()); err == nil && prefix.Addr().Unmap() == ip {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dnsMaxUDPSize is the max udp payload size of queries and responses, as recommended by RFC 6891.
+const dnsMaxUDPSize = 4096
+
+// dnsPacketPool holds the buffers of udp queries.
+var dnsPacketPool = sync.Pool{
+	New: func() any { return new([dnsMaxUDPSize]byte) },
+}
+
+// ServePacketConn serves dns queries over udp.
+func (h *DnsHandler) ServePacketConn(pc net.PacketConn) {
+	for {
+		buf := dnsPacketPool.Get().(*[dnsMaxUDPSize]byte)
+		n, addr, err := pc.ReadFrom(buf[:])
+		if err != nil {
+			dnsPacketPool.Put(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Error().Err(err).Str("server_addr", pc.LocalAddr().String()).Msg("dns read udp packet error")
+			continue
+		}
+
+		go func(buf *[dnsMaxUDPSize]byte, query []byte, addr net.Addr) {
+			defer dnsPacketPool.Put(buf)
+
+			req := &DnsRequest{
+				RemoteAddr: addr.String(),
+				ServerAddr: pc.LocalAddr().String(),
+				Proto:      "udp",
+			}
+
+			resp := h.Exchange(context.Background(), req, query)
+			if resp == nil {
+				return
+			}
+
+			if size := dnsUDPSize(query); len(resp) > size {
+				resp = dnsTruncate(resp)
+			}
+
+			pc.WriteTo(resp, addr)
+		}(buf, buf[:n], addr)
+	}
+}
+
+// ServeConn serves dns queries over tcp or tls, a connection may carry multiple queries.
+func (h *DnsHandler) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	proto := "tcp"
+	if tc, ok := conn.(*tls.Conn); ok {
+		proto = "tls"
+		tc.SetDeadline(time.Now().Add(10 * time.Second))
+		if err := tc.Handshake(); err != nil {
+			log.Debug().Err(err).Str("server_addr", conn.LocalAddr().String()).Str("remote_addr", conn.RemoteAddr().String()).Msg("dns tls handshake error")
+			return
+		}
+	}
+
+	for {
+		// idle timeout of RFC 7766
+		conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+		var b [2]byte
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return
+		}
+
+		query := make([]byte, binary.BigEndian.Uint16(b[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		req := &DnsRequest{
+			RemoteAddr: conn.RemoteAddr().String(),
+			ServerAddr: conn.LocalAddr().String(),
+			Proto:      proto,
+		}
+
+		resp := h.Exchange(context.Background(), req, query)
+		if resp == nil {
+			return
+		}
+
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// Exchange answers a dns query, it returns nil if the query is malformed.
+func (h *DnsHandler) Exchange(ctx context.Context, req *DnsRequest, query []byte) []byte {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+
+	question, err := p.Question()
+	if err != nil {
+		return dnsReply(header, nil, dnsmessage.RCodeFormatError, nil, 0)
+	}
+
+	req.RemoteIP, _, _ = net.SplitHostPort(req.RemoteAddr)
+	req.Domain = strings.TrimSuffix(question.Name.String(), ".")
+	req.QType = strings.TrimPrefix(question.Type.String(), "Type")
+	req.TraceID = log.NewXID()
+
+	var output string
+	if h.PolicyTemplate != nil {
+		var sb strings.Builder
+		err := h.PolicyTemplate.Execute(&sb, struct {
+			Request    *DnsRequest
+			ServerAddr string
+		}{req, req.ServerAddr})
+		if err != nil {
+			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("dns_policy", h.Config.Policy).Msg("execute dns policy error")
+			return dnsReply(header, &question, dnsmessage.RCodeServerFailure, nil, 0)
+		}
+
+		output = strings.TrimSpace(sb.String())
+		log.Debug().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Interface("request", req).Str("dns_policy_output", output).Msg("execute dns policy ok")
+	}
+
+	resp := h.answer(ctx, req, header, question, query, output)
+
+	if h.Config.Log {
+		var country, region, city string
+		if h.RegionResolver != nil && h.RegionResolver.CityReader != nil {
+			country, region, city, _ = h.RegionResolver.LookupCity(ctx, net.ParseIP(req.RemoteIP))
+		}
+		var asn uint
+		if h.RegionResolver != nil {
+			asn, _, _ = h.RegionResolver.LookupASN(ctx, net.ParseIP(req.RemoteIP))
+		}
+		h.ForwardLogger.Info().Stringer("trace_id", req.TraceID).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("remote_country", country).Str("remote_region", region).Str("remote_city", city).Uint("remote_asn", asn).Str("dns_proto", req.Proto).Str("dns_domain", req.Domain).Str("dns_qtype", req.QType).Str("dns_policy_output", output).Int("dns_response_size", len(resp)).Msg("dns request end")
+	}
+
+	return resp
+}
+
+func (h *DnsHandler) answer(ctx context.Context, req *DnsRequest, header dnsmessage.Header, question dnsmessage.Question, query []byte, output string) []byte {
+	domain := req.Domain
+	switch output {
+	case "", "pass", "forward":
+		break
+	case "reject", "deny", "nxdomain":
+		return dnsReply(header, &question, dnsmessage.RCodeNameError, nil, 0)
+	case "refused":
+		return dnsReply(header, &question, dnsmessage.RCodeRefused, nil, 0)
+	case "nodata":
+		return dnsReply(header, &question, dnsmessage.RCodeSuccess, nil, 0)
+	default:
+		// a list of ips rewrites the answer, otherwise the answer is the ips of another domain.
+		var ips []netip.Addr
+		for _, s := range strings.FieldsFunc(output, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' }) {
+			if ip, err := netip.ParseAddr(s); err == nil {
+				ips = append(ips, ip)
+			}
+		}
+		if len(ips) > 0 {
+			return dnsReply(header, &question, dnsmessage.RCodeSuccess, ips, uint32(max(h.Resolver.CacheDuration, time.Second)/time.Second))
+		}
+		domain = output
+	}
+
+	var network string
+	switch question.Type {
+	case dnsmessage.TypeA:
+		network = "ip4"
+	case dnsmessage.TypeAAAA:
+		network = "ip6"
+	default:
+		if domain != req.Domain {
+			return dnsReply(header, &question, dnsmessage.RCodeSuccess, nil, 0)
+		}
+		resp, err := h.forward(ctx, domain, query)
+		if err != nil {
+			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("dns_domain", req.Domain).Str("dns_qtype", req.QType).Msg("dns forward query error")
+			return dnsReply(header, &question, dnsmessage.RCodeServerFailure, nil, 0)
+		}
+		return resp
+	}
+
+	if h.Config.FakeIP && h.Resolver.FakeIP.Match(domain) {
+		// the ttl is short, so that clients query again after the mapping is recycled
+		if ip, ok := h.Resolver.FakeIP.Allocate(network, domain); ok {
+			return dnsReply(header, &question, dnsmessage.RCodeSuccess, []netip.Addr{ip}, 1)
+		}
+		return dnsReply(header, &question, dnsmessage.RCodeSuccess, nil, 0)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	ips, ttl, err := h.Resolver.LookupNetIPWithTTL(ctx, network, domain)
+	if err != nil {
+		// the domain may exist without records of this type
+		if _, err := h.Resolver.LookupNetIP(ctx, "ip", domain); err == nil {
+			return dnsReply(header, &question, dnsmessage.RCodeSuccess, nil, 0)
+		}
+		var de *net.DNSError
+		if errors.As(err, &de) && de.IsNotFound {
+			return dnsReply(header, &question, dnsmessage.RCodeNameError, nil, 0)
+		}
+		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("dns_domain", req.Domain).Str("dns_qtype", req.QType).Msg("dns lookup error")
+		return dnsReply(header, &question, dnsmessage.RCodeServerFailure, nil, 0)
+	}
+
+	return dnsReply(header, &question, dnsmessage.RCodeSuccess, ips, uint32(max(ttl, time.Second)/time.Second))
+}
+
+// forward sends the raw query to the resolvers routed by dns rules of domain, they are tried in order.
+func (h *DnsHandler) forward(ctx context.Context, domain string, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	resolvers, _, _ := h.Resolver.Route(domain)
+
+	var resp []byte
+	var err error
+	for _, resolver := range resolvers {
+		dial := resolver.Dial
+		if dial == nil {
+			dial = h.upstream
+		}
+		if resp, err = dnsExchange(ctx, dial, query); err == nil {
+			return resp, nil
+		}
+	}
+
+	return nil, err
+}
+
+func dnsReply(header dnsmessage.Header, question *dnsmessage.Question, rcode dnsmessage.RCode, ips []netip.Addr, ttl uint32) []byte {
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		OpCode:             header.OpCode,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	b.EnableCompression()
+
+	b.StartQuestions()
+	if question == nil {
+		msg, _ := b.Finish()
+		return msg
+	}
+	b.Question(*question)
+
+	b.StartAnswers()
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		rh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: ttl}
+		switch {
+		case ip.Is4() && question.Type == dnsmessage.TypeA:
+			b.AResource(rh, dnsmessage.AResource{A: ip.As4()})
+		case ip.Is6() && question.Type == dnsmessage.TypeAAAA:
+			b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: ip.As16()})
+		}
+	}
+
+	msg, _ := b.Finish()
+	return msg
+}
+
+// dnsMinTTL returns the min ttl of answers in response, see RFC 8484 section 5.1.
+func dnsMinTTL(resp []byte) int {
+	var p dnsmessage.Parser
+	if _, err := p.Start(resp); err != nil {
+		return 0
+	}
+	if p.SkipAllQuestions() != nil {
+		return 0
+	}
+
+	answers, _ := p.AllAnswers()
+	if len(answers) == 0 {
+		return 0
+	}
+
+	ttl := answers[0].Header.TTL
+	for _, rr := range answers[1:] {
+		ttl = min(ttl, rr.Header.TTL)
+	}
+
+	return int(ttl)
+}
+
+// dnsUDPSize returns the max udp payload size of query, see RFC 6891.
+func dnsUDPSize(query []byte) int {
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err != nil {
+		return 512
+	}
+	if p.SkipAllQuestions() != nil || p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+		return 512
+	}
+
+	additionals, _ := p.AllAdditionals()
+	for _, rr := range additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			return min(max(int(rr.Header.Class), 512), dnsMaxUDPSize)
+		}
+	}
+
+	return 512
+}
+
+// dnsTruncate returns the header and question of response with TC bit, so that client retries over tcp.
+func dnsTruncate(resp []byte) []byte {
+	var p dnsmessage.Parser
+	header, err := p.Start(resp)
+	if err != nil {
+		return nil
+	}
+
+	question, err := p.Question()
+	if err != nil {
+		return nil
+	}
+
+	header.Truncated = true
+
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), header)
+	b.StartQuestions()
+	b.Question(question)
+
+	msg, _ := b.Finish()
+	return msg
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestDnsIsListenAddr(t *testing.T) {
+	cases := []struct {
+		Addr   string
+		Listen string
+		Match  bool
+	}{
+		{"127.0.0.1:53", "127.0.0.1:53", true},
+		{"127.0.0.1:53", ":53", true},
+		{"127.0.0.53:53", "0.0.0.0:53", true},
+		{"[::1]:53", "[::]:53", true},
+		{"127.0.0.1:53", "localhost:53", true},
+		{"127.0.0.1:53", "127.0.0.1:5353", false},
+		{"127.0.0.53:53", "127.0.0.1:53", false},
+		{"192.0.2.1:53", ":53", false},
+		{"8.8.8.8:53", "127.0.0.1:53", false},
+	}
+
+	for _, c := range cases {
+		if match := dnsIsListenAddr(c.Addr, c.Listen); match != c.Match {
+			t.Errorf("dnsIsListenAddr(%#v, %#v) must return %v, not %v", c.Addr, c.Listen, c.Match, match)
+		}
+	}
+}
@@ -48,6 +48,10 @@ var RequestInfoContextKey = struct {
 	name string
 }{"request-info"}
 
+var ConnContextKey = struct {
+	name string
+}{"conn"}
+
 var riPool = sync.Pool{
 	New: func() interface{} {
 		return new(RequestInfo)
@@ -91,9 +95,10 @@ func (h *HTTPServerHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 	}
 
 	ri.UserAgent, _, _ = h.UserAgentMap.Get(req.Header.Get("User-Agent"))
-	if h.RegionResolver.MaxmindReader != nil {
+	if h.RegionResolver.CityReader != nil {
 		ri.GeoipInfo.Country, ri.GeoipInfo.Region, ri.GeoipInfo.City, _ = h.RegionResolver.LookupCity(context.Background(), net.ParseIP(ri.RemoteIP))
 	}
+	ri.GeoipInfo.ASN, _, _ = h.RegionResolver.LookupASN(context.Background(), net.ParseIP(ri.RemoteIP))
 
 	ri.TraceID = log.NewXID()
 
@@ -113,6 +118,7 @@ func (h *HTTPServerHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 		Str("remote_country", ri.GeoipInfo.Country).
 		Str("remote_region", ri.GeoipInfo.Region).
 		Str("remote_city", ri.GeoipInfo.City).
+		Uint("remote_asn", ri.GeoipInfo.ASN).
 		Value()
 
 	hostname := req.Host
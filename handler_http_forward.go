@@ -2,14 +2,17 @@ package main
 
 import (
 	"cmp"
-	"crypto/sha1"
+	"context"
+	"crypto/subtle"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"runtime"
 	"slices"
 	"strings"
@@ -19,6 +22,7 @@ import (
 	"github.com/jszwec/csvutil"
 	"github.com/mileusna/useragent"
 	"github.com/phuslu/log"
+	"github.com/quic-go/quic-go/http3"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/net/publicsuffix"
 )
@@ -52,6 +56,11 @@ func (h *HTTPForwardHandler) Load() error {
 		}
 	}
 
+	// golang.org/x/net/http2 only advertises extended CONNECT of RFC 8441 with GODEBUG=http2xconnect=1 at startup
+	if h.Config.Forward.Websocket != "" && !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		log.Info().Str("forward_websocket", h.Config.Forward.Websocket).Msg("websocket over http2 is disabled, set GODEBUG=http2xconnect=1 to enable it")
+	}
+
 	if len(h.Dialers) != 0 {
 		h.transports = make(map[string]*http.Transport)
 		for name, dailer := range h.Dialers {
@@ -110,7 +119,8 @@ func (h *HTTPForwardHandler) Load() error {
 func (h *HTTPForwardHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	ri := req.Context().Value(RequestInfoContextKey).(*RequestInfo)
 
-	websocket := h.Config.Forward.Websocket != "" && req.URL.Path == h.Config.Forward.Websocket && ((req.Method == http.MethodGet && req.ProtoMajor == 1) || (req.Method == http.MethodConnect && req.ProtoAtLeast(2, 0)))
+	// extended CONNECT carries the protocol by :protocol header in HTTP/2, and by Proto in HTTP/3
+	websocket := h.Config.Forward.Websocket != "" && req.URL.Path == h.Config.Forward.Websocket && ((req.Method == http.MethodGet && req.ProtoMajor == 1) || (req.Method == http.MethodConnect && req.ProtoAtLeast(2, 0) && (req.Header.Get(":protocol") == "websocket" || req.Proto == "websocket")))
 	if websocket {
 		host, port := req.URL.Query().Get("host"), req.URL.Query().Get("port")
 		if host == "" && port == "" {
@@ -121,6 +131,18 @@ func (h *HTTPForwardHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request
 		req.Method = http.MethodConnect
 	}
 
+	// RFC 9298 CONNECT-UDP, the target is carried by path of extended CONNECT request.
+	connectUDP := req.Method == http.MethodConnect && req.Proto == "connect-udp"
+	if connectUDP {
+		host, port, ok := ParseMasqueUDPPath(req.URL.EscapedPath())
+		if !ok {
+			http.Error(rw, "invalid connect-udp target", http.StatusBadRequest)
+			return
+		}
+		req.Host = net.JoinHostPort(host, port)
+		req.URL = &url.URL{Host: req.Host}
+	}
+
 	var err error
 	var host = req.Host
 	if h, _, err := net.SplitHostPort(req.Host); err == nil {
@@ -265,6 +287,12 @@ func (h *HTTPForwardHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request
 			dialer = h.LocalDialer
 		}
 
+		if connectUDP {
+			transmitBytes, err = h.serveConnectUDP(rw, req, dialer)
+			log.Debug().Context(ri.LogContext).Str("username", ai.Username).Str("http_domain", domain).Int64("transmit_bytes", transmitBytes).Err(err).Msg("forward log")
+			return
+		}
+
 		conn, err := dialer.DialContext(req.Context(), "tcp", req.Host)
 		if err != nil {
 			log.Error().Err(err).Context(ri.LogContext).Msg("dial host error")
@@ -282,19 +310,28 @@ func (h *HTTPForwardHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request
 				return
 			}
 
-			if websocket {
-				key := sha1.Sum([]byte(req.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
-				rw.Header().Set("sec-websocket-accept", string(key[:]))
-				rw.Header().Set("upgrade", "websocket")
-				rw.Header().Set("connection", "Upgrade")
-				rw.WriteHeader(http.StatusSwitchingProtocols)
-			} else {
-				rw.WriteHeader(http.StatusOK)
-			}
+			// extended CONNECT of RFC 8441 and RFC 9220 is answered with 200 instead of 101
+			rw.WriteHeader(http.StatusOK)
 			flusher.Flush()
 
 			w = FlushWriter{rw}
 			r = req.Body
+
+			if websocket {
+				ws := &WebsocketConn{
+					Conn: &websocketStream{
+						rwc: struct {
+							io.Reader
+							io.Writer
+							io.Closer
+						}{req.Body, w, req.Body},
+						local:  req.Context().Value(http.LocalAddrContextKey).(net.Addr),
+						remote: first(net.ResolveTCPAddr("tcp", req.RemoteAddr)),
+					},
+				}
+				defer ws.Close()
+				w, r = ws, ws
+			}
 		} else {
 			hijacker, ok := rw.(http.Hijacker)
 			if !ok {
@@ -312,8 +349,10 @@ func (h *HTTPForwardHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request
 			r = lconn
 
 			if websocket {
-				key := sha1.Sum([]byte(req.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
-				fmt.Fprintf(lconn, "HTTP/1.1 101 Switching Protocols\r\nSec-WebSocket-Accept: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n", key[:])
+				fmt.Fprintf(lconn, "HTTP/1.1 101 Switching Protocols\r\nSec-WebSocket-Accept: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n", WebsocketAcceptKey(req.Header.Get("Sec-WebSocket-Key")))
+				ws := &WebsocketConn{Conn: lconn}
+				defer ws.Close()
+				w, r = ws, ws
 			} else {
 				io.WriteString(lconn, "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\n")
 			}
@@ -337,6 +376,7 @@ func (h *HTTPForwardHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request
 					Str("remote_country", ri.GeoipInfo.Country).
 					Str("remote_region", ri.GeoipInfo.Region).
 					Str("remote_city", ri.GeoipInfo.City).
+					Uint("remote_asn", ri.GeoipInfo.ASN).
 					Str("http_method", req.Method).
 					Str("http_host", host).
 					Str("http_domain", domain).
@@ -433,6 +473,7 @@ func (h *HTTPForwardHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request
 					Str("remote_country", ri.GeoipInfo.Country).
 					Str("remote_region", ri.GeoipInfo.Region).
 					Str("remote_city", ri.GeoipInfo.City).
+					Uint("remote_asn", ri.GeoipInfo.ASN).
 					Str("http_method", req.Method).
 					Str("http_host", host).
 					Str("http_domain", domain).
@@ -453,6 +494,69 @@ func (h *HTTPForwardHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request
 	}
 }
 
+// serveConnectUDP relays HTTP datagrams of a CONNECT-UDP request to the udp target.
+func (h *HTTPForwardHandler) serveConnectUDP(rw http.ResponseWriter, req *http.Request, dialer Dialer) (int64, error) {
+	streamer, ok := rw.(http3.HTTPStreamer)
+	if !ok {
+		http.Error(rw, "connect-udp requires http3", http.StatusBadRequest)
+		return 0, errors.New("connect-udp requires http3")
+	}
+
+	conn, err := dialer.DialContext(req.Context(), "udp", req.Host)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return 0, err
+	}
+	defer conn.Close()
+
+	rw.Header().Set("capsule-protocol", "?1")
+	rw.WriteHeader(http.StatusOK)
+
+	str := streamer.HTTPStream()
+	defer str.Close()
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	// the tunnel ends when client closes the request stream, capsules are ignored.
+	go func() {
+		io.Copy(io.Discard, str)
+		cancel()
+		conn.Close()
+	}()
+
+	go func() {
+		for {
+			data, err := str.ReceiveDatagram(ctx)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			if payload, ok := masqueUDPPayload(data); ok {
+				conn.Write(payload)
+			}
+		}
+	}()
+
+	var transmitBytes int64
+	buf := make([]byte, 1+65535)
+	for {
+		n, err := conn.Read(buf[1:])
+		if err != nil {
+			return transmitBytes, nil
+		}
+		buf[0] = 0 // context id
+		// datagrams larger than quic path mtu are dropped
+		if err := str.SendDatagram(buf[:1+n]); err != nil {
+			if ctx.Err() != nil {
+				return transmitBytes, err
+			}
+			continue
+		}
+		transmitBytes += int64(n)
+	}
+}
+
 type ForwardAuthInfo struct {
 	Username   string `csv:"username"`
 	Password   string `csv:"password"`
@@ -496,7 +600,7 @@ func (h *HTTPForwardHandler) GetAuthInfo(ri *RequestInfo, req *http.Request) (Fo
 		case strings.HasPrefix(r.Password, "$2a$"):
 			return bcrypt.CompareHashAndPassword([]byte(r.Password), []byte(password)) == nil
 		default:
-			return r.Password == password
+			return subtle.ConstantTimeCompare([]byte(r.Password), []byte(password)) == 1
 		}
 	}); i >= 0 {
 		ai = (*records)[i]
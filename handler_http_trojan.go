@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuslu/log"
+)
+
+const (
+	TrojanCommandConnect      byte = 1
+	TrojanCommandUDPAssociate byte = 3
+)
+
+// TrojanListener recognizes trojan requests right after tls handshake, other connections are returned by Accept.
+// A connection which is not a trojan request is returned as *ConnWithData, its ConnectionState is the one of tls connection.
+type TrojanListener struct {
+	net.Listener
+	GetHandler func(serverName string) *HTTPServerHandler
+	ConnState  func(net.Conn, http.ConnState)
+
+	once      sync.Once
+	closeOnce sync.Once
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+}
+
+func (l *TrojanListener) init() {
+	l.once.Do(func() {
+		l.conns = make(chan net.Conn)
+		l.errs = make(chan error)
+		l.done = make(chan struct{})
+		go func() {
+			for {
+				c, err := l.Listener.Accept()
+				if err != nil {
+					select {
+					case l.errs <- err:
+					case <-l.done:
+						return
+					}
+					if errors.Is(err, net.ErrClosed) {
+						return
+					}
+					continue
+				}
+				go l.serve(c)
+			}
+		}()
+	})
+}
+
+func (l *TrojanListener) Accept() (net.Conn, error) {
+	l.init()
+
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *TrojanListener) Close() error {
+	l.init()
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// deliver passes c to Accept, or closes it if the listener is closed.
+func (l *TrojanListener) deliver(c net.Conn) {
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close()
+		l.ConnState(c, http.StateClosed)
+	}
+}
+
+func (l *TrojanListener) serve(c net.Conn) {
+	tc, ok := c.(*tls.Conn)
+	if !ok {
+		l.deliver(c)
+		return
+	}
+
+	tc.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := tc.Handshake(); err != nil {
+		log.Debug().Err(err).Str("remote_addr", tc.RemoteAddr().String()).Msg("trojan listener tls handshake error")
+		tc.Close()
+		l.ConnState(tc, http.StateClosed)
+		return
+	}
+	tc.SetDeadline(time.Time{})
+
+	cs := tc.ConnectionState()
+	if cs.NegotiatedProtocol == "h2" {
+		l.deliver(tc)
+		return
+	}
+
+	h := l.GetHandler(cs.ServerName)
+	if h == nil || !h.Config.Forward.Trojan {
+		l.deliver(tc)
+		return
+	}
+
+	// trojan request starts with hex(sha224(password)) and CRLF, a http request starts with an upper case method.
+	var buf [4096]byte
+	var n int
+	tc.SetReadDeadline(time.Now().Add(60 * time.Second))
+	for n < 58 {
+		m, err := tc.Read(buf[n:])
+		n += m
+		if n > 0 && !isTrojanPrefix(buf[:min(n, 58)]) {
+			break
+		}
+		if err != nil {
+			var ne net.Error
+			if n == 0 && errors.As(err, &ne) && ne.Timeout() {
+				tc.SetReadDeadline(time.Time{})
+				l.deliver(tc)
+				return
+			}
+			tc.Close()
+			l.ConnState(tc, http.StateClosed)
+			return
+		}
+	}
+	tc.SetReadDeadline(time.Time{})
+
+	data := make([]byte, n)
+	copy(data, buf[:n])
+
+	if n < 58 || !isTrojanPrefix(data[:58]) {
+		l.deliver(&ConnWithData{tc, data})
+		return
+	}
+
+	defer l.ConnState(tc, http.StateClosed)
+	defer tc.Close()
+
+	h.ServeTrojan(&ConnWithData{tc, data[58:]}, string(data[:56]), &cs)
+}
+
+func isTrojanPrefix(b []byte) bool {
+	for i, c := range b {
+		switch {
+		case i < 56 && ('0' <= c && c <= '9' || 'a' <= c && c <= 'f'):
+		case i == 56 && c == '\r':
+		case i == 57 && c == '\n':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ServeTrojan authenticates the trojan password by forward auth table, and serves it as a CONNECT request of forward handler.
+func (h *HTTPServerHandler) ServeTrojan(conn net.Conn, hash string, cs *tls.ConnectionState) {
+	fh, ok := h.ForwardHandler.(*HTTPForwardHandler)
+	if !ok {
+		return
+	}
+
+	ai, err := fh.GetTrojanAuthInfo(hash)
+	if err != nil {
+		log.Warn().Err(err).Str("remote_addr", conn.RemoteAddr().String()).Str("server_name", cs.ServerName).Msg("trojan auth error")
+		conn.SetReadDeadline(time.Now().Add(time.Duration(10+fastrandn(20)) * time.Second))
+		io.Copy(io.Discard, conn)
+		return
+	}
+
+	var b [2]byte
+	if _, err := io.ReadFull(conn, b[:1]); err != nil {
+		return
+	}
+	if b[0] != TrojanCommandConnect {
+		log.Warn().Str("remote_addr", conn.RemoteAddr().String()).Str("username", ai.Username).Int("trojan_command", int(b[0])).Msg("trojan unsupported command")
+		return
+	}
+
+	addr, err := ReadSocksAddr(conn)
+	if err != nil {
+		log.Warn().Err(err).Str("remote_addr", conn.RemoteAddr().String()).Str("username", ai.Username).Msg("trojan read address error")
+		return
+	}
+
+	if _, err := io.ReadFull(conn, b[:2]); err != nil || b != [2]byte{'\r', '\n'} {
+		return
+	}
+
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: addr},
+		Host:       addr,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header: http.Header{
+			"Proxy-Authorization": []string{"Basic " + base64.StdEncoding.EncodeToString([]byte(ai.Username+":"+ai.Password))},
+		},
+		Body:       io.NopCloser(conn),
+		RemoteAddr: conn.RemoteAddr().String(),
+		RequestURI: addr,
+		TLS:        cs,
+	}
+	req = req.WithContext(context.WithValue(context.Background(), http.LocalAddrContextKey, conn.LocalAddr()))
+
+	rw := &trojanResponseWriter{conn: conn, header: http.Header{}}
+	h.ServeHTTP(rw, req)
+
+	if rw.status != http.StatusOK {
+		log.Warn().Str("remote_addr", req.RemoteAddr).Str("username", ai.Username).Str("trojan_addr", addr).Int("status", rw.status).Msg("trojan connect error")
+	}
+}
+
+// trojanResponseWriter writes the tunnel data of a successful CONNECT to trojan connection, and drops error responses.
+type trojanResponseWriter struct {
+	conn   net.Conn
+	header http.Header
+	status int
+}
+
+func (rw *trojanResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *trojanResponseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+}
+
+func (rw *trojanResponseWriter) Write(b []byte) (int, error) {
+	rw.WriteHeader(http.StatusOK)
+	if rw.status != http.StatusOK {
+		return len(b), nil
+	}
+	return rw.conn.Write(b)
+}
+
+func (rw *trojanResponseWriter) Flush() {}
+
+func (h *HTTPForwardHandler) GetTrojanAuthInfo(hash string) (ForwardAuthInfo, error) {
+	if h.csvloader == nil {
+		return ForwardAuthInfo{}, errors.New("trojan requires a csv auth_table")
+	}
+
+	records := h.csvloader.Load()
+	if records == nil {
+		return ForwardAuthInfo{}, errors.New("empty records in csvloader " + h.csvloader.Filename)
+	}
+
+	for _, r := range *records {
+		// bcrypt passwords cannot be used by trojan
+		if strings.HasPrefix(r.Password, "$2a$") {
+			continue
+		}
+		if sum := sha256.Sum224([]byte(r.Password)); subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(hash)) == 1 {
+			return r, nil
+		}
+	}
+
+	return ForwardAuthInfo{}, errors.New("no matched trojan password")
+}
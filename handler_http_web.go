@@ -15,6 +15,8 @@ import (
 type HTTPWebHandler struct {
 	Config    HTTPConfig
 	Transport *http.Transport
+	Dialers   map[string]Dialer
+	Resolver  *Resolver
 	Functions template.FuncMap
 
 	wildcards []struct {
@@ -74,6 +76,23 @@ func (h *HTTPWebHandler) Load() error {
 					DumpFailure:       web.Proxy.DumpFailure,
 				},
 			})
+		case web.Tunnel.Enabled:
+			routers = append(routers, router{
+				web.Location,
+				&HTTPWebTunnelHandler{
+					DialerName: web.Tunnel.DialerName,
+					Dialers:    h.Dialers,
+				},
+			})
+		case web.Doh.Enabled:
+			routers = append(routers, router{
+				web.Location,
+				&HTTPWebDohHandler{
+					Resolver:  h.Resolver,
+					Functions: h.Functions,
+					Policy:    web.Doh.Policy,
+				},
+			})
 		}
 	}
 
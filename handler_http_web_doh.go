@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strconv"
+	"text/template"
+
+	"github.com/phuslu/log"
+)
+
+// HTTPWebDohHandler serves DNS-over-HTTPS of RFC 8484 by dns handler.
+type HTTPWebDohHandler struct {
+	Resolver  *Resolver
+	Functions template.FuncMap
+	Policy    string
+
+	handler *DnsHandler
+}
+
+func (h *HTTPWebDohHandler) Load() error {
+	h.handler = &DnsHandler{
+		Config: DnsConfig{
+			Policy: h.Policy,
+		},
+		Resolver:  h.Resolver,
+		Functions: h.Functions,
+	}
+
+	return h.handler.Load()
+}
+
+func (h *HTTPWebDohHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	ri := req.Context().Value(RequestInfoContextKey).(*RequestInfo)
+
+	var query []byte
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		query, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if req.Header.Get("content-type") != "application/dns-message" {
+			http.Error(rw, "415 unsupported media type", http.StatusUnsupportedMediaType)
+			return
+		}
+		query, err = io.ReadAll(io.LimitReader(req.Body, 65535))
+	default:
+		http.Error(rw, "405 method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil || len(query) == 0 {
+		http.Error(rw, "400 bad request", http.StatusBadRequest)
+		return
+	}
+
+	dnsReq := &DnsRequest{
+		RemoteAddr: req.RemoteAddr,
+		ServerAddr: ri.ServerAddr,
+		Proto:      "https",
+	}
+
+	resp := h.handler.Exchange(req.Context(), dnsReq, query)
+	if resp == nil {
+		http.Error(rw, "400 bad request", http.StatusBadRequest)
+		return
+	}
+
+	log.Debug().Context(ri.LogContext).Str("dns_domain", dnsReq.Domain).Str("dns_qtype", dnsReq.QType).Msg("web doh request")
+
+	rw.Header().Set("content-type", "application/dns-message")
+	rw.Header().Set("content-length", strconv.Itoa(len(resp)))
+	rw.Header().Set("cache-control", "max-age="+strconv.Itoa(dnsMinTTL(resp)))
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(resp)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/phuslu/log"
+)
+
+type HTTPWebTunnelHandler struct {
+	DialerName string
+	Dialers    map[string]Dialer
+
+	tunnel *TunnelHandler
+}
+
+func (h *HTTPWebTunnelHandler) Load() error {
+	tunnel, ok := h.Dialers[h.DialerName].(*TunnelHandler)
+	if !ok {
+		return errors.New("no tunnel server with dialer_name: " + h.DialerName)
+	}
+
+	h.tunnel = tunnel
+
+	return nil
+}
+
+func (h *HTTPWebTunnelHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	ri := req.Context().Value(RequestInfoContextKey).(*RequestInfo)
+
+	if req.Method != http.MethodGet || req.ProtoMajor != 1 || !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		http.Error(rw, "400 bad request", http.StatusBadRequest)
+		return
+	}
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(rw, "400 bad request", http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		http.Error(rw, fmt.Sprintf("%#v is not http.Hijacker", rw), http.StatusBadGateway)
+		return
+	}
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		log.Error().Err(err).Context(ri.LogContext).Msg("web tunnel hijack error")
+		return
+	}
+
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", WebsocketAcceptKey(key))
+	if err != nil {
+		log.Error().Err(err).Context(ri.LogContext).Msg("web tunnel write upgrade response error")
+		conn.Close()
+		return
+	}
+
+	if n := brw.Reader.Buffered(); n > 0 {
+		data, _ := brw.Reader.Peek(n)
+		conn = &ConnWithData{conn, data}
+	}
+
+	log.Info().Context(ri.LogContext).Str("tunnel_dialer_name", h.DialerName).Msg("web tunnel upgraded")
+
+	h.tunnel.ServeTunnelConn(&WebsocketConn{Conn: conn})
+}
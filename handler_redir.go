@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/phuslu/log"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+type RedirRequest struct {
+	RemoteAddr string
+	RemoteIP   string
+	ServerAddr string
+	Network    string
+	Host       string
+	Port       int
+	// OriginalIP is the original destination ip, Host is the sniffed domain or the domain of fake ip if any.
+	OriginalIP string
+	TraceID    log.XID
+}
+
+// RedirHandler serves transparent proxy connections of iptables REDIRECT or TPROXY.
+type RedirHandler struct {
+	Config         RedirConfig
+	ForwardLogger  log.Logger
+	RegionResolver *RegionResolver
+	LocalDialer    *LocalDialer
+	Upstreams      map[string]Dialer
+	Functions      template.FuncMap
+
+	PolicyTemplate   *template.Template
+	UpstreamTemplate *template.Template
+
+	sessions sync.Map // udp sessions of TPROXY, src+dst => *redirUDPSession
+}
+
+func (h *RedirHandler) Load() error {
+	var err error
+
+	if s := h.Config.Forward.Policy; s != "" {
+		if h.PolicyTemplate, err = template.New(s).Funcs(h.Functions).Parse(s); err != nil {
+			return err
+		}
+	}
+
+	if s := h.Config.Forward.Dialer; s != "" {
+		if h.UpstreamTemplate, err = template.New(s).Funcs(h.Functions).Parse(s); err != nil {
+			return err
+		}
+	}
+
+	if h.Config.Mark != 0 {
+		// direct connections are marked, so that they are not redirected to the handler again
+		lc := net.ListenConfig{Control: DailerController{Mark: h.Config.Mark}.Control}
+		pc, err := lc.ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+		if err != nil {
+			return fmt.Errorf("redir: set mark %d error: %w", h.Config.Mark, err)
+		}
+		pc.Close()
+
+		dialer := *h.LocalDialer
+		dialer.Mark = h.Config.Mark
+		h.LocalDialer = &dialer
+	}
+
+	return nil
+}
+
+func (h *RedirHandler) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	var req RedirRequest
+	req.RemoteAddr = conn.RemoteAddr().String()
+	req.RemoteIP, _, _ = net.SplitHostPort(req.RemoteAddr)
+	req.ServerAddr = conn.LocalAddr().String()
+	req.Network = "tcp"
+	req.TraceID = log.NewXID()
+
+	var dst netip.AddrPort
+	if h.Config.Transparent {
+		// the local address of TPROXY connection is the original destination
+		dst = conn.LocalAddr().(*net.TCPAddr).AddrPort()
+	} else {
+		tc, ok := conn.(*net.TCPConn)
+		if !ok {
+			log.Error().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msg("redir connection is not tcp")
+			return
+		}
+		var err error
+		if dst, err = GetOriginalDST(tc); err != nil {
+			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msg("redir get original destination error")
+			return
+		}
+		// a connection to the listener itself is not redirected, forwarding it makes a loop
+		if laddr := tc.LocalAddr().(*net.TCPAddr).AddrPort(); dst.Addr().Unmap() == laddr.Addr().Unmap() && dst.Port() == laddr.Port() {
+			log.Error().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("redir_original_dst", dst.String()).Msg("redir original destination is the listener")
+			return
+		}
+	}
+
+	if err := h.request(&req, dst); err != nil {
+		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("redir_original_ip", req.OriginalIP).Msg("redir resolve fake ip error")
+		return
+	}
+
+	// peek the tls server name or http host of client first data, servers speak first are not delayed too long.
+	var head []byte
+	if h.Config.Sniff {
+		var host string
+		head, host = sniffHost(conn, 300*time.Millisecond)
+		if host != "" && net.ParseIP(host) == nil {
+			req.Host = host
+		}
+	}
+
+	dail, dialerName, ok := h.dialer(&req)
+	if !ok {
+		return
+	}
+
+	log.Info().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("redir_network", req.Network).Str("redir_host", req.Host).Int("redir_port", req.Port).Str("redir_original_ip", req.OriginalIP).Str("forward_dialer_name", dialerName).Msg("forward redir request")
+
+	rconn, err := dail(context.Background(), "tcp", net.JoinHostPort(req.Host, strconv.Itoa(req.Port)))
+	if err != nil {
+		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("redir_host", req.Host).Int("redir_port", req.Port).Str("forward_dialer_name", dialerName).Msg("connect remote host failed")
+		return
+	}
+	defer rconn.Close()
+
+	if len(head) != 0 {
+		if _, err := rconn.Write(head); err != nil {
+			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("redir_host", req.Host).Int("redir_port", req.Port).Msg("write remote host failed")
+			return
+		}
+	}
+
+	go io.Copy(rconn, conn)
+	_, err = io.Copy(conn, NewRateLimitReader(rconn, h.Config.Forward.SpeedLimit))
+
+	h.log(&req, dialerName)
+}
+
+// ServePacketConn serves udp packets of TPROXY, every pair of source and destination is a session.
+func (h *RedirHandler) ServePacketConn(conn *net.UDPConn) {
+	b := make([]byte, 65535)
+	for {
+		n, src, dst, err := ReadFromUDPWithOriginalDST(conn, b)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Error().Err(err).Str("server_addr", conn.LocalAddr().String()).Msg("redir read udp packet error")
+			continue
+		}
+
+		src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+		dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+
+		key := src.String() + "-" + dst.String()
+		if v, ok := h.sessions.Load(key); ok {
+			v.(*redirUDPSession).Write(b[:n])
+			continue
+		}
+
+		req := RedirRequest{
+			RemoteAddr: src.String(),
+			RemoteIP:   src.Addr().String(),
+			ServerAddr: conn.LocalAddr().String(),
+			Network:    "udp",
+			TraceID:    log.NewXID(),
+		}
+
+		payload := append([]byte(nil), b[:n]...)
+		go h.serveUDPSession(key, req, src, dst, payload)
+	}
+}
+
+type redirUDPSession struct {
+	rconn net.Conn
+}
+
+func (s *redirUDPSession) Write(b []byte) {
+	s.rconn.SetReadDeadline(time.Now().Add(redirUDPTimeout))
+	s.rconn.Write(b)
+}
+
+const redirUDPTimeout = 60 * time.Second
+
+func (h *RedirHandler) serveUDPSession(key string, req RedirRequest, src, dst netip.AddrPort, payload []byte) {
+	if err := h.request(&req, dst); err != nil {
+		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("redir_original_ip", req.OriginalIP).Msg("redir resolve fake ip error")
+		return
+	}
+
+	dail, dialerName, ok := h.dialer(&req)
+	if !ok {
+		return
+	}
+
+	log.Info().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("redir_network", req.Network).Str("redir_host", req.Host).Int("redir_port", req.Port).Str("redir_original_ip", req.OriginalIP).Str("forward_dialer_name", dialerName).Msg("forward redir request")
+
+	rconn, err := dail(context.Background(), "udp", net.JoinHostPort(req.Host, strconv.Itoa(req.Port)))
+	if err != nil {
+		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("redir_host", req.Host).Int("redir_port", req.Port).Str("forward_dialer_name", dialerName).Msg("connect remote host failed")
+		return
+	}
+	defer rconn.Close()
+
+	// replies are sent from the original destination
+	lconn, err := DialTransparentUDP(dst, src)
+	if err != nil {
+		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("redir_original_ip", req.OriginalIP).Msg("redir dial transparent udp error")
+		return
+	}
+	defer lconn.Close()
+
+	session := &redirUDPSession{rconn: rconn}
+	if v, loaded := h.sessions.LoadOrStore(key, session); loaded {
+		// a concurrent packet of same session has won
+		v.(*redirUDPSession).Write(payload)
+		return
+	}
+	defer h.sessions.Delete(key)
+
+	session.Write(payload)
+
+	b := make([]byte, 65535)
+	for {
+		n, err := rconn.Read(b)
+		if err != nil {
+			break
+		}
+		if _, err := lconn.Write(b[:n]); err != nil {
+			break
+		}
+		rconn.SetReadDeadline(time.Now().Add(redirUDPTimeout))
+	}
+
+	h.log(&req, dialerName)
+}
+
+// request fills the destination of req, a fake ip is mapped back to its domain.
+func (h *RedirHandler) request(req *RedirRequest, dst netip.AddrPort) (err error) {
+	req.OriginalIP = dst.Addr().Unmap().String()
+	req.Port = int(dst.Port())
+	req.Host, err = h.LocalDialer.Resolver.FakeIP.Resolve(req.OriginalIP)
+	return
+}
+
+// dialer executes the policy and dialer templates of req, it returns false if req is rejected.
+func (h *RedirHandler) dialer(req *RedirRequest) (func(ctx context.Context, network, addr string) (net.Conn, error), string, bool) {
+	var sb strings.Builder
+
+	if h.PolicyTemplate != nil {
+		sb.Reset()
+		err := h.PolicyTemplate.Execute(&sb, struct {
+			Request    RedirRequest
+			ServerAddr string
+		}{*req, req.ServerAddr})
+		if err != nil {
+			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("forward_policy", h.Config.Forward.Policy).Msg("execute forward_policy error")
+			return nil, "", false
+		}
+
+		output := strings.TrimSpace(sb.String())
+		log.Debug().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Interface("request", req).Str("forward_policy_output", output).Msg("execute forward_policy ok")
+
+		switch output {
+		case "reject", "deny":
+			return nil, "", false
+		}
+	}
+
+	var dialerName = ""
+	dail := h.LocalDialer.DialContext
+	if h.UpstreamTemplate != nil {
+		sb.Reset()
+		err := h.UpstreamTemplate.Execute(&sb, struct {
+			Request    RedirRequest
+			ServerAddr string
+		}{*req, req.ServerAddr})
+		if err != nil {
+			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("forward_dialer_name", h.Config.Forward.Dialer).Msg("execute forward_dialer error")
+			return nil, "", false
+		}
+
+		if dialerName = strings.TrimSpace(sb.String()); dialerName != "" {
+			u, ok := h.Upstreams[dialerName]
+			if !ok {
+				log.Error().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("forward_dialer_name", h.Config.Forward.Dialer).Str("dialer_name", dialerName).Msg("dialer not exists")
+				return nil, "", false
+			}
+			dail = u.DialContext
+		}
+	}
+
+	return dail, dialerName, true
+}
+
+func (h *RedirHandler) log(req *RedirRequest, dialerName string) {
+	if !h.Config.Forward.Log {
+		return
+	}
+
+	var country, region, city string
+	if h.RegionResolver.CityReader != nil {
+		country, region, city, _ = h.RegionResolver.LookupCity(context.Background(), net.ParseIP(req.RemoteIP))
+	}
+	asn, _, _ := h.RegionResolver.LookupASN(context.Background(), net.ParseIP(req.RemoteIP))
+	h.ForwardLogger.Info().Stringer("trace_id", req.TraceID).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("remote_country", country).Str("remote_region", region).Str("remote_city", city).Uint("remote_asn", asn).Str("redir_network", req.Network).Str("redir_host", req.Host).Int("redir_port", req.Port).Str("redir_original_ip", req.OriginalIP).Str("forward_dialer_name", dialerName).Msg("forward redir request end")
+}
+
+// sniffHost reads the first data of conn in timeout, and returns the data with tls server name or http host in it.
+func sniffHost(conn net.Conn, timeout time.Duration) ([]byte, string) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	// a tls record is at most 16KB
+	b := make([]byte, 0, 5+16*1024)
+	for len(b) < cap(b) {
+		n, err := conn.Read(b[len(b):cap(b)])
+		b = b[:len(b)+n]
+
+		host, more := sniffHostOf(b)
+		if host != "" || !more || err != nil {
+			return b, host
+		}
+	}
+
+	return b, ""
+}
+
+// sniffHostOf returns the tls server name or http host of b, and whether more data is needed.
+func sniffHostOf(b []byte) (string, bool) {
+	if len(b) == 0 {
+		return "", true
+	}
+
+	// tls handshake record
+	if b[0] == 0x16 {
+		if len(b) < 5 {
+			return "", true
+		}
+		n := 5 + (int(b[3])<<8 | int(b[4]))
+		if len(b) < n {
+			return "", true
+		}
+		return sniffTLSServerName(b[:n]), false
+	}
+
+	if b[0] < 'A' || b[0] > 'Z' {
+		return "", false
+	}
+
+	end := bytes.Index(b, []byte("\r\n\r\n"))
+	if end < 0 {
+		return "", true
+	}
+
+	for _, line := range strings.Split(string(b[:end]), "\r\n")[1:] {
+		if key, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(key, "host") {
+			host := strings.TrimSpace(value)
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			return host, false
+		}
+	}
+
+	return "", false
+}
+
+// sniffTLSServerName returns the server name indication of a tls client hello record.
+func sniffTLSServerName(record []byte) string {
+	plaintext := cryptobyte.String(record)
+
+	var s cryptobyte.String
+	var msgType uint8
+	// Skip uint8 ContentType and uint16 ProtocolVersion, then uint24 length, uint16 version, and 32 byte random.
+	if !plaintext.Skip(1+2) || !plaintext.ReadUint16LengthPrefixed(&s) || !s.ReadUint8(&msgType) || msgType != 1 || !s.Skip(3+2+32) {
+		return ""
+	}
+
+	var sessionID, cipherSuites, compressionMethods, extensions cryptobyte.String
+	if !s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!s.ReadUint8LengthPrefixed(&compressionMethods) ||
+		!s.ReadUint16LengthPrefixed(&extensions) {
+		return ""
+	}
+
+	for !extensions.Empty() {
+		var extension uint16
+		var extData cryptobyte.String
+		if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&extData) {
+			return ""
+		}
+		if extension != 0 {
+			continue
+		}
+
+		// server_name extension, see RFC 6066 section 3
+		var names cryptobyte.String
+		if !extData.ReadUint16LengthPrefixed(&names) {
+			return ""
+		}
+		for !names.Empty() {
+			var nameType uint8
+			var name cryptobyte.String
+			if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+				return ""
+			}
+			if nameType == 0 {
+				return string(name)
+			}
+		}
+	}
+
+	return ""
+}
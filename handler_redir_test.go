@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+// clientHelloRecord returns the first tls record sent by a client of serverName.
+func clientHelloRecord(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		client.Close()
+	}()
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatalf("read tls record header error: %+v", err)
+	}
+	record := make([]byte, 5+(int(header[3])<<8|int(header[4])))
+	copy(record, header)
+	if _, err := io.ReadFull(server, record[5:]); err != nil {
+		t.Fatalf("read tls record error: %+v", err)
+	}
+
+	return record
+}
+
+func TestSniffTLSServerName(t *testing.T) {
+	cases := []struct {
+		Record []byte
+		Host   string
+	}{
+		{clientHelloRecord(t, "www.example.org"), "www.example.org"},
+		{clientHelloRecord(t, ""), ""},
+		{clientHelloRecord(t, "www.example.org")[:64], ""},
+		{[]byte("\x16\x03\x01\x00\x00"), ""},
+	}
+
+	for _, c := range cases {
+		if host := sniffTLSServerName(c.Record); host != c.Host {
+			t.Errorf("sniffTLSServerName(%x) must return %#v, not %#v", c.Record[:min(len(c.Record), 16)], c.Host, host)
+		}
+	}
+}
+
+func TestSniffHostOf(t *testing.T) {
+	hello := clientHelloRecord(t, "www.example.org")
+
+	cases := []struct {
+		Data string
+		Host string
+		More bool
+	}{
+		{"", "", true},
+		{string(hello[:3]), "", true},
+		{string(hello[:len(hello)-1]), "", true},
+		{string(hello), "www.example.org", false},
+		{"GET / HTTP/1.1\r\nHost: www.example.org\r\n\r\n", "www.example.org", false},
+		{"POST / HTTP/1.1\r\nhost: www.example.org:8080\r\nContent-Length: 0\r\n\r\n", "www.example.org", false},
+		{"GET / HTTP/1.1\r\nHost: www.exam", "", true},
+		{"GET / HTTP/1.0\r\n\r\n", "", false},
+		{"\x00\x01\x02", "", false},
+	}
+
+	for _, c := range cases {
+		if host, more := sniffHostOf([]byte(c.Data)); host != c.Host || more != c.More {
+			t.Errorf("sniffHostOf(%q) must return %#v %v, not %#v %v", c.Data[:min(len(c.Data), 32)], c.Host, c.More, host, more)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jszwec/csvutil"
+	"github.com/phuslu/log"
+	"github.com/phuslu/lru"
+)
+
+type ShadowsocksRequest struct {
+	RemoteAddr string
+	RemoteIP   string
+	ServerAddr string
+	Username   string
+	Host       string
+	Port       int
+	TraceID    log.XID
+}
+
+type ShadowsocksHandler struct {
+	Config         ShadowsocksConfig
+	ForwardLogger  log.Logger
+	RegionResolver *RegionResolver
+	LocalDialer    *LocalDialer
+	Upstreams      map[string]Dialer
+	Functions      template.FuncMap
+
+	PolicyTemplate   *template.Template
+	UpstreamTemplate *template.Template
+
+	cipher *ShadowsocksCipher
+	keys   [][]byte
+	users  []ForwardAuthInfo
+	salts  *lru.TTLCache[string, bool]
+}
+
+func (h *ShadowsocksHandler) Load() error {
+	var err error
+
+	if s := h.Config.Forward.Policy; s != "" {
+		if h.PolicyTemplate, err = template.New(s).Funcs(h.Functions).Parse(s); err != nil {
+			return err
+		}
+	}
+
+	if s := h.Config.Forward.Dialer; s != "" {
+		if h.UpstreamTemplate, err = template.New(s).Funcs(h.Functions).Parse(s); err != nil {
+			return err
+		}
+	}
+
+	var ok bool
+	if h.cipher, ok = ShadowsocksCiphers[h.Config.Method]; !ok {
+		return errors.New("shadowsocks: unsupported method " + h.Config.Method)
+	}
+
+	if h.Config.Password != "" {
+		key, err := h.cipher.Key(h.Config.Password)
+		if err != nil {
+			return err
+		}
+		h.keys = append(h.keys, key)
+		h.users = append(h.users, ForwardAuthInfo{})
+	}
+
+	// every user of auth table has its own password, and it is recognized by trial decryption.
+	if h.Config.Forward.AuthTable != "" {
+		data, err := os.ReadFile(h.Config.Forward.AuthTable)
+		if err != nil {
+			return err
+		}
+
+		var records []ForwardAuthInfo
+		if err = csvutil.Unmarshal(data, &records); err != nil {
+			return err
+		}
+
+		for _, r := range records {
+			key, err := h.cipher.Key(r.Password)
+			if err != nil {
+				return errors.New("shadowsocks: invalid password of user " + r.Username + ": " + err.Error())
+			}
+			h.keys = append(h.keys, key)
+			h.users = append(h.users, r)
+		}
+	}
+
+	if len(h.keys) == 0 {
+		return errors.New("shadowsocks: empty password and auth_table")
+	}
+
+	h.salts = lru.NewTTLCache[string, bool](64 * 1024)
+
+	return nil
+}
+
+func (h *ShadowsocksHandler) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	var req ShadowsocksRequest
+	req.RemoteAddr = conn.RemoteAddr().String()
+	req.RemoteIP, _, _ = net.SplitHostPort(req.RemoteAddr)
+	req.ServerAddr = conn.LocalAddr().String()
+	req.TraceID = log.NewXID()
+
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+
+	sc, index, addr, err := ShadowsocksServer(conn, h.cipher, h.keys)
+	if err != nil {
+		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msg("shadowsocks read request error")
+		// drain the connection instead of closing it, to avoid active probing
+		conn.SetReadDeadline(time.Now().Add(time.Duration(10+fastrandn(20)) * time.Second))
+		io.Copy(io.Discard, conn)
+		return
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	// salts are unique in the replay window of 2022 timestamp checking
+	salt := string(sc.RequestSalt)
+	if _, ok := h.salts.Get(salt); ok {
+		log.Warn().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msg("shadowsocks replayed request")
+		return
+	}
+	h.salts.Set(salt, true, 2*shadowsocks2022MaxTimeDiff)
+
+	ai := h.users[index]
+	req.Username = ai.Username
+
+	host, port, _ := net.SplitHostPort(addr)
+	req.Host = host
+	req.Port, _ = strconv.Atoi(port)
+
+	if ai.VIP == 0 {
+		if ai.SpeedLimit == 0 && h.Config.Forward.SpeedLimit > 0 {
+			ai.SpeedLimit = h.Config.Forward.SpeedLimit
+		}
+	}
+
+	var sb strings.Builder
+
+	if h.PolicyTemplate != nil {
+		sb.Reset()
+		err := h.PolicyTemplate.Execute(&sb, struct {
+			Request    ShadowsocksRequest
+			ServerAddr string
+		}{req, req.ServerAddr})
+		if err != nil {
+			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("forward_policy", h.Config.Forward.Policy).Msg("execute forward_policy error")
+			return
+		}
+
+		output := strings.TrimSpace(sb.String())
+		log.Debug().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Interface("request", req).Str("forward_policy_output", output).Msg("execute forward_policy ok")
+
+		switch output {
+		case "reject", "deny":
+			return
+		}
+	}
+
+	var dialerName = ""
+	dail := h.LocalDialer.DialContext
+	if h.UpstreamTemplate != nil {
+		sb.Reset()
+		err := h.UpstreamTemplate.Execute(&sb, struct {
+			Request    ShadowsocksRequest
+			ServerAddr string
+		}{req, req.ServerAddr})
+		if err != nil {
+			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("forward_dialer_name", h.Config.Forward.Dialer).Msg("execute forward_dialer error")
+			return
+		}
+
+		if dialerName = strings.TrimSpace(sb.String()); dialerName != "" {
+			u, ok := h.Upstreams[dialerName]
+			if !ok {
+				log.Error().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("forward_dialer_name", h.Config.Forward.Dialer).Str("dialer_name", dialerName).Msg("dialer not exists")
+				return
+			}
+			dail = u.DialContext
+		}
+	}
+
+	log.Info().Str("server_addr", req.ServerAddr).Str("username", req.Username).Str("remote_ip", req.RemoteIP).Str("shadowsocks_host", req.Host).Int("shadowsocks_port", req.Port).Str("forward_dialer_name", dialerName).Msg("forward shadowsocks request")
+
+	rconn, err := dail(context.Background(), "tcp", addr)
+	if err != nil {
+		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("shadowsocks_host", req.Host).Int("shadowsocks_port", req.Port).Str("forward_dialer_name", dialerName).Msg("connect remote host failed")
+		return
+	}
+	defer rconn.Close()
+
+	go io.Copy(rconn, sc)
+	_, err = io.Copy(sc, NewRateLimitReader(rconn, ai.SpeedLimit))
+
+	if h.Config.Forward.Log {
+		var country, region, city string
+		if h.RegionResolver.CityReader != nil {
+			country, region, city, _ = h.RegionResolver.LookupCity(context.Background(), net.ParseIP(req.RemoteIP))
+		}
+		asn, _, _ := h.RegionResolver.LookupASN(context.Background(), net.ParseIP(req.RemoteIP))
+		h.ForwardLogger.Info().Stringer("trace_id", req.TraceID).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("remote_country", country).Str("remote_region", region).Str("remote_city", city).Uint("remote_asn", asn).Str("username", req.Username).Str("shadowsocks_host", req.Host).Int("shadowsocks_port", req.Port).Str("forward_dialer_name", dialerName).Msg("forward shadowsocks request end")
+	}
+}
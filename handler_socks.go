@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"fmt"
 	"io"
 	"net"
@@ -151,6 +152,13 @@ func (h *SocksHandler) ServeConn(conn net.Conn) {
 	}
 	req.Port = int(b[n-2])<<8 | int(b[n-1])
 
+	// recover the domain of fake ip, so that policy and dialer templates see the domain
+	if req.Host, err = h.LocalDialer.Resolver.FakeIP.Resolve(req.Host); err != nil {
+		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("socks_host", req.Host).Msg("socks resolve fake ip error")
+		WriteSocks5Status(conn, Socks5StatusHostUnreachable)
+		return
+	}
+
 	if ai.VIP == 0 {
 		if ai.SpeedLimit == 0 && h.Config.Forward.SpeedLimit > 0 {
 			ai.SpeedLimit = h.Config.Forward.SpeedLimit
@@ -232,10 +240,11 @@ func (h *SocksHandler) ServeConn(conn net.Conn) {
 
 	if h.Config.Forward.Log {
 		var country, region, city string
-		if h.RegionResolver.MaxmindReader != nil {
+		if h.RegionResolver.CityReader != nil {
 			country, region, city, _ = h.RegionResolver.LookupCity(context.Background(), net.ParseIP(req.RemoteIP))
 		}
-		h.ForwardLogger.Info().Stringer("trace_id", req.TraceID).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("remote_country", country).Str("remote_region", region).Str("remote_city", city).Str("forward_dialer_name", h.Config.Forward.Dialer).Str("socks_host", req.Host).Int("socks_port", req.Port).Int("socks_version", int(req.Version)).Str("forward_dialer_name", dialerName).Msg("forward socks request end")
+		asn, _, _ := h.RegionResolver.LookupASN(context.Background(), net.ParseIP(req.RemoteIP))
+		h.ForwardLogger.Info().Stringer("trace_id", req.TraceID).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("remote_country", country).Str("remote_region", region).Str("remote_city", city).Uint("remote_asn", asn).Str("forward_dialer_name", h.Config.Forward.Dialer).Str("socks_host", req.Host).Int("socks_port", req.Port).Int("socks_version", int(req.Version)).Str("forward_dialer_name", dialerName).Msg("forward socks request end")
 	}
 
 	return
@@ -268,7 +277,7 @@ func (h *SocksHandler) GetAuthInfo(req SocksRequest) (ForwardAuthInfo, error) {
 		case strings.HasPrefix(r.Password, "$2a$"):
 			return bcrypt.CompareHashAndPassword([]byte(r.Password), []byte(password)) == nil
 		default:
-			return r.Password == password
+			return subtle.ConstantTimeCompare([]byte(r.Password), []byte(password)) == 1
 		}
 	}); i >= 0 {
 		ai = records[i]
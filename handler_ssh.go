@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jszwec/csvutil"
+	"github.com/phuslu/log"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+type SSHRequest struct {
+	RemoteAddr string
+	RemoteIP   string
+	ServerAddr string
+	Username   string
+	Host       string
+	Port       int
+	TraceID    log.XID
+}
+
+type SSHHandler struct {
+	Config         SSHConfig
+	ForwardLogger  log.Logger
+	RegionResolver *RegionResolver
+	LocalDialer    *LocalDialer
+	Upstreams      map[string]Dialer
+	Functions      template.FuncMap
+
+	PolicyTemplate   *template.Template
+	UpstreamTemplate *template.Template
+
+	config    *ssh.ServerConfig
+	csvloader *FileLoader[[]ForwardAuthInfo]
+}
+
+func (h *SSHHandler) Load() error {
+	var err error
+
+	if s := h.Config.Forward.Policy; s != "" {
+		if h.PolicyTemplate, err = template.New(s).Funcs(h.Functions).Parse(s); err != nil {
+			return err
+		}
+	}
+
+	if s := h.Config.Forward.Dialer; s != "" {
+		if h.UpstreamTemplate, err = template.New(s).Funcs(h.Functions).Parse(s); err != nil {
+			return err
+		}
+	}
+
+	if h.Config.Forward.AuthTable == "" && h.Config.AuthorizedKeys == "" {
+		return errors.New("ssh: auth_table or authorized_keys is required")
+	}
+
+	signer, err := loadSSHHostKey(h.Config.HostKey)
+	if err != nil {
+		return err
+	}
+
+	h.config = &ssh.ServerConfig{
+		ServerVersion: "SSH-2.0-liner",
+	}
+	h.config.AddHostKey(signer)
+
+	if h.Config.Forward.AuthTable != "" {
+		if !strings.HasSuffix(h.Config.Forward.AuthTable, ".csv") {
+			return fmt.Errorf("ssh: unsupported auth_table: %s", h.Config.Forward.AuthTable)
+		}
+		h.csvloader = &FileLoader[[]ForwardAuthInfo]{
+			Filename:     h.Config.Forward.AuthTable,
+			Unmarshal:    csvutil.Unmarshal,
+			PollDuration: 15 * time.Second,
+			ErrorLogger:  log.DefaultLogger.Std("", 0),
+		}
+		records := h.csvloader.Load()
+		if records == nil {
+			return fmt.Errorf("ssh: load auth_table %s failed", h.Config.Forward.AuthTable)
+		}
+		log.Info().Strs("server_listen", h.Config.Listen).Str("auth_table", h.Config.Forward.AuthTable).Int("auth_table_size", len(*records)).Msg("load auth_table ok")
+
+		h.config.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			ai, err := h.GetAuthInfo(conn.User(), string(password))
+			if err != nil {
+				return nil, err
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"speed_limit": strconv.FormatInt(ai.SpeedLimit, 10), "vip": strconv.Itoa(ai.VIP)}}, nil
+		}
+	}
+
+	if h.Config.AuthorizedKeys != "" {
+		h.config.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			// authorized_keys is read in every auth, so that it could be changed without restart.
+			data, err := os.ReadFile(h.Config.AuthorizedKeys)
+			if err != nil {
+				return nil, err
+			}
+			for len(data) > 0 {
+				var pub ssh.PublicKey
+				pub, _, _, data, err = ssh.ParseAuthorizedKey(data)
+				if err != nil {
+					break
+				}
+				if bytes.Equal(pub.Marshal(), key.Marshal()) {
+					return &ssh.Permissions{Extensions: map[string]string{"pubkey_fingerprint": ssh.FingerprintSHA256(key)}}, nil
+				}
+			}
+			return nil, fmt.Errorf("unknown public key of user %s", conn.User())
+		}
+	}
+
+	return nil
+}
+
+// loadSSHHostKey reads the host key of filename, a ed25519 key is generated and saved if the file does not exist.
+func loadSSHHostKey(filename string) (ssh.Signer, error) {
+	if filename == "" {
+		return nil, errors.New("ssh: host_key is required")
+	}
+
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(key, "")
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(block)
+		if err := os.WriteFile(filename, data, 0600); err != nil {
+			return nil, err
+		}
+		log.Info().Str("host_key", filename).Msg("ssh host_key does not exist, generate a new one")
+	} else if err != nil {
+		return nil, err
+	}
+
+	return ssh.ParsePrivateKey(data)
+}
+
+func (h *SSHHandler) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	remoteIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	serverAddr := conn.LocalAddr().String()
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, h.config)
+	if err != nil {
+		log.Error().Err(err).Str("server_addr", serverAddr).Str("remote_ip", remoteIP).Msg("ssh handshake error")
+		return
+	}
+	defer sconn.Close()
+
+	conn.SetDeadline(time.Time{})
+
+	log.Info().Str("server_addr", serverAddr).Str("remote_ip", remoteIP).Str("username", sconn.User()).Str("ssh_client_version", string(sconn.ClientVersion())).Msg("ssh connection established")
+
+	// global requests, e.g. keepalive and tcpip-forward of ssh -R, are declined.
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		switch nc.ChannelType() {
+		case "direct-tcpip":
+			go h.serveDirectTCPIP(sconn, nc)
+		case "session":
+			go h.serveSession(nc)
+		default:
+			nc.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+// serveSession keeps a session of ssh client without -N open, it only prints a banner.
+func (h *SSHHandler) serveSession(nc ssh.NewChannel) {
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+
+	go func() {
+		for req := range reqs {
+			switch req.Type {
+			case "shell":
+				req.Reply(true, nil)
+				io.WriteString(ch, "liner: port forwarding only\r\n")
+			case "pty-req", "env", "window-change":
+				req.Reply(true, nil)
+			default:
+				req.Reply(false, nil)
+			}
+		}
+	}()
+
+	io.Copy(io.Discard, ch)
+}
+
+func (h *SSHHandler) serveDirectTCPIP(sconn *ssh.ServerConn, nc ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginAddr string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(nc.ExtraData(), &payload); err != nil {
+		nc.Reject(ssh.ConnectionFailed, "invalid direct-tcpip payload")
+		return
+	}
+
+	var req SSHRequest
+	req.RemoteAddr = sconn.RemoteAddr().String()
+	req.RemoteIP, _, _ = net.SplitHostPort(req.RemoteAddr)
+	req.ServerAddr = sconn.LocalAddr().String()
+	req.Username = sconn.User()
+	req.Host = payload.Host
+	req.Port = int(payload.Port)
+	req.TraceID = log.NewXID()
+
+	var ai ForwardAuthInfo
+	if sconn.Permissions != nil {
+		ai.Username = sconn.User()
+		ai.SpeedLimit, _ = strconv.ParseInt(sconn.Permissions.Extensions["speed_limit"], 10, 64)
+		ai.VIP, _ = strconv.Atoi(sconn.Permissions.Extensions["vip"])
+	}
+
+	if ai.VIP == 0 {
+		if ai.SpeedLimit == 0 && h.Config.Forward.SpeedLimit > 0 {
+			ai.SpeedLimit = h.Config.Forward.SpeedLimit
+		}
+	}
+
+	var sb strings.Builder
+
+	if h.PolicyTemplate != nil {
+		sb.Reset()
+		err := h.PolicyTemplate.Execute(&sb, struct {
+			Request    SSHRequest
+			ServerAddr string
+		}{req, req.ServerAddr})
+		if err != nil {
+			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("forward_policy", h.Config.Forward.Policy).Msg("execute forward_policy error")
+			nc.Reject(ssh.ConnectionFailed, "forward policy error")
+			return
+		}
+
+		output := strings.TrimSpace(sb.String())
+		log.Debug().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Interface("request", req).Str("forward_policy_output", output).Msg("execute forward_policy ok")
+
+		switch output {
+		case "reject", "deny":
+			nc.Reject(ssh.Prohibited, "connection not allowed by ruleset")
+			return
+		}
+	}
+
+	var dialerName = ""
+	dail := h.LocalDialer.DialContext
+	if h.UpstreamTemplate != nil {
+		sb.Reset()
+		err := h.UpstreamTemplate.Execute(&sb, struct {
+			Request    SSHRequest
+			ServerAddr string
+		}{req, req.ServerAddr})
+		if err != nil {
+			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("forward_dialer_name", h.Config.Forward.Dialer).Msg("execute forward_dialer error")
+			nc.Reject(ssh.ConnectionFailed, "forward dialer error")
+			return
+		}
+
+		if dialerName = strings.TrimSpace(sb.String()); dialerName != "" {
+			u, ok := h.Upstreams[dialerName]
+			if !ok {
+				log.Error().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("forward_dialer_name", h.Config.Forward.Dialer).Str("dialer_name", dialerName).Msg("dialer not exists")
+				nc.Reject(ssh.ConnectionFailed, "dialer not exists")
+				return
+			}
+			dail = u.DialContext
+		}
+	}
+
+	log.Info().Str("server_addr", req.ServerAddr).Str("username", req.Username).Str("remote_ip", req.RemoteIP).Str("ssh_host", req.Host).Int("ssh_port", req.Port).Str("forward_dialer_name", dialerName).Msg("forward ssh request")
+
+	rconn, err := dail(context.Background(), "tcp", net.JoinHostPort(req.Host, strconv.Itoa(req.Port)))
+	if err != nil {
+		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("ssh_host", req.Host).Int("ssh_port", req.Port).Str("forward_dialer_name", dialerName).Msg("connect remote host failed")
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer rconn.Close()
+
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	go func() {
+		io.Copy(rconn, ch)
+		if c, ok := rconn.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		}
+	}()
+	_, err = io.Copy(ch, NewRateLimitReader(rconn, ai.SpeedLimit))
+
+	if h.Config.Forward.Log {
+		var country, region, city string
+		if h.RegionResolver.CityReader != nil {
+			country, region, city, _ = h.RegionResolver.LookupCity(context.Background(), net.ParseIP(req.RemoteIP))
+		}
+		asn, _, _ := h.RegionResolver.LookupASN(context.Background(), net.ParseIP(req.RemoteIP))
+		h.ForwardLogger.Info().Stringer("trace_id", req.TraceID).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("remote_country", country).Str("remote_region", region).Str("remote_city", city).Uint("remote_asn", asn).Str("username", req.Username).Str("ssh_host", req.Host).Int("ssh_port", req.Port).Str("forward_dialer_name", dialerName).Msg("forward ssh request end")
+	}
+}
+
+func (h *SSHHandler) GetAuthInfo(username, password string) (ForwardAuthInfo, error) {
+	var ai ForwardAuthInfo
+
+	records := h.csvloader.Load()
+	if records == nil {
+		return ai, fmt.Errorf("empty records in csvloader %s", h.csvloader.Filename)
+	}
+	if i := slices.IndexFunc(*records, func(r ForwardAuthInfo) bool {
+		if r.Username != username {
+			return false
+		}
+		switch {
+		case strings.HasPrefix(r.Password, "$2a$"):
+			return bcrypt.CompareHashAndPassword([]byte(r.Password), []byte(password)) == nil
+		default:
+			return subtle.ConstantTimeCompare([]byte(r.Password), []byte(password)) == 1
+		}
+	}); i >= 0 {
+		ai = (*records)[i]
+	}
+	if ai.Username == "" {
+		return ai, errors.New("wrong username or password of user " + username)
+	}
+
+	return ai, nil
+}
@@ -2,108 +2,465 @@ package main
 
 import (
 	"bufio"
+	"cmp"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/yamux"
 	"github.com/phuslu/log"
+	"github.com/puzpuzpuz/xsync/v3"
 )
 
+const (
+	TunnelCommandService byte = 1
+	TunnelCommandConnect byte = 2
+)
+
+const (
+	TunnelStatusOK byte = iota
+	TunnelStatusAuthFailed
+	TunnelStatusEgressDenied
+	TunnelStatusConnectFailed
+)
+
+var _ Dialer = (*TunnelHandler)(nil)
+
 type TunnelHandler struct {
-	Config         TunnelConfig
-	ForwardLogger  log.Logger
-	RegionResolver *RegionResolver
-	LocalDialer    Dialer
+	Config          TunnelConfig
+	ForwardLogger   log.Logger
+	RegionResolver  *RegionResolver
+	LocalDialer     Dialer
+	Dialers         map[string]Dialer
+	TLSConfigurator *TLSConfigurator
+
+	tlsConfig  *tls.Config
+	sessions   *xsync.MapOf[string, *TunnelSession]
+	clientName string
 
-	tunnel atomic.Value // yamux.Session
+	statusMu sync.Mutex
+	status   TunnelClientStatus
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
 }
 
-func (h *TunnelHandler) Load() error {
-	return nil
+type TunnelSession struct {
+	Name       string
+	Services   []string
+	RemoteAddr string
+	CreatedAt  time.Time
+	Session    *yamux.Session
+	Streams    atomic.Int64
+	BytesIn    atomic.Int64
+	BytesOut   atomic.Int64
 }
 
-func (h *TunnelHandler) ServeConn(conn net.Conn) {
+// TunnelClientStatus is the state of tunnel client, it is published in /debug/vars.
+type TunnelClientStatus struct {
+	Name        string    `json:"name"`
+	RemoteAddr  string    `json:"remote_addr"`
+	Connected   bool      `json:"connected"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Uptime      string    `json:"uptime,omitempty"`
+	Reconnects  int64     `json:"reconnects"`
+	Streams     int64     `json:"streams"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at"`
+}
 
-	v := h.tunnel.Load()
-	if v == nil {
-		conn.SetDeadline(time.Now().Add(10 * time.Second))
-		br := bufio.NewReader(conn)
+func (h *TunnelHandler) Load() error {
+	h.sessions = xsync.NewMapOf[string, *TunnelSession]()
 
-		req, err := http.ReadRequest(br)
-		if err != nil {
-			log.Error().Err(err).Msg("tunnel read conn error")
-			conn.Close()
-			return
+	if h.Config.Client.RemoteAddr != "" {
+		h.clientName = h.Config.Client.Name
+		if h.clientName == "" {
+			h.clientName, _ = os.Hostname()
 		}
-		if req.Header.Get("x-tunnel-key") != h.Config.Server.Key {
-			log.Error().Err(err).Msg("tunnel verfiy conn key error")
-			conn.Close()
-			return
+		h.status.Name = h.clientName
+		h.status.RemoteAddr = h.Config.Client.RemoteAddr
+		if name := "tunnel_client_" + h.clientName; expvar.Get(name) == nil {
+			expvar.Publish(name, expvar.Func(func() any { return h.ClientStatus() }))
 		}
+	}
 
-		fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	if h.Config.Server.Listen == "" && h.Config.Server.DialerName == "" {
+		return nil
+	}
 
-		if n := br.Buffered(); n > 0 {
-			data, _ := br.Peek(n)
-			conn = &ConnWithData{conn, data}
-		}
+	if name := "tunnel_server_" + cmp.Or(h.Config.Server.DialerName, h.Config.Server.Listen); expvar.Get(name) == nil {
+		expvar.Publish(name, expvar.Func(func() any { return h.ServerStatus() }))
+	}
 
-		session, err := yamux.Client(conn, nil)
+	if h.Config.Server.Key == "" && len(h.Config.Server.Keys) == 0 {
+		return errors.New("tunnel: empty server key")
+	}
+
+	keyfile, certfile := h.Config.Server.Keyfile, h.Config.Server.Certfile
+	if certfile == "" {
+		certfile = keyfile
+	}
+
+	switch {
+	case keyfile != "":
+		cert, err := tls.LoadX509KeyPair(certfile, keyfile)
 		if err != nil {
-			log.Error().Err(err).Msg("tunnel create session error")
+			return err
+		}
+		h.tlsConfig = &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{cert},
+		}
+	case h.Config.Server.ServerName != "" && h.TLSConfigurator != nil:
+		h.tlsConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if hello.ServerName == "" {
+					hello.ServerName = h.Config.Server.ServerName
+				}
+				return h.TLSConfigurator.GetCertificate(hello)
+			},
+		}
+	}
+
+	if h.tlsConfig == nil && h.Config.Server.Listen != "" {
+		if !h.Config.Server.Insecure {
+			return fmt.Errorf("tunnel: server listen %s requires keyfile or server_name, or set insecure: true", h.Config.Server.Listen)
+		}
+		log.Warn().Str("tunnel_listen", h.Config.Server.Listen).Msg("tunnel server listens without tls, the key and traffic are sent in cleartext")
+	}
+
+	return nil
+}
+
+func (h *TunnelHandler) yamuxConfig(keepalive int) *yamux.Config {
+	config := yamux.DefaultConfig()
+	config.EnableKeepAlive = true
+	config.KeepAliveInterval = time.Duration(cmp.Or(keepalive, 15)) * time.Second
+	config.ConnectionWriteTimeout = 10 * time.Second
+	config.LogOutput = io.Discard
+	return config
+}
+
+func (h *TunnelHandler) ServeConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if h.tlsConfig != nil {
+		tconn := tls.Server(conn, h.tlsConfig)
+		if err := tconn.Handshake(); err != nil {
+			log.Error().Err(err).Str("remote_addr", conn.RemoteAddr().String()).Msg("tunnel tls handshake error")
 			conn.Close()
 			return
 		}
+		conn = tconn
+	}
 
-		h.tunnel.Store(session)
+	br := bufio.NewReader(conn)
 
+	_, err := http.ReadRequest(br)
+	if err != nil {
+		log.Error().Err(err).Str("remote_addr", conn.RemoteAddr().String()).Msg("tunnel read conn error")
+		conn.Close()
 		return
 	}
 
-	session := v.(*yamux.Session)
+	io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
 
-	stream, err := session.Open()
+	if n := br.Buffered(); n > 0 {
+		data, _ := br.Peek(n)
+		conn = &ConnWithData{conn, data}
+	}
+
+	h.ServeTunnelConn(conn)
+}
+
+// ServeTunnelConn authenticates a client on an upgraded connection and serves its yamux session.
+func (h *TunnelHandler) ServeTunnelConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	ts, err := h.handshake(conn)
 	if err != nil {
-		log.Error().Err(err).Msg("tunnel open stream error")
-		time.Sleep(10 * time.Millisecond)
+		log.Error().Err(err).Str("remote_addr", conn.RemoteAddr().String()).Msg("tunnel handshake error")
 		conn.Close()
 		return
 	}
+	conn.SetDeadline(time.Time{})
 
-	go func(stream, conn net.Conn) {
-		defer stream.Close()
-		defer conn.Close()
-		go io.Copy(stream, conn)
-		_, err := io.Copy(conn, stream)
-		if err != nil {
-			log.Error().Err(err).Msg("forward tunnel error")
-		}
-	}(stream, conn)
+	ts.Session, err = yamux.Client(conn, h.yamuxConfig(h.Config.Server.KeepAlive))
+	if err != nil {
+		log.Error().Err(err).Msg("tunnel create session error")
+		conn.Close()
+		return
+	}
 
-	return
+	if old, loaded := h.sessions.LoadAndStore(ts.Name, ts); loaded {
+		log.Info().Str("tunnel_client", ts.Name).Str("remote_addr", ts.RemoteAddr).Str("old_remote_addr", old.RemoteAddr).Msg("tunnel client reconnected, replace old session")
+		old.Session.Close()
+	}
+
+	log.Info().Str("tunnel_client", ts.Name).Strs("tunnel_services", ts.Services).Str("remote_addr", ts.RemoteAddr).Msg("tunnel client connected")
+
+	go func(ts *TunnelSession) {
+		<-ts.Session.CloseChan()
+		h.removeSession(ts)
+		log.Info().Str("tunnel_client", ts.Name).Str("remote_addr", ts.RemoteAddr).Msg("tunnel client disconnected")
+	}(ts)
+}
+
+// removeSession deletes ts from sessions unless it has been replaced by a newer session of the same client.
+func (h *TunnelHandler) removeSession(ts *TunnelSession) {
+	h.sessions.Compute(ts.Name, func(old *TunnelSession, loaded bool) (*TunnelSession, bool) {
+		return old, !loaded || old == ts
+	})
+}
+
+// handshake challenges the client with a random nonce, and verifies the HMAC-SHA256 of nonce and client hello.
+// A client listed in server keys must sign with its own key, so other clients cannot take over its name.
+func (h *TunnelHandler) handshake(conn net.Conn) (*TunnelSession, error) {
+	var nonce [32]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(nonce[:]); err != nil {
+		return nil, err
+	}
+
+	var b [2]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return nil, err
+	}
+	hello := make([]byte, int(binary.BigEndian.Uint16(b[:]))+sha256.Size)
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		return nil, err
+	}
+	hello, sum := hello[:len(hello)-sha256.Size], hello[len(hello)-sha256.Size:]
+
+	name, services, _ := strings.Cut(string(hello), "\n")
+
+	key := h.Config.Server.Key
+	if k, ok := h.Config.Server.Keys[name]; ok {
+		key = k
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(nonce[:])
+	mac.Write(hello)
+	if key == "" || !hmac.Equal(mac.Sum(nil), sum) {
+		conn.Write([]byte{TunnelStatusAuthFailed})
+		return nil, errors.New("tunnel: verify client hmac error")
+	}
+
+	if _, err := conn.Write([]byte{TunnelStatusOK}); err != nil {
+		return nil, err
+	}
+	ts := &TunnelSession{
+		Name:       name,
+		RemoteAddr: conn.RemoteAddr().String(),
+		CreatedAt:  timeNow(),
+	}
+	if services != "" {
+		ts.Services = strings.Split(services, ",")
+	}
+
+	return ts, nil
+}
+
+// DialContext opens a stream to the service of a tunnel client, the addr is in form of "client:service".
+func (h *TunnelHandler) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp6", "tcp4":
+	default:
+		return nil, errors.New("tunnel: no support for connections of type " + network)
+	}
+
+	client, service, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ts, ok := h.sessions.Load(client)
+	if !ok {
+		return nil, errors.New("tunnel: client " + client + " is not connected")
+	}
+	if len(ts.Services) != 0 && !slices.Contains(ts.Services, service) {
+		return nil, errors.New("tunnel: client " + client + " has no service " + service)
+	}
+
+	stream, err := ts.Session.Open()
+	if err != nil {
+		return nil, err
+	}
+	ts.Streams.Add(1)
+
+	if err := WriteTunnelHeader(stream, TunnelCommandService, service); err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	return &tunnelCountingConn{stream, &ts.BytesIn, &ts.BytesOut}, nil
+}
+
+// DialEgress asks the tunnel client to dial addr from its network, the client replies a status byte after dialing.
+func (h *TunnelHandler) DialEgress(ctx context.Context, client, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp6", "tcp4":
+	default:
+		return nil, errors.New("tunnel: no support for connections of type " + network)
+	}
+
+	ts, ok := h.sessions.Load(client)
+	if !ok {
+		return nil, errors.New("tunnel: client " + client + " is not connected")
+	}
+
+	stream, err := ts.Session.Open()
+	if err != nil {
+		return nil, err
+	}
+	ts.Streams.Add(1)
+
+	if err := WriteTunnelHeader(stream, TunnelCommandConnect, addr); err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetReadDeadline(deadline)
+	}
+
+	var status [1]byte
+	if _, err := io.ReadFull(stream, status[:]); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	stream.SetReadDeadline(time.Time{})
+
+	switch status[0] {
+	case TunnelStatusOK:
+		return &tunnelCountingConn{stream, &ts.BytesIn, &ts.BytesOut}, nil
+	case TunnelStatusEgressDenied:
+		stream.Close()
+		return nil, errors.New("tunnel: client " + client + " does not allow egress")
+	default:
+		stream.Close()
+		return nil, errors.New("tunnel: client " + client + " failed to connect " + addr)
+	}
 }
 
 func (h *TunnelHandler) Client(ctx context.Context) {
+	services := make(map[string]string)
+	if h.Config.Client.LocalAddr != "" {
+		services[""] = h.Config.Client.LocalAddr
+	}
+	for name, addr := range h.Config.Client.Services {
+		services[name] = addr
+	}
+
+	names := make([]string, 0, len(services))
+	for name := range services {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	clientName := h.clientName
+
+	dialer := h.LocalDialer
+	if name := h.Config.Client.Dialer; name != "" {
+		d, ok := h.Dialers[name]
+		if !ok {
+			log.Fatal().Str("tunnel_dialer", name).Msg("tunnel dialer not exists")
+		}
+		dialer = d
+	}
+
 	connect := func() (*yamux.Session, error) {
-		conn, err := h.LocalDialer.DialContext(ctx, "tcp", h.Config.Client.RemoteAddr)
+		remote := h.Config.Client.RemoteAddr
+		if !strings.Contains(remote, "://") {
+			remote = "tcp://" + remote
+		}
+		u, err := url.Parse(remote)
 		if err != nil {
 			return nil, err
 		}
 
-		_, err = io.WriteString(conn, strings.Join([]string{
-			"GET / HTTP/1.1",
-			"x-tunnel-key: " + h.Config.Client.Key,
-		}, "\r\n")+"\r\n\r\n")
+		addr := u.Host
+		if u.Port() == "" {
+			switch u.Scheme {
+			case "ws":
+				addr = net.JoinHostPort(u.Hostname(), "80")
+			case "wss":
+				addr = net.JoinHostPort(u.Hostname(), "443")
+			}
+		}
+
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
 		if err != nil {
 			return nil, err
 		}
 
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+		switch u.Scheme {
+		case "tcp", "ws":
+		case "tls", "wss":
+			tconn := tls.Client(conn, &tls.Config{
+				NextProtos:         []string{"http/1.1"},
+				ServerName:         cmp.Or(u.Query().Get("sni"), u.Hostname()),
+				InsecureSkipVerify: u.Query().Get("insecure") == "1",
+				ClientSessionCache: tls.NewLRUClientSessionCache(128),
+			})
+			if err := tconn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn = tconn
+		default:
+			conn.Close()
+			return nil, errors.New("tunnel: unsupported remote_addr scheme: " + u.Scheme)
+		}
+
+		websocket := u.Scheme == "ws" || u.Scheme == "wss"
+		websocketKey := NewWebsocketKey()
+
+		header := []string{
+			"GET " + cmp.Or(u.RequestURI(), "/") + " HTTP/1.1",
+			"Host: " + u.Host,
+			"Connection: Upgrade",
+			"Upgrade: websocket",
+		}
+		if websocket {
+			header = append(header,
+				"Sec-WebSocket-Version: 13",
+				"Sec-WebSocket-Key: "+websocketKey,
+				"User-Agent: "+DefaultUserAgent,
+			)
+		}
+
+		_, err = io.WriteString(conn, strings.Join(header, "\r\n")+"\r\n\r\n")
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
 		br := bufio.NewReader(conn)
 		resp, err := http.ReadResponse(br, nil)
 		if err != nil {
@@ -117,12 +474,51 @@ func (h *TunnelHandler) Client(ctx context.Context) {
 			return nil, fmt.Errorf("tunnel error: read conn response %d", resp.StatusCode)
 		}
 
+		if websocket && resp.Header.Get("Sec-WebSocket-Accept") != WebsocketAcceptKey(websocketKey) {
+			conn.Close()
+			return nil, errors.New("tunnel error: mismatched sec-websocket-accept")
+		}
+
 		if n := br.Buffered(); n > 0 {
 			data, _ := br.Peek(n)
 			conn = &ConnWithData{conn, data}
 		}
 
-		session, err := yamux.Server(conn, nil)
+		if websocket {
+			conn = &WebsocketConn{Conn: conn, Client: true}
+		}
+
+		var nonce [32]byte
+		if _, err := io.ReadFull(conn, nonce[:]); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		hello := clientName + "\n" + strings.Join(names, ",")
+		mac := hmac.New(sha256.New, []byte(h.Config.Client.Key))
+		mac.Write(nonce[:])
+		mac.Write([]byte(hello))
+
+		buf := binary.BigEndian.AppendUint16(nil, uint16(len(hello)))
+		buf = append(buf, hello...)
+		buf = mac.Sum(buf)
+		if _, err := conn.Write(buf); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if buf[0] != TunnelStatusOK {
+			conn.Close()
+			return nil, fmt.Errorf("tunnel error: handshake status %d", buf[0])
+		}
+
+		conn.SetDeadline(time.Time{})
+
+		session, err := yamux.Server(conn, h.yamuxConfig(h.Config.Client.KeepAlive))
 		if err != nil {
 			return nil, err
 		}
@@ -130,41 +526,230 @@ func (h *TunnelHandler) Client(ctx context.Context) {
 		return session, nil
 	}
 
+	maxBackoff := time.Duration(cmp.Or(h.Config.Client.MaxBackoff, 60)) * time.Second
+	backoff := time.Second
+
 	for {
 		session, err := connect()
 		if err != nil {
-			log.Error().Err(err).Msg("tunnel error: create yamux session")
-			time.Sleep(2000 * time.Millisecond)
+			if ctx.Err() != nil {
+				log.Info().Str("tunnel_client", clientName).Msg("tunnel client stopped")
+				return
+			}
+
+			h.setStatus(func(status *TunnelClientStatus) {
+				status.LastError = err.Error()
+				status.LastErrorAt = time.Now()
+			})
+
+			// exponential backoff with jitter in [backoff/2, backoff)
+			delay := backoff/2 + time.Duration(fastrandn(uint32(backoff/2/time.Millisecond)))*time.Millisecond
+			log.Error().Err(err).Str("tunnel_client", clientName).Dur("retry_after", delay).Msg("tunnel error: create yamux session")
+
+			select {
+			case <-ctx.Done():
+				log.Info().Str("tunnel_client", clientName).Msg("tunnel client stopped")
+				return
+			case <-time.After(delay):
+			}
+
+			backoff = min(backoff*2, maxBackoff)
 			continue
 		}
-		log.Info().Msg("tunnel new session")
+
+		backoff = time.Second
+
+		h.setStatus(func(status *TunnelClientStatus) {
+			if !status.ConnectedAt.IsZero() {
+				status.Reconnects++
+			}
+			status.Connected = true
+			status.ConnectedAt = time.Now()
+			status.Streams = 0
+		})
+
+		log.Info().Str("tunnel_client", clientName).Strs("tunnel_services", names).Msg("tunnel new session")
+
+		go func() {
+			select {
+			case <-ctx.Done():
+				session.Close()
+			case <-session.CloseChan():
+			}
+		}()
 
 		for {
 			stream, err := session.Accept()
 			if err != nil {
-				log.Error().Err(err).Msg("tunnel error: accept yamux stream")
-				time.Sleep(100 * time.Millisecond)
+				if ctx.Err() == nil {
+					log.Error().Err(err).Str("tunnel_client", clientName).Msg("tunnel error: accept yamux stream")
+				}
+				h.setStatus(func(status *TunnelClientStatus) {
+					status.Connected = false
+					if ctx.Err() == nil {
+						status.LastError = err.Error()
+						status.LastErrorAt = time.Now()
+					}
+				})
 				session.Close()
 				break
 			}
 
-			log.Info().Msg("tunnel new session")
+			h.setStatus(func(status *TunnelClientStatus) { status.Streams++ })
+			stream = &tunnelCountingConn{stream, &h.bytesIn, &h.bytesOut}
 
 			go func(ctx context.Context, stream net.Conn) {
 				defer stream.Close()
 
-				conn, err := h.LocalDialer.DialContext(ctx, "tcp", h.Config.Client.LocalAddr)
+				stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+				cmd, name, err := ReadTunnelHeader(stream)
 				if err != nil {
-					log.Error().Err(err).Str("local_addr", h.Config.Client.LocalAddr).Msg("tunnel error: failed to connect local addr")
+					log.Error().Err(err).Msg("tunnel error: read stream header")
 					return
 				}
-				defer conn.Close()
+				stream.SetReadDeadline(time.Time{})
+
+				var conn net.Conn
+				switch cmd {
+				case TunnelCommandService:
+					localAddr, ok := services[name]
+					if !ok {
+						log.Error().Str("tunnel_service", name).Msg("tunnel error: service not exists")
+						return
+					}
+
+					conn, err = h.LocalDialer.DialContext(ctx, "tcp", localAddr)
+					if err != nil {
+						log.Error().Err(err).Str("tunnel_service", name).Str("local_addr", localAddr).Msg("tunnel error: failed to connect local addr")
+						return
+					}
+
+					log.Info().Str("tunnel_service", name).Str("local_addr", localAddr).Msg("tunnel forward")
+				case TunnelCommandConnect:
+					if !h.Config.Client.AllowEgress {
+						log.Warn().Str("remote_addr", name).Msg("tunnel error: egress is not allowed")
+						stream.Write([]byte{TunnelStatusEgressDenied})
+						return
+					}
 
-				log.Info().Msg("tunnel forward")
+					conn, err = h.LocalDialer.DialContext(ctx, "tcp", name)
+					if err != nil {
+						log.Error().Err(err).Str("remote_addr", name).Msg("tunnel error: failed to connect egress addr")
+						stream.Write([]byte{TunnelStatusConnectFailed})
+						return
+					}
+
+					if _, err := stream.Write([]byte{TunnelStatusOK}); err != nil {
+						conn.Close()
+						return
+					}
+
+					log.Info().Str("remote_addr", name).Msg("tunnel egress")
+				default:
+					log.Error().Int("tunnel_command", int(cmd)).Msg("tunnel error: unsupported stream command")
+					return
+				}
+				defer conn.Close()
 
 				go io.Copy(stream, conn)
 				io.Copy(conn, stream)
 			}(ctx, stream)
 		}
+
+		if ctx.Err() != nil {
+			log.Info().Str("tunnel_client", clientName).Msg("tunnel client stopped")
+			return
+		}
+	}
+}
+
+func (h *TunnelHandler) setStatus(f func(status *TunnelClientStatus)) {
+	h.statusMu.Lock()
+	f(&h.status)
+	h.statusMu.Unlock()
+}
+
+func (h *TunnelHandler) ClientStatus() TunnelClientStatus {
+	h.statusMu.Lock()
+	status := h.status
+	h.statusMu.Unlock()
+
+	status.BytesIn, status.BytesOut = h.bytesIn.Load(), h.bytesOut.Load()
+	if status.Connected {
+		status.Uptime = time.Since(status.ConnectedAt).Truncate(time.Second).String()
+	}
+
+	return status
+}
+
+func (h *TunnelHandler) ServerStatus() any {
+	type session struct {
+		Name       string    `json:"name"`
+		Services   []string  `json:"services"`
+		RemoteAddr string    `json:"remote_addr"`
+		CreatedAt  time.Time `json:"created_at"`
+		Uptime     string    `json:"uptime"`
+		Streams    int64     `json:"streams"`
+		BytesIn    int64     `json:"bytes_in"`
+		BytesOut   int64     `json:"bytes_out"`
 	}
+
+	var sessions []session
+	h.sessions.Range(func(name string, ts *TunnelSession) bool {
+		sessions = append(sessions, session{
+			Name:       ts.Name,
+			Services:   ts.Services,
+			RemoteAddr: ts.RemoteAddr,
+			CreatedAt:  ts.CreatedAt,
+			Uptime:     time.Since(ts.CreatedAt).Truncate(time.Second).String(),
+			Streams:    ts.Streams.Load(),
+			BytesIn:    ts.BytesIn.Load(),
+			BytesOut:   ts.BytesOut.Load(),
+		})
+		return true
+	})
+	slices.SortFunc(sessions, func(a, b session) int { return cmp.Compare(a.Name, b.Name) })
+
+	return sessions
+}
+
+// tunnelCountingConn counts the bytes of a tunnel stream as they are read and written.
+type tunnelCountingConn struct {
+	net.Conn
+	in  *atomic.Int64
+	out *atomic.Int64
+}
+
+func (c *tunnelCountingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.in.Add(int64(n))
+	return n, err
+}
+
+func (c *tunnelCountingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.out.Add(int64(n))
+	return n, err
+}
+
+func WriteTunnelHeader(w io.Writer, cmd byte, target string) error {
+	if len(target) > 255 {
+		return errors.New("tunnel: target too long: " + target)
+	}
+	_, err := w.Write(append([]byte{cmd, byte(len(target))}, target...))
+	return err
+}
+
+func ReadTunnelHeader(r io.Reader) (cmd byte, target string, err error) {
+	var b [256]byte
+	if _, err = io.ReadFull(r, b[:2]); err != nil {
+		return
+	}
+	cmd = b[0]
+	n := int(b[1])
+	if _, err = io.ReadFull(r, b[:n]); err != nil {
+		return
+	}
+	target = string(b[:n])
+	return
 }
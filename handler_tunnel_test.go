@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/puzpuzpuz/xsync/v3"
+)
+
+func TestTunnelRemoveSession(t *testing.T) {
+	h := &TunnelHandler{sessions: xsync.NewMapOf[string, *TunnelSession]()}
+
+	a := &TunnelSession{Name: "office"}
+	b := &TunnelSession{Name: "office"}
+
+	h.sessions.Store(a.Name, a)
+	h.sessions.Store(b.Name, b)
+
+	h.removeSession(a)
+	if ts, ok := h.sessions.Load("office"); !ok || ts != b {
+		t.Fatalf("removeSession of replaced session deleted the new session: %v %v", ts, ok)
+	}
+
+	h.removeSession(b)
+	h.removeSession(a)
+	if ts, ok := h.sessions.Load("office"); ok {
+		t.Fatalf("removeSession stored %v after both sessions closed", ts)
+	}
+}
+
+func TestTunnelHandshakeKeys(t *testing.T) {
+	h := &TunnelHandler{}
+	h.Config.Server.Key = "shared"
+	h.Config.Server.Keys = map[string]string{"office": "office-key"}
+
+	cases := []struct {
+		Name   string
+		Key    string
+		Status byte
+	}{
+		{"office", "office-key", TunnelStatusOK},
+		{"office", "shared", TunnelStatusAuthFailed},
+		{"home", "shared", TunnelStatusOK},
+		{"home", "office-key", TunnelStatusAuthFailed},
+	}
+
+	for _, c := range cases {
+		server, client := net.Pipe()
+		go func() {
+			defer client.Close()
+			var nonce [32]byte
+			if _, err := io.ReadFull(client, nonce[:]); err != nil {
+				return
+			}
+			hello := c.Name + "\nssh"
+			mac := hmac.New(sha256.New, []byte(c.Key))
+			mac.Write(nonce[:])
+			mac.Write([]byte(hello))
+			buf := binary.BigEndian.AppendUint16(nil, uint16(len(hello)))
+			buf = append(buf, hello...)
+			client.Write(mac.Sum(buf))
+			io.ReadFull(client, buf[:1])
+		}()
+
+		ts, err := h.handshake(server)
+		server.Close()
+		if ok := c.Status == TunnelStatusOK; ok != (err == nil) {
+			t.Errorf("handshake(%q, %q) error = %v", c.Name, c.Key, err)
+			continue
+		}
+		if err == nil && ts.Name != c.Name {
+			t.Errorf("handshake(%q, %q) name = %q", c.Name, c.Key, ts.Name)
+		}
+	}
+}
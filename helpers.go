@@ -306,6 +306,9 @@ func (c *MirrorHeaderConn) Read(b []byte) (n int, err error) {
 }
 
 func GetMirrorHeader(conn net.Conn) *bytebufferpool.ByteBuffer {
+	if c, ok := conn.(*ConnWithData); ok && c != nil {
+		conn = c.Conn
+	}
 	if c, ok := conn.(*tls.Conn); ok && c != nil {
 		// conn = (*struct{ conn net.Conn })(unsafe.Pointer(c)).conn
 		conn = c.NetConn()
@@ -336,6 +339,14 @@ func (c *ConnWithData) Read(b []byte) (int, error) {
 	return n, nil
 }
 
+// ConnectionState returns the tls connection state of the wrapped *tls.Conn, e.g. the fallback connection of trojan listener.
+func (c *ConnWithData) ConnectionState() tls.ConnectionState {
+	if tc, ok := c.Conn.(*tls.Conn); ok {
+		return tc.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
 type ConnWithBuffers struct {
 	net.Conn
 	Buffers net.Buffers
@@ -578,10 +589,15 @@ func ReadFile(s string) (body []byte, err error) {
 	case "http", "https":
 		var resp *http.Response
 		resp, err = http.Get(s)
-		if err == nil {
-			defer resp.Body.Close()
-			body, err = io.ReadAll(resp.Body)
+		if err != nil {
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = errors.New("get " + s + " error: " + resp.Status)
+			return
 		}
+		body, err = io.ReadAll(resp.Body)
 	default:
 		err = errors.New("unsupported url: " + s)
 	}
@@ -6,6 +6,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"net"
 	"net/netip"
@@ -17,14 +18,23 @@ import (
 
 const (
 	SO_REUSEPORT            = 15
+	IP_TRANSPARENT          = 19
+	IP_RECVORIGDSTADDR      = 20
 	TCP_FASTOPEN            = 23
 	IP_BIND_ADDRESS_NO_PORT = 24
+	TCP_FASTOPEN_CONNECT    = 30
+	IPV6_RECVORIGDSTADDR    = 74
+	IPV6_TRANSPARENT        = 75
+	SO_ORIGINAL_DST         = 80
+	SO_MARK                 = 36
 )
 
 type ListenConfig struct {
 	ReusePort   bool
 	FastOpen    bool
 	DeferAccept bool
+	// Transparent accepts connections and packets of TPROXY, whose destinations are not local.
+	Transparent bool
 }
 
 func (lc ListenConfig) Listen(ctx context.Context, network, address string) (net.Listener, error) {
@@ -40,6 +50,10 @@ func (lc ListenConfig) Listen(ctx context.Context, network, address string) (net
 				if lc.DeferAccept {
 					syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT, 1)
 				}
+				if lc.Transparent {
+					syscall.SetsockoptInt(int(fd), syscall.SOL_IP, IP_TRANSPARENT, 1)
+					syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, IPV6_TRANSPARENT, 1)
+				}
 			})
 		},
 	}
@@ -54,6 +68,12 @@ func (lc ListenConfig) ListenPacket(ctx context.Context, network, address string
 				if lc.ReusePort {
 					syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, SO_REUSEPORT, 1)
 				}
+				if lc.Transparent {
+					syscall.SetsockoptInt(int(fd), syscall.SOL_IP, IP_TRANSPARENT, 1)
+					syscall.SetsockoptInt(int(fd), syscall.SOL_IP, IP_RECVORIGDSTADDR, 1)
+					syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, IPV6_TRANSPARENT, 1)
+					syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, IPV6_RECVORIGDSTADDR, 1)
+				}
 			})
 		},
 	}
@@ -63,11 +83,22 @@ func (lc ListenConfig) ListenPacket(ctx context.Context, network, address string
 
 type DailerController struct {
 	BindInterface string
+	FastOpen      bool
+	Mark          int
 }
 
-func (dc DailerController) Control(network, addr string, c syscall.RawConn) (err error) {
-	return c.Control(func(fd uintptr) {
-		if ip, err := netip.ParseAddr(dc.BindInterface); err == nil {
+func (dc DailerController) Control(network, addr string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		if dc.FastOpen {
+			syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, TCP_FASTOPEN_CONNECT, 1)
+		}
+		if dc.Mark != 0 {
+			if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, SO_MARK, dc.Mark); err != nil {
+				return
+			}
+		}
+		if ip, perr := netip.ParseAddr(dc.BindInterface); perr == nil {
 			var sa syscall.Sockaddr
 			if ip.Is4() {
 				ip4 := ip.As4()
@@ -95,11 +126,118 @@ func (dc DailerController) Control(network, addr string, c syscall.RawConn) (err
 			err = syscall.BindToDevice(int(fd), dc.BindInterface)
 		}
 	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
 }
 
 //go:linkname setsockopt syscall.setsockopt
 func setsockopt(s int, level int, name int, val unsafe.Pointer, vallen uintptr) (err error)
 
+//go:linkname getsockopt syscall.getsockopt
+func getsockopt(s int, level int, name int, val unsafe.Pointer, vallen *uint32) (err error)
+
+// GetOriginalDST returns the destination of a connection before it is redirected by iptables REDIRECT.
+func GetOriginalDST(tc *net.TCPConn) (addr netip.AddrPort, err error) {
+	var c syscall.RawConn
+	c, err = tc.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	cerr := c.Control(func(fd uintptr) {
+		if tc.LocalAddr().(*net.TCPAddr).AddrPort().Addr().Unmap().Is4() {
+			var sa syscall.RawSockaddrInet4
+			size := uint32(unsafe.Sizeof(sa))
+			if err = getsockopt(int(fd), syscall.SOL_IP, SO_ORIGINAL_DST, unsafe.Pointer(&sa), &size); err != nil {
+				err = os.NewSyscallError("getsockopt SOL_IP SO_ORIGINAL_DST", err)
+				return
+			}
+			port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+			addr = netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), uint16(port[0])<<8|uint16(port[1]))
+		} else {
+			var sa syscall.RawSockaddrInet6
+			size := uint32(unsafe.Sizeof(sa))
+			if err = getsockopt(int(fd), syscall.SOL_IPV6, SO_ORIGINAL_DST, unsafe.Pointer(&sa), &size); err != nil {
+				err = os.NewSyscallError("getsockopt SOL_IPV6 IP6T_SO_ORIGINAL_DST", err)
+				return
+			}
+			port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+			addr = netip.AddrPortFrom(netip.AddrFrom16(sa.Addr), uint16(port[0])<<8|uint16(port[1]))
+		}
+	})
+	if cerr != nil {
+		err = cerr
+	}
+
+	return
+}
+
+// ReadFromUDPWithOriginalDST reads a packet of TPROXY from conn, which is listened by ListenConfig with Transparent.
+func ReadFromUDPWithOriginalDST(conn *net.UDPConn, b []byte) (n int, src, dst netip.AddrPort, err error) {
+	oob := make([]byte, 128)
+
+	var oobn int
+	n, oobn, _, src, err = conn.ReadMsgUDPAddrPort(b, oob)
+	if err != nil {
+		return
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return
+	}
+
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == syscall.SOL_IP && msg.Header.Type == IP_RECVORIGDSTADDR && len(msg.Data) >= syscall.SizeofSockaddrInet4:
+			sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&msg.Data[0]))
+			port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+			dst = netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), uint16(port[0])<<8|uint16(port[1]))
+			return
+		case msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == IPV6_RECVORIGDSTADDR && len(msg.Data) >= syscall.SizeofSockaddrInet6:
+			sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(&msg.Data[0]))
+			port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+			dst = netip.AddrPortFrom(netip.AddrFrom16(sa.Addr), uint16(port[0])<<8|uint16(port[1]))
+			return
+		}
+	}
+
+	err = errors.New("udp: original destination not found in control message")
+	return
+}
+
+// DialTransparentUDP returns a udp connection from non-local laddr to raddr, it replies packets of TPROXY.
+func DialTransparentUDP(laddr, raddr netip.AddrPort) (*net.UDPConn, error) {
+	dialer := &net.Dialer{
+		LocalAddr: net.UDPAddrFromAddrPort(laddr),
+		Control: func(network, address string, conn syscall.RawConn) error {
+			var err error
+			cerr := conn.Control(func(fd uintptr) {
+				syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+				syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, SO_REUSEPORT, 1)
+				if laddr.Addr().Is4() {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, IP_TRANSPARENT, 1)
+				} else {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, IPV6_TRANSPARENT, 1)
+				}
+			})
+			if cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+
+	conn, err := dialer.Dial("udp", raddr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
+
 func SetTcpBrutalRate(tc *net.TCPConn, rate uint64) (err error) {
 	var c syscall.RawConn
 	c, err = tc.SyscallConn()
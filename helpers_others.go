@@ -7,6 +7,8 @@ import (
 	"context"
 	"errors"
 	"net"
+	"net/netip"
+	"runtime"
 	"syscall"
 )
 
@@ -14,6 +16,7 @@ type ListenConfig struct {
 	ReusePort   bool
 	FastOpen    bool
 	DeferAccept bool
+	Transparent bool
 }
 
 func (ln ListenConfig) Listen(ctx context.Context, network, address string) (net.Listener, error) {
@@ -31,9 +34,14 @@ func (ln ListenConfig) ListenPacket(ctx context.Context, network, address string
 
 type DailerController struct {
 	BindInterface string
+	FastOpen      bool
+	Mark          int
 }
 
 func (dc DailerController) Control(network, address string, c syscall.RawConn) error {
+	if dc.Mark != 0 {
+		return errors.New("so_mark is not supported on " + runtime.GOOS)
+	}
 	return nil
 }
 
@@ -41,6 +49,18 @@ func SetTcpBrutalRate(tc *net.TCPConn, rate uint64) error {
 	return nil
 }
 
+func GetOriginalDST(tc *net.TCPConn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errors.New("not implemented")
+}
+
+func ReadFromUDPWithOriginalDST(conn *net.UDPConn, b []byte) (int, netip.AddrPort, netip.AddrPort, error) {
+	return 0, netip.AddrPort{}, netip.AddrPort{}, errors.New("not implemented")
+}
+
+func DialTransparentUDP(laddr, raddr netip.AddrPort) (*net.UDPConn, error) {
+	return nil, errors.New("not implemented")
+}
+
 func SetProcessName(name string) error {
 	return nil
 }
@@ -4,7 +4,7 @@ import (
 	"cmp"
 	"context"
 	"crypto/tls"
-	"errors"
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"io"
@@ -111,13 +111,20 @@ func main() {
 
 	slog.SetDefault(log.DefaultLogger.Slog())
 
+	// dialers are filled after resolver, dns servers look up them on dialing
+	dialers := make(map[string]Dialer)
+
 	// global resolver
 	resolver := &Resolver{
 		Resolver: &net.Resolver{
 			PreferGo: true,
 		},
-		LRUCache:      lru.NewTTLCache[string, []netip.Addr](32 * 1024),
+		LRUCache:      lru.NewTTLCache[string, *ResolverCacheEntry](32 * 1024),
 		CacheDuration: time.Minute,
+		MinTTL:        10 * time.Second,
+		MaxTTL:        time.Hour,
+		NegativeTTL:   30 * time.Second,
+		Singleflight:  &singleflight_Group[string, *ResolverCacheEntry]{},
 	}
 
 	if config.Global.DnsCacheDuration != "" {
@@ -128,79 +135,109 @@ func main() {
 		resolver.CacheDuration = dur
 	}
 
-	if dnsServer := config.Global.DnsServer; dnsServer != "" {
-		if !strings.Contains(dnsServer, "://") {
-			dnsServer = "udp://" + dnsServer
+	for _, x := range []struct {
+		name  string
+		value string
+		ttl   *time.Duration
+	}{
+		{"dns_min_ttl", config.Global.DnsMinTTL, &resolver.MinTTL},
+		{"dns_max_ttl", config.Global.DnsMaxTTL, &resolver.MaxTTL},
+		{"dns_negative_ttl", config.Global.DnsNegativeTTL, &resolver.NegativeTTL},
+		{"dns_stale_ttl", config.Global.DnsStaleTTL, &resolver.StaleTTL},
+	} {
+		if x.value == "" {
+			continue
 		}
-		u, err := url.Parse(dnsServer)
+		dur, err := time.ParseDuration(x.value)
 		if err != nil {
-			log.Fatal().Err(err).Str("dns_server", config.Global.DnsServer).Msg("parse dns_server error")
+			log.Fatal().Err(err).Str(x.name, x.value).Msg("invalid " + x.name)
 		}
-		if u.Scheme == "" || u.Host == "" {
-			log.Fatal().Err(errors.New("no scheme or host")).Str("dns_server", config.Global.DnsServer).Msg("parse dns_server error")
+		*x.ttl = dur
+	}
+
+	if dnsServer := config.Global.DnsServer; dnsServer != "" {
+		if resolver.Resolver.Dial, err = NewResolverDialer(dnsServer, dialers); err != nil {
+			log.Fatal().Err(err).Str("dns_server", dnsServer).Msg("parse dns_server error")
 		}
+	}
 
-		switch u.Scheme {
-		case "udp", "tcp":
-			var addr = u.Host
-			if _, _, err := net.SplitHostPort(u.Host); err != nil {
-				addr = net.JoinHostPort(addr, "53")
+	// split-horizon dns rules
+	for _, rule := range config.Global.DnsRules {
+		rr := ResolverRule{
+			Domains: rule.Domains,
+			Geosite: rule.Geosite,
+			Trusted: rule.Trusted,
+		}
+		for _, server := range rule.Server {
+			dial, err := NewResolverDialer(server, dialers)
+			if err != nil {
+				log.Fatal().Err(err).Str("dns_server", server).Msg("parse dns_rules server error")
 			}
-			dnsDialer := &net.Dialer{
-				Timeout: 2 * time.Second,
+			rr.Resolvers = append(rr.Resolvers, &net.Resolver{PreferGo: true, Dial: dial})
+		}
+		if len(rr.Resolvers) == 0 {
+			log.Fatal().Strs("dns_rule_domains", rule.Domains).Strs("dns_rule_geosite", rule.Geosite).Msg("dns_rules server is empty")
+		}
+		if rule.CacheDuration != "" {
+			if rr.CacheDuration, err = time.ParseDuration(rule.CacheDuration); err != nil {
+				log.Fatal().Err(err).Str("cache_duration", rule.CacheDuration).Msg("invalid dns_rules cache_duration")
 			}
-			resolver.Resolver.Dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
-				return dnsDialer.DialContext(ctx, u.Scheme, addr)
+		}
+		resolver.Rules = append(resolver.Rules, rr)
+	}
+
+	// static hosts, e.g. "*.svc.example.org": "10.0.0.1,10.0.0.2"
+	for name, value := range config.Global.Hosts {
+		if resolver.Hosts == nil {
+			resolver.Hosts = &ResolverHosts{}
+		}
+		for _, s := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+			ip, err := netip.ParseAddr(s)
+			if err != nil {
+				log.Fatal().Err(err).Str("host", name).Str("ip", s).Msg("invalid hosts ip")
 			}
-		case "tls", "dot":
-			var addr = u.Host
-			if _, _, err := net.SplitHostPort(u.Host); err != nil {
-				addr = net.JoinHostPort(addr, "853")
+			resolver.Hosts.Add(name, ip)
+		}
+	}
+
+	if config.Global.HostsFile != "" {
+		resolver.HostsFile = &FileLoader[ResolverHosts]{
+			Filename:     config.Global.HostsFile,
+			Unmarshal:    ParseHostsFile,
+			PollDuration: 15 * time.Second,
+			ErrorLogger:  log.DefaultLogger.Std("", 0),
+		}
+		resolver.HostsFile.Load()
+	}
+
+	// poisoned ips of dns answers, the embedded poisoned_ips.txt is only used by geoip unless it is set, "none" disables both
+	var poisoned *PoisonedIPs
+	if config.Global.DnsPoisonedIPs != "none" {
+		poisoned = &PoisonedIPs{Source: config.Global.DnsPoisonedIPs}
+		if err := poisoned.Load(); err != nil {
+			log.Fatal().Err(err).Str("dns_poisoned_ips", config.Global.DnsPoisonedIPs).Msg("load dns_poisoned_ips error")
+		}
+		if config.Global.DnsPoisonedIPs != "" {
+			resolver.Poisoned = poisoned
+		}
+	}
+
+	// fake ip pool of dns handlers, e.g. [198.18.0.0/15, fc00::/18]
+	if len(config.Global.DnsFakeIP) != 0 {
+		resolver.FakeIP = &FakeIP{
+			Filter: config.Global.DnsFakeIPFilter,
+			Size:   config.Global.DnsFakeIPSize,
+		}
+		for _, s := range config.Global.DnsFakeIP {
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil || prefix.Addr().BitLen()-prefix.Bits() < 2 {
+				log.Fatal().Err(err).Str("dns_fake_ip", s).Msg("invalid dns_fake_ip")
 			}
-			tlsDialer := &tls.Dialer{
-				NetDialer: &net.Dialer{
-					Timeout: 2 * time.Second,
-				},
-				Config: &tls.Config{
-					ServerName:         u.Hostname(),
-					ClientSessionCache: tls.NewLRUClientSessionCache(128),
-				},
+			if prefix.Addr().Is4() {
+				resolver.FakeIP.Prefix4 = prefix.Masked()
+			} else {
+				resolver.FakeIP.Prefix6 = prefix.Masked()
 			}
-			resolver.Resolver.Dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
-				return tlsDialer.DialContext(ctx, "tcp", addr)
-			}
-		case "https", "http2", "h2", "doh":
-			resolver.Resolver.Dial = (&DoHResolverDialer{
-				EndPoint:  strings.NewReplacer("http2", "https", "h2", "https", "doh", "https").Replace(config.Global.DnsServer),
-				UserAgent: u.Query().Get("user_agent"),
-				Transport: &http2.Transport{
-					TLSClientConfig: &tls.Config{
-						ServerName:         u.Hostname(),
-						ClientSessionCache: tls.NewLRUClientSessionCache(128),
-					},
-				},
-			}).DialContext
-		case "http3", "h3":
-			resolver.Resolver.Dial = (&DoHResolverDialer{
-				EndPoint:  strings.NewReplacer("http3", "https", "h3", "https").Replace(config.Global.DnsServer),
-				UserAgent: u.Query().Get("user_agent"),
-				Transport: &http3.RoundTripper{
-					DisableCompression: false,
-					EnableDatagrams:    false,
-					TLSClientConfig: &tls.Config{
-						NextProtos:         []string{"h3"},
-						InsecureSkipVerify: u.Query().Get("insecure") == "1",
-						ServerName:         u.Hostname(),
-						ClientSessionCache: tls.NewLRUClientSessionCache(128),
-					},
-					QUICConfig: &quic.Config{
-						DisablePathMTUDiscovery: false,
-						EnableDatagrams:         false,
-						MaxIncomingUniStreams:   200,
-						MaxIncomingStreams:      200,
-					},
-				},
-			}).DialContext
 		}
 	}
 
@@ -208,17 +245,38 @@ func main() {
 		Resolver: resolver,
 	}
 
-	if names, _ := filepath.Glob("*.mmdb"); len(names) != 0 {
-		regionResolver.MaxmindReader, err = maxminddb.Open(names[0])
-		if err != nil {
-			log.Fatal().Err(err).Str("geoip2_database", names[0]).Msg("load geoip2_database error")
+	// maxmind databases are recognized by type, e.g. GeoLite2-City, GeoLite2-ASN and GeoIP2-ISP
+	names, _ := filepath.Glob("*.mmdb")
+	for _, name := range names {
+		loader := &FileLoader[maxminddb.Reader]{
+			Filename:     name,
+			Unmarshal:    UnmarshalMaxmindDB,
+			PollDuration: time.Minute,
+			ErrorLogger:  log.DefaultLogger.Std("", 0),
+		}
+		db := loader.Load()
+		if db == nil {
+			log.Fatal().Str("geoip2_database", name).Msg("load geoip2_database error")
+		}
+		switch dbtype := db.Metadata.DatabaseType; {
+		case strings.Contains(dbtype, "City"), strings.Contains(dbtype, "Country"):
+			regionResolver.CityReader = loader
+		case strings.Contains(dbtype, "ASN"):
+			regionResolver.ASNReader = loader
+		case strings.Contains(dbtype, "ISP"):
+			regionResolver.ISPReader = loader
+		default:
+			log.Warn().Str("geoip2_database", name).Str("geoip2_database_type", dbtype).Msg("unsupported geoip2_database type")
 		}
 	}
 
 	// global dialer
 	dialer := &LocalDialer{
 		Resolver:        resolver,
-		Concurrency:     2,
+		Concurrency:     cmp.Or(config.Global.DialConcurrency, 2),
+		AttemptDelay:    time.Duration(cmp.Or(config.Global.DialAttemptDelay, 250)) * time.Millisecond,
+		FamilyCache:     lru.NewTTLCache[string, bool](8192),
+		FamilyCacheTTL:  time.Duration(cmp.Or(config.Global.DialFamilyTTL, 600)) * time.Second,
 		ForbidLocalAddr: config.Global.ForbidLocalAddr,
 		ReadBuffSize:    config.Global.DialReadBuffer,
 		WriteBuffSize:   config.Global.DialWriteBuffer,
@@ -230,7 +288,6 @@ func main() {
 		},
 	}
 
-	dialers := make(map[string]Dialer)
 	for name, dailer := range config.Dialer {
 		u, err := url.Parse(dailer)
 		if err != nil {
@@ -250,6 +307,11 @@ func main() {
 				ClientKey:  u.Query().Get("key"),
 				ClientCert: u.Query().Get("cert"),
 				Dialer:     dialer,
+
+				TCPFastOpen:     u.Query().Get("tfo") == "1",
+				PoolSize:        first(strconv.Atoi(u.Query().Get("pool_size"))),
+				PoolIdleTimeout: time.Duration(first(strconv.Atoi(u.Query().Get("pool_idle_timeout")))) * time.Second,
+				Pipelining:      u.Query().Get("pipelining") == "1",
 			}
 		case "http2":
 			dialers[name] = &HTTP2Dialer{
@@ -258,6 +320,7 @@ func main() {
 				Host:       u.Hostname(),
 				Port:       u.Port(),
 				UserAgent:  u.Query().Get("user_agent"),
+				Insecure:   u.Query().Get("insecure") == "1",
 				CACert:     u.Query().Get("cacert"),
 				ClientKey:  u.Query().Get("key"),
 				ClientCert: u.Query().Get("cert"),
@@ -265,14 +328,41 @@ func main() {
 				Dialer:     dialer,
 			}
 		case "http3":
-			dialers[name] = &HTTP3Dialer{
-				Username:  u.User.Username(),
-				Password:  first(u.User.Password()),
-				Host:      u.Hostname(),
-				Port:      u.Port(),
-				UserAgent: u.Query().Get("user_agent"),
-				Resolver:  resolver,
+			d := &HTTP3Dialer{
+				Username:                u.User.Username(),
+				Password:                first(u.User.Password()),
+				Host:                    u.Hostname(),
+				Port:                    u.Port(),
+				UserAgent:               u.Query().Get("user_agent"),
+				Insecure:                u.Query().Get("insecure") == "1",
+				CACert:                  u.Query().Get("cacert"),
+				ClientKey:               u.Query().Get("key"),
+				ClientCert:              u.Query().Get("cert"),
+				MaxClients:              cmp.Or(first(strconv.Atoi(u.Query().Get("max_clients"))), 8),
+				Resolver:                resolver,
+				KeepAlivePeriod:         time.Duration(first(strconv.Atoi(u.Query().Get("keepalive")))) * time.Second,
+				MaxIdleTimeout:          time.Duration(first(strconv.Atoi(u.Query().Get("idle_timeout")))) * time.Second,
+				HandshakeIdleTimeout:    time.Duration(first(strconv.Atoi(u.Query().Get("handshake_timeout")))) * time.Second,
+				DisablePathMTUDiscovery: u.Query().Get("disable_path_mtu_discovery") == "1",
+			}
+			// fallback to http2 of the same address when udp is blocked
+			if u.Query().Get("fallback") == "1" {
+				d.Fallback = &HTTP2Dialer{
+					Username:   d.Username,
+					Password:   d.Password,
+					Host:       d.Host,
+					Port:       d.Port,
+					UserAgent:  d.UserAgent,
+					Insecure:   d.Insecure,
+					CACert:     d.CACert,
+					ClientKey:  d.ClientKey,
+					ClientCert: d.ClientCert,
+					MaxClients: d.MaxClients,
+					Dialer:     dialer,
+				}
+				d.FallbackDuration = time.Duration(first(strconv.Atoi(u.Query().Get("fallback_duration")))) * time.Second
 			}
+			dialers[name] = d
 		case "websocket", "wss":
 			dialers[name] = &WebsocketDialer{
 				EndpointFormat: fmt.Sprintf("https://%s%s", u.Host, u.RequestURI()),
@@ -280,6 +370,7 @@ func main() {
 				Password:       first(u.User.Password()),
 				UserAgent:      u.Query().Get("user_agent"),
 				Insecure:       u.Query().Get("insecure") == "1",
+				HTTP2:          u.Query().Get("http2") == "1",
 				Dialer:         dialer,
 			}
 		case "socks", "socks5", "socks5h":
@@ -302,24 +393,115 @@ func main() {
 				Resolver: resolver,
 				Dialer:   dialer,
 			}
+		case "ss", "shadowsocks":
+			method, password := u.User.Username(), first(u.User.Password())
+			if _, ok := u.User.Password(); !ok {
+				// SIP002 userinfo, base64url(method:password)
+				if b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(method, "=")); err == nil {
+					method, password, _ = strings.Cut(string(b), ":")
+				}
+			}
+			dialers[name] = &ShadowsocksDialer{
+				Method:   method,
+				Password: password,
+				Host:     u.Hostname(),
+				Port:     u.Port(),
+				Dialer:   dialer,
+			}
 		case "ssh", "ssh2":
 			dialers[name] = &SSHDialer{
 				Username:              u.User.Username(),
 				Password:              first(u.User.Password()),
-				PrivateKey:            string(first(os.ReadFile(u.Query().Get("key")))),
+				PrivateKeyFile:        u.Query().Get("key"),
+				Passphrase:            u.Query().Get("passphrase"),
+				Certificate:           u.Query().Get("cert"),
+				Agent:                 u.Query().Get("agent") == "1",
 				Host:                  u.Hostname(),
 				Port:                  u.Port(),
 				StrictHostKeyChecking: cmp.Or(u.Query().Get("StrictHostKeyChecking") == "yes", u.Query().Get("strict_host_key_checking") == "yes"),
 				UserKnownHostsFile:    cmp.Or(u.Query().Get("UserKnownHostsFile"), u.Query().Get("user_known_hosts_file")),
 				MaxClients:            cmp.Or(first(strconv.Atoi(u.Query().Get("max_clients"))), 8),
 				Timeout:               time.Duration(cmp.Or(first(strconv.Atoi(u.Query().Get("timeout"))), 10)) * time.Second,
+				KeepAliveInterval:     time.Duration(cmp.Or(first(strconv.Atoi(cmp.Or(u.Query().Get("ServerAliveInterval"), u.Query().Get("keepalive")))), 30)) * time.Second,
+				KeepAliveCountMax:     cmp.Or(first(strconv.Atoi(cmp.Or(u.Query().Get("ServerAliveCountMax"), u.Query().Get("keepalive_count_max")))), 3),
+				Jump:                  cmp.Or(u.Query().Get("ProxyJump"), u.Query().Get("jump")),
 				Dialer:                dialer,
 			}
+		case "tunnel":
+			dialers[name] = &TunnelDialer{
+				Client: u.Hostname(),
+				Server: u.Query().Get("server"),
+			}
 		default:
 			log.Fatal().Str("dialer_scheme", u.Scheme).Msgf("unsupported dialer=%+v", u)
 		}
 	}
 
+	// ssh jump hosts, a jump dialer may have its own jump host
+	for name, d := range dialers {
+		sd, ok := d.(*SSHDialer)
+		if !ok || sd.Jump == "" {
+			continue
+		}
+		jump, ok := dialers[sd.Jump].(*SSHDialer)
+		if !ok {
+			log.Fatal().Str("dialer", name).Str("ssh_jump", sd.Jump).Msg("ssh jump is not a ssh dialer")
+		}
+		for i, j := 0, jump; j != nil && j.Jump != ""; i++ {
+			if j.Jump == name || i > len(dialers) {
+				log.Fatal().Str("dialer", name).Str("ssh_jump", sd.Jump).Msg("ssh jump loops")
+			}
+			j, _ = dialers[j.Jump].(*SSHDialer)
+		}
+		sd.Dialer = jump
+	}
+
+	tlsConfigurator := &TLSConfigurator{
+		ClientHelloMap: xsync.NewMapOf[string, *tls.ClientHelloInfo](),
+	}
+
+	// tunnel handlers, a tunnel server could be referenced as a dialer
+	tunnels := make([]*TunnelHandler, len(config.Tunnel))
+	for i, tunnel := range config.Tunnel {
+		tunnels[i] = &TunnelHandler{
+			Config:          tunnel,
+			ForwardLogger:   forwardLogger,
+			RegionResolver:  regionResolver,
+			LocalDialer:     dialer,
+			Dialers:         dialers,
+			TLSConfigurator: tlsConfigurator,
+		}
+		if err = tunnels[i].Load(); err != nil {
+			log.Fatal().Err(err).Str("tunnel_listen", tunnel.Server.Listen).Msg("tunnel hanlder load error")
+		}
+		if name := tunnel.Server.DialerName; name != "" {
+			if _, ok := dialers[name]; ok {
+				log.Fatal().Str("tunnel_dialer_name", name).Msg("tunnel dialer_name conflicts with dialer")
+			}
+			dialers[name] = tunnels[i]
+		}
+	}
+	for name, d := range dialers {
+		td, ok := d.(*TunnelDialer)
+		if !ok {
+			continue
+		}
+		for _, h := range tunnels {
+			if h.Config.Server.Listen == "" && h.Config.Server.DialerName == "" {
+				continue
+			}
+			if td.Server == "" || td.Server == h.Config.Server.DialerName {
+				if td.Tunnel != nil {
+					log.Fatal().Str("dialer", name).Msg("tunnel dialer matches multiple tunnel servers, specify ?server=dialer_name")
+				}
+				td.Tunnel = h
+			}
+		}
+		if td.Tunnel == nil {
+			log.Fatal().Str("dialer", name).Str("tunnel_server", td.Server).Msg("tunnel dialer has no tunnel server")
+		}
+	}
+
 	// see http.DefaultTransport
 	transport := &http.Transport{
 		DialContext: dialer.DialContext,
@@ -344,17 +526,32 @@ func main() {
 	// template functions
 	functions := &Functions{
 		RegionResolver: regionResolver,
+		PoisonedIPs:    poisoned,
 		GeoSite:        &geosite.DomainListCommunity{Transport: transport},
 		GeoSiteCache:   lru.NewTTLCache[string, *string](8192),
 		IPListCache:    lru.NewTTLCache[string, *string](128),
 		RegexpCache:    xsync.NewMapOf[string, *regexp.Regexp](),
 		Singleflight:   &singleflight_Group[string, string]{},
+
+		GeoSiteSources:   config.Global.Geosite.Sources,
+		GeoSiteCacheFile: config.Global.Geosite.CacheFile,
+		GeoSiteChecksum:  config.Global.Geosite.Checksum,
+		GeoSiteRefresh:   time.Hour,
+	}
+	if s := config.Global.Geosite.Refresh; s != "" {
+		if functions.GeoSiteRefresh, err = time.ParseDuration(s); err != nil {
+			log.Fatal().Err(err).Str("geosite_refresh", s).Msg("invalid geosite refresh")
+		}
 	}
 	if err := functions.Load(); err != nil {
 		log.Fatal().Err(err).Msgf("%T.Load() fatal", functions)
 	}
 	log.Info().Msgf("%T.Load() ok", functions.GeoSite)
 
+	if len(resolver.Rules) != 0 {
+		resolver.GeoSite = functions.geosite
+	}
+
 	lc := ListenConfig{
 		FastOpen:    false,
 		ReusePort:   true,
@@ -364,9 +561,6 @@ func main() {
 	servers := make([]*http.Server, 0)
 
 	// listen and serve https
-	tlsConfigurator := &TLSConfigurator{
-		ClientHelloMap: xsync.NewMapOf[string, *tls.ClientHelloInfo](),
-	}
 	h2handlers := map[string]map[string]HTTPHandler{}
 	for _, server := range config.Https {
 		handler := &HTTPServerHandler{
@@ -381,6 +575,8 @@ func main() {
 			WebHandler: &HTTPWebHandler{
 				Config:    server,
 				Transport: transport,
+				Dialers:   dialers,
+				Resolver:  resolver,
 				Functions: functions.FuncMap,
 			},
 			ServerNames:    server.ServerName,
@@ -451,25 +647,35 @@ func main() {
 
 		log.Info().Str("version", version).Str("address", ln.Addr().String()).Msg("liner listen and serve tls")
 
+		lookup := func(serverName string) HTTPHandler {
+			if serverName == "" {
+				serverName = tlsConfigurator.DefaultServername
+			}
+			h, _ := handlers[serverName]
+			if h == nil {
+				for key, value := range handlers {
+					if key != "" && key[0] == '*' && strings.HasSuffix(serverName, key[1:]) {
+						h = value
+						break
+					}
+				}
+			}
+			return h
+		}
+
 		server := &http.Server{
 			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.TLS == nil {
+					// net/http only fills the state of *tls.Conn, e.g. not the fallback connection of trojan listener
+					if c, ok := r.Context().Value(ConnContextKey).(interface{ ConnectionState() tls.ConnectionState }); ok {
+						cs := c.ConnectionState()
+						r.TLS = &cs
+					}
+				}
 				if s, _, err := net.SplitHostPort(r.TLS.ServerName); err == nil {
 					r.TLS.ServerName = s
 				}
-				var serverName = r.TLS.ServerName
-				if serverName == "" {
-					serverName = tlsConfigurator.DefaultServername
-				}
-
-				h, _ := handlers[serverName]
-				if h == nil {
-					for key, value := range handlers {
-						if key != "" && key[0] == '*' && strings.HasSuffix(serverName, key[1:]) {
-							h = value
-							break
-						}
-					}
-				}
+				h := lookup(r.TLS.ServerName)
 				if h == nil {
 					http.NotFound(w, r)
 					return
@@ -480,7 +686,10 @@ func main() {
 				GetConfigForClient: tlsConfigurator.GetConfigForClient,
 			},
 			ConnState: tlsConfigurator.ConnState,
-			ErrorLog:  log.DefaultLogger.Std("", 0),
+			ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+				return context.WithValue(ctx, ConnContextKey, c)
+			},
+			ErrorLog: log.DefaultLogger.Std("", 0),
 		}
 
 		http2.ConfigureServer(server, &http2.Server{
@@ -490,7 +699,7 @@ func main() {
 			MaxReadFrameSize:             1024 * 1024,       // 1MB read frame, https://github.com/golang/go/issues/47840
 		})
 
-		go server.Serve(TCPListener{
+		ln = TCPListener{
 			TCPListener:     ln.(*net.TCPListener),
 			TcpBrutalRate:   config.Global.TcpBrutalRate,
 			KeepAlivePeriod: 3 * time.Minute,
@@ -498,19 +707,36 @@ func main() {
 			// WriteBufferSize: 1 << 20,
 			MirrorHeader: true,
 			TLSConfig:    server.TLSConfig,
-		})
+		}
+
+		for _, h := range handlers {
+			if h.(*HTTPServerHandler).Config.Forward.Trojan {
+				ln = &TrojanListener{
+					Listener: ln,
+					GetHandler: func(serverName string) *HTTPServerHandler {
+						h, _ := lookup(serverName).(*HTTPServerHandler)
+						return h
+					},
+					ConnState: tlsConfigurator.ConnState,
+				}
+				break
+			}
+		}
+
+		go server.Serve(ln)
 
 		servers = append(servers, server)
 
 		// start http3 server
 		go (&http3.Server{
-			Addr:      addr,
-			Handler:   server.Handler,
-			TLSConfig: server.TLSConfig,
+			Addr:            addr,
+			Handler:         server.Handler,
+			TLSConfig:       server.TLSConfig,
+			EnableDatagrams: true,
 			QUICConfig: &quic.Config{
 				Allow0RTT:                  true,
 				DisablePathMTUDiscovery:    false,
-				EnableDatagrams:            false,
+				EnableDatagrams:            true,
 				MaxIncomingStreams:         100,
 				MaxStreamReceiveWindow:     6 * 1024 * 1024,
 				MaxConnectionReceiveWindow: 100 * 6 * 1024 * 1024,
@@ -540,6 +766,8 @@ func main() {
 			WebHandler: &HTTPWebHandler{
 				Config:    httpConfig,
 				Transport: transport,
+				Dialers:   dialers,
+				Resolver:  resolver,
 				Functions: functions.FuncMap,
 			},
 			ServerNames:    httpConfig.ServerName,
@@ -625,6 +853,224 @@ func main() {
 		}
 	}
 
+	// redir handler
+	for _, redirConfig := range config.Redir {
+		for _, addr := range redirConfig.Listen {
+			h := &RedirHandler{
+				Config:         redirConfig,
+				ForwardLogger:  forwardLogger,
+				RegionResolver: regionResolver,
+				LocalDialer:    dialer,
+				Upstreams:      dialers,
+				Functions:      functions.FuncMap,
+			}
+
+			if err = h.Load(); err != nil {
+				log.Fatal().Err(err).Str("address", addr).Msg("redir hanlder load error")
+			}
+
+			lc := ListenConfig{
+				ReusePort:   true,
+				Transparent: redirConfig.Transparent,
+			}
+
+			ln, err := lc.Listen(context.Background(), "tcp", addr)
+			if err != nil {
+				log.Fatal().Err(err).Str("address", addr).Msg("net.Listen error")
+			}
+
+			log.Info().Str("version", version).Str("address", ln.Addr().String()).Bool("redir_transparent", redirConfig.Transparent).Msg("liner listen and serve redir")
+
+			go func(ln net.Listener, h *RedirHandler) {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						log.Error().Err(err).Str("version", version).Str("address", ln.Addr().String()).Msg("liner accept redir connection error")
+						time.Sleep(10 * time.Millisecond)
+						continue
+					}
+					go h.ServeConn(conn)
+				}
+			}(ln, h)
+
+			// udp is only supported by TPROXY
+			if redirConfig.Transparent {
+				pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+				if err != nil {
+					log.Fatal().Err(err).Str("address", addr).Msg("net.ListenPacket error")
+				}
+
+				go h.ServePacketConn(pc.(*net.UDPConn))
+			}
+		}
+	}
+
+	// shadowsocks handler
+	for _, ssConfig := range config.Shadowsocks {
+		for _, addr := range ssConfig.Listen {
+			var ln net.Listener
+
+			if ln, err = lc.Listen(context.Background(), "tcp", addr); err != nil {
+				log.Fatal().Err(err).Str("address", addr).Msg("net.Listen error")
+			}
+
+			log.Info().Str("version", version).Str("address", ln.Addr().String()).Str("shadowsocks_method", ssConfig.Method).Msg("liner listen and serve shadowsocks")
+
+			h := &ShadowsocksHandler{
+				Config:         ssConfig,
+				ForwardLogger:  forwardLogger,
+				RegionResolver: regionResolver,
+				LocalDialer:    dialer,
+				Upstreams:      dialers,
+				Functions:      functions.FuncMap,
+			}
+
+			if err = h.Load(); err != nil {
+				log.Fatal().Err(err).Str("address", addr).Msg("shadowsocks hanlder load error")
+			}
+
+			go func(ln net.Listener, h *ShadowsocksHandler) {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						log.Error().Err(err).Str("version", version).Str("address", ln.Addr().String()).Msg("liner accept shadowsocks connection error")
+						time.Sleep(10 * time.Millisecond)
+						continue
+					}
+					go h.ServeConn(conn)
+				}
+			}(ln, h)
+		}
+	}
+
+	// ssh handler
+	for _, sshConfig := range config.Ssh {
+		for _, addr := range sshConfig.Listen {
+			var ln net.Listener
+
+			if ln, err = lc.Listen(context.Background(), "tcp", addr); err != nil {
+				log.Fatal().Err(err).Str("address", addr).Msg("net.Listen error")
+			}
+
+			log.Info().Str("version", version).Str("address", ln.Addr().String()).Msg("liner listen and serve ssh")
+
+			h := &SSHHandler{
+				Config:         sshConfig,
+				ForwardLogger:  forwardLogger,
+				RegionResolver: regionResolver,
+				LocalDialer:    dialer,
+				Upstreams:      dialers,
+				Functions:      functions.FuncMap,
+			}
+
+			if err = h.Load(); err != nil {
+				log.Fatal().Err(err).Str("address", addr).Msg("ssh hanlder load error")
+			}
+
+			go func(ln net.Listener, h *SSHHandler) {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						log.Error().Err(err).Str("version", version).Str("address", ln.Addr().String()).Msg("liner accept ssh connection error")
+						time.Sleep(10 * time.Millisecond)
+						continue
+					}
+					go h.ServeConn(conn)
+				}
+			}(ln, h)
+		}
+	}
+
+	// dns handler
+	for _, dnsConfig := range config.Dns {
+		h := &DnsHandler{
+			Config:         dnsConfig,
+			ForwardLogger:  forwardLogger,
+			RegionResolver: regionResolver,
+			Resolver:       resolver,
+			Functions:      functions.FuncMap,
+		}
+
+		if err = h.Load(); err != nil {
+			log.Fatal().Err(err).Strs("dns_listen", dnsConfig.Listen).Msg("dns hanlder load error")
+		}
+
+		for _, addr := range dnsConfig.Listen {
+			pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+			if err != nil {
+				log.Fatal().Err(err).Str("address", addr).Msg("net.ListenPacket error")
+			}
+
+			ln, err := lc.Listen(context.Background(), "tcp", addr)
+			if err != nil {
+				log.Fatal().Err(err).Str("address", addr).Msg("net.Listen error")
+			}
+
+			log.Info().Str("version", version).Str("address", ln.Addr().String()).Msg("liner listen and serve dns")
+
+			go h.ServePacketConn(pc)
+			go func(ln net.Listener, h *DnsHandler) {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						log.Error().Err(err).Str("version", version).Str("address", ln.Addr().String()).Msg("liner accept dns connection error")
+						time.Sleep(10 * time.Millisecond)
+						continue
+					}
+					go h.ServeConn(conn)
+				}
+			}(ln, h)
+		}
+
+		if len(dnsConfig.TlsListen) == 0 {
+			continue
+		}
+
+		if len(dnsConfig.ServerName) == 0 {
+			log.Fatal().Strs("dns_tls_listen", dnsConfig.TlsListen).Msg("dns tls_listen requires server_name")
+		}
+
+		for _, name := range dnsConfig.ServerName {
+			tlsConfigurator.AddCertEntry(TLSConfiguratorEntry{
+				ServerName: name,
+				KeyFile:    dnsConfig.Keyfile,
+				CertFile:   dnsConfig.Certfile,
+			})
+		}
+
+		tlsConfig := &tls.Config{
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				// dns clients may connect by ip without sni
+				if hello.ServerName == "" {
+					hello.ServerName = dnsConfig.ServerName[0]
+				}
+				return tlsConfigurator.GetCertificate(hello)
+			},
+			NextProtos: []string{"dot"},
+		}
+
+		for _, addr := range dnsConfig.TlsListen {
+			ln, err := lc.Listen(context.Background(), "tcp", addr)
+			if err != nil {
+				log.Fatal().Err(err).Str("address", addr).Msg("net.Listen error")
+			}
+
+			log.Info().Str("version", version).Str("address", ln.Addr().String()).Msg("liner listen and serve dns over tls")
+
+			go func(ln net.Listener, h *DnsHandler) {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						log.Error().Err(err).Str("version", version).Str("address", ln.Addr().String()).Msg("liner accept dns connection error")
+						time.Sleep(10 * time.Millisecond)
+						continue
+					}
+					go h.ServeConn(conn)
+				}
+			}(tls.NewListener(ln, tlsConfig), h)
+		}
+	}
+
 	// stream handler
 	for _, streamConfig := range config.Stream {
 		for _, addr := range streamConfig.Listen {
@@ -662,17 +1108,12 @@ func main() {
 	}
 
 	// tunnel handler
-	for _, tunnel := range config.Tunnel {
+	tunnelCtx, tunnelCancel := context.WithCancel(context.Background())
+	defer tunnelCancel()
+	for i, tunnel := range config.Tunnel {
+		h := tunnels[i]
 
-		h := &TunnelHandler{
-			Config:         tunnel,
-			ForwardLogger:  forwardLogger,
-			RegionResolver: regionResolver,
-			LocalDialer:    dialer,
-		}
-
-		switch {
-		case tunnel.Server.Listen != "":
+		if tunnel.Server.Listen != "" {
 			var ln net.Listener
 
 			if ln, err = lc.Listen(context.Background(), "tcp", tunnel.Server.Listen); err != nil {
@@ -681,22 +1122,58 @@ func main() {
 
 			log.Info().Str("version", version).Str("address", ln.Addr().String()).Msg("liner listen and tunnel port")
 
-			if err = h.Load(); err != nil {
-				log.Fatal().Err(err).Str("address", tunnel.Server.Listen).Msg("tunnel hanlder load error")
-			}
-
 			go func(ln net.Listener, h *TunnelHandler) {
 				for {
 					conn, err := ln.Accept()
 					if err != nil {
 						log.Error().Err(err).Str("version", version).Str("address", ln.Addr().String()).Msg("liner accept tunnel connection error")
 						time.Sleep(10 * time.Millisecond)
+						continue
 					}
 					go h.ServeConn(conn)
 				}
 			}(ln, h)
-		case tunnel.Client.RemoteAddr != "" && tunnel.Client.LocalAddr != "":
-			go h.Client(context.Background())
+		}
+
+		for _, expose := range tunnel.Server.Expose {
+			var ln net.Listener
+
+			if ln, err = lc.Listen(context.Background(), "tcp", expose.Listen); err != nil {
+				log.Fatal().Err(err).Str("address", expose.Listen).Msg("net.Listen error")
+			}
+
+			log.Info().Str("version", version).Str("address", ln.Addr().String()).Str("tunnel_client", expose.Client).Str("tunnel_service", expose.Service).Msg("liner listen and expose tunnel service")
+
+			sh := &StreamHandler{
+				Config: StreamConfig{
+					Listen:    []string{expose.Listen},
+					ProxyPass: net.JoinHostPort(expose.Client, expose.Service),
+					Dialer:    "tunnel",
+				},
+				ForwardLogger:  forwardLogger,
+				RegionResolver: regionResolver,
+				LocalDialer:    dialer,
+				Dialers:        map[string]Dialer{"tunnel": h},
+			}
+
+			if err = sh.Load(); err != nil {
+				log.Fatal().Err(err).Str("address", expose.Listen).Msg("stream hanlder load error")
+			}
+
+			go func(ln net.Listener, h *StreamHandler) {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						log.Error().Err(err).Str("version", version).Str("address", ln.Addr().String()).Msg("liner accept tunnel expose connection error")
+						time.Sleep(10 * time.Millisecond)
+						continue
+					}
+					go h.ServeConn(conn)
+				}
+			}(ln, sh)
+		}
+		if tunnel.Client.RemoteAddr != "" && (tunnel.Client.LocalAddr != "" || len(tunnel.Client.Services) != 0) {
+			go h.Client(tunnelCtx)
 		}
 	}
 
@@ -742,6 +1219,8 @@ func main() {
 	log.Warn().Msg("liner start graceful shutdown...")
 	SetProcessName("liner: (graceful shutdown)")
 
+	tunnelCancel()
+
 	var wg sync.WaitGroup
 	for _, server := range servers {
 		wg.Add(1)
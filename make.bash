@@ -8,19 +8,19 @@ BUILDROOT=build
 
 REVSION=$(git rev-list --count HEAD)
 LDFLAGS="-s -w -X main.version=${REVSION}"
-SOURCES="README.md china.pac autoindex.html example.yaml liner.sh"
+SOURCES="README.md china.pac autoindex.html example.yaml liner.sh poisoned_ips.txt"
 
 GOOS=${GOOS:-$(go env GOOS)}
 GOARCH=${GOARCH:-$(go env GOARCH)}
 CGO_ENABLED=${CGO_ENABLED:-$(go env CGO_ENABLED)}
 
 if [ "${GOOS}" == "windows" ]; then
-    SOURCES="README.md china.pac example.yaml"
+    SOURCES="README.md china.pac example.yaml poisoned_ips.txt"
     BUILDDIR=${BUILDROOT}/${GOOS}_${GOARCH}
     DISTFILE=${PROJECT}_${GOOS}_${GOARCH}-${REVSION}
     GOEXE=.exe
 elif [ "${GOOS}" == "darwin" ]; then
-    SOURCES="README.md china.pac example.yaml"
+    SOURCES="README.md china.pac example.yaml poisoned_ips.txt"
     BUILDDIR=${BUILDROOT}/${GOOS}_${GOARCH}
     DISTFILE=${PROJECT}_${GOOS}_${GOARCH}-${REVSION}
 elif [ "${GOARCH:0:3}" == "arm" ]; then
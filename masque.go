@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// MasqueUDPPathPrefix is the prefix of default uri template of RFC 9298, /.well-known/masque/udp/{target_host}/{target_port}/
+const MasqueUDPPathPrefix = "/.well-known/masque/udp/"
+
+// MasqueUDPPath returns the path and raw path of url for target, colons of ipv6 address are percent-encoded in raw path.
+func MasqueUDPPath(host, port string) (path, rawPath string) {
+	path = MasqueUDPPathPrefix + host + "/" + port + "/"
+	rawPath = MasqueUDPPathPrefix + strings.ReplaceAll(url.PathEscape(host), ":", "%3A") + "/" + url.PathEscape(port) + "/"
+	return
+}
+
+// ParseMasqueUDPPath parses the target of an escaped path, see url.URL.EscapedPath
+func ParseMasqueUDPPath(escapedPath string) (host, port string, ok bool) {
+	s, ok := strings.CutPrefix(escapedPath, MasqueUDPPathPrefix)
+	if !ok {
+		return
+	}
+	parts := strings.Split(strings.TrimSuffix(s, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	host, err := url.PathUnescape(parts[0])
+	if err != nil {
+		return "", "", false
+	}
+	port, err = url.PathUnescape(parts[1])
+	if err != nil {
+		return "", "", false
+	}
+	return host, port, true
+}
+
+// MasqueConn sends and receives udp payloads as HTTP datagrams of context id 0 on a CONNECT-UDP stream.
+type MasqueConn struct {
+	Stream     http3.Stream
+	remoteAddr net.Addr
+	localAddr  net.Addr
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	once         sync.Once
+}
+
+func (c *MasqueConn) Read(b []byte) (int, error) {
+	ctx := context.Background()
+	c.mu.Lock()
+	if deadline := c.readDeadline; !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	c.mu.Unlock()
+
+	for {
+		data, err := c.Stream.ReceiveDatagram(ctx)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				return 0, &net.OpError{Op: "read", Net: "udp", Addr: c.remoteAddr, Err: errMasqueTimeout{}}
+			}
+			return 0, err
+		}
+		payload, ok := masqueUDPPayload(data)
+		if !ok {
+			continue
+		}
+		return copy(b, payload), nil
+	}
+}
+
+func (c *MasqueConn) Write(b []byte) (int, error) {
+	data := make([]byte, 0, 1+len(b))
+	data = quicvarint.Append(data, 0)
+	data = append(data, b...)
+	if err := c.Stream.SendDatagram(data); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *MasqueConn) Close() (err error) {
+	c.once.Do(func() {
+		c.Stream.CancelRead(0)
+		err = c.Stream.Close()
+	})
+	return
+}
+
+func (c *MasqueConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *MasqueConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *MasqueConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *MasqueConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *MasqueConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// masqueUDPPayload strips the context id of a HTTP datagram, the datagrams of unknown context are dropped.
+func masqueUDPPayload(data []byte) ([]byte, bool) {
+	r := bytes.NewReader(data)
+	id, err := quicvarint.Read(r)
+	if err != nil || id != 0 {
+		return nil, false
+	}
+	return data[len(data)-r.Len():], true
+}
+
+type errMasqueTimeout struct{}
+
+func (errMasqueTimeout) Error() string   { return "i/o timeout" }
+func (errMasqueTimeout) Timeout() bool   { return true }
+func (errMasqueTimeout) Temporary() bool { return true }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestMasqueUDPPath(t *testing.T) {
+	cases := []struct {
+		Host       string
+		Port       string
+		RequestURI string
+	}{
+		{"1.1.1.1", "53", "/.well-known/masque/udp/1.1.1.1/53/"},
+		{"2606:4700::1111", "53", "/.well-known/masque/udp/2606%3A4700%3A%3A1111/53/"},
+		{"example.org", "443", "/.well-known/masque/udp/example.org/443/"},
+	}
+
+	for _, c := range cases {
+		req, err := http.NewRequest(http.MethodConnect, "https://proxy.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.URL.Path, req.URL.RawPath = MasqueUDPPath(c.Host, c.Port)
+
+		if uri := req.URL.RequestURI(); uri != c.RequestURI {
+			t.Errorf("MasqueUDPPath(%#v, %#v) must be sent as %#v, not %#v", c.Host, c.Port, c.RequestURI, uri)
+		}
+
+		// the server side parses the request uri
+		u, err := url.ParseRequestURI(req.URL.RequestURI())
+		if err != nil {
+			t.Fatal(err)
+		}
+		host, port, ok := ParseMasqueUDPPath(u.EscapedPath())
+		if !ok || host != c.Host || port != c.Port {
+			t.Errorf("ParseMasqueUDPPath(%#v) must return %#v %#v, not %#v %#v %v", u.EscapedPath(), c.Host, c.Port, host, port, ok)
+		}
+	}
+}
@@ -2,40 +2,606 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
 	"net"
+	"net/http"
 	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/phuslu/log"
 	"github.com/phuslu/lru"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/http2"
 )
 
 type Resolver struct {
 	*net.Resolver
-	LRUCache      *lru.TTLCache[string, []netip.Addr]
+	LRUCache *lru.TTLCache[string, *ResolverCacheEntry]
+	// CacheDuration is the ttl of lookups without record ttls, e.g. lookups of system resolver.
 	CacheDuration time.Duration
+	// MinTTL and MaxTTL clamp the ttls of records.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// NegativeTTL is the ttl of nonexistent domains.
+	NegativeTTL time.Duration
+	// StaleTTL is how long an expired record could be served while it is refreshing, see RFC 8767.
+	StaleTTL     time.Duration
+	Singleflight *singleflight_Group[string, *ResolverCacheEntry]
+
+	// Rules routes lookups to other resolvers by domain, the first matched rule is used.
+	Rules []ResolverRule
+	// GeoSite returns the first filter which matches the geosite category of a domain, e.g. "google@cn", it is used by rules with Geosite.
+	GeoSite func(domain string, filters ...string) string
+
+	// Hosts and HostsFile are static mappings which are consulted before dns lookups, Hosts takes precedence.
+	Hosts     *ResolverHosts
+	HostsFile *FileLoader[ResolverHosts]
+
+	// FakeIP answers domains by fake addresses in dns handlers, and dialers map them back to domains.
+	FakeIP *FakeIP
+
+	// Poisoned answers are discarded and retried over the default resolver, which should be secure, e.g. dns over https.
+	// It is nil unless dns_poisoned_ips is set, answers of trusted rules are not checked.
+	Poisoned *PoisonedIPs
+}
+
+type ResolverCacheEntry struct {
+	IPs     []netip.Addr
+	Err     error
+	Expires time.Time
+}
+
+// ResolverRule matches domains by suffix or geosite category, its resolvers are tried in order.
+type ResolverRule struct {
+	Domains       []string
+	Geosite       []string
+	Resolvers     []*net.Resolver
+	CacheDuration time.Duration
+	// Trusted resolvers are not checked for poisoned answers, e.g. split-horizon or lan resolvers.
+	Trusted bool
+}
+
+func (rule *ResolverRule) Match(host string, geosite func(string, ...string) string) bool {
+	for _, domain := range rule.Domains {
+		domain = strings.TrimPrefix(domain, ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	if len(rule.Geosite) != 0 && geosite != nil {
+		if geosite(host, rule.Geosite...) != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Route returns the resolvers for host, the cache duration of matched rule which overrides record ttls, and whether the rule is trusted.
+func (r *Resolver) Route(host string) ([]*net.Resolver, time.Duration, bool) {
+	for i := range r.Rules {
+		if rule := &r.Rules[i]; rule.Match(host, r.GeoSite) {
+			return rule.Resolvers, rule.CacheDuration, rule.Trusted
+		}
+	}
+
+	return []*net.Resolver{r.Resolver}, 0, false
 }
 
 func (r *Resolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	ips, _, err := r.LookupNetIPWithTTL(ctx, network, host)
+	return ips, err
+}
+
+// LookupNetIPWithTTL is like LookupNetIP, and it returns the remaining ttl of records.
+func (r *Resolver) LookupNetIPWithTTL(ctx context.Context, network, host string) ([]netip.Addr, time.Duration, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{ip}, 0, nil
+	}
+
+	if ips, ok := r.lookupHosts(network, host); ok {
+		if len(ips) == 0 {
+			return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return ips, r.CacheDuration, nil
+	}
+
+	// records of ip4 and ip6 are cached separately from ip
+	key := host
+	if network != "ip" {
+		key = network + ":" + host
+	}
+
 	if r.LRUCache != nil {
-		if v, ok := r.LRUCache.Get(host); ok {
-			return v, nil
+		if e, ok := r.LRUCache.Get(key); ok {
+			if ttl := e.Expires.Sub(timeNow()); ttl > 0 {
+				return e.IPs, ttl, e.Err
+			}
+			if e.Err == nil {
+				// serve stale records and refresh them in background
+				go r.lookup(context.Background(), network, host, key)
+				return e.IPs, 30 * time.Second, nil
+			}
 		}
 	}
 
-	if ip, err := netip.ParseAddr(host); err == nil {
-		return []netip.Addr{ip}, nil
+	e := r.lookup(ctx, network, host, key)
+	if e.Err != nil {
+		return nil, 0, e.Err
+	}
+
+	return e.IPs, e.Expires.Sub(timeNow()), nil
+}
+
+// lookupHosts returns the addresses of host in static mappings of network, and whether host is mapped.
+func (r *Resolver) lookupHosts(network, host string) ([]netip.Addr, bool) {
+	ips, ok := r.Hosts.Lookup(host)
+	if !ok && r.HostsFile != nil {
+		ips, ok = r.HostsFile.Load().Lookup(host)
+	}
+	if !ok || network == "ip" {
+		return ips, ok
 	}
 
-	ips, err := r.Resolver.LookupNetIP(ctx, network, host)
+	var addrs []netip.Addr
+	for _, ip := range ips {
+		if ip.Unmap().Is4() == (network == "ip4") {
+			addrs = append(addrs, ip)
+		}
+	}
+
+	return addrs, true
+}
+
+// lookup resolves host and caches the result, concurrent lookups of a key are coalesced.
+func (r *Resolver) lookup(ctx context.Context, network, host, key string) *ResolverCacheEntry {
+	fn := func() (*ResolverCacheEntry, error) {
+		// the lookup is shared by other callers, so it should not be canceled by this caller
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer cancel()
+
+		resolvers, cacheDuration, trusted := r.Route(host)
+
+		var ips []netip.Addr
+		var ttl time.Duration
+		var err error
+		for _, resolver := range resolvers {
+			ips, ttl, err = r.exchange(ctx, resolver, network, host)
+			if err == nil && !trusted {
+				ips, ttl, err = r.unpoison(ctx, resolver, network, host, ips, ttl)
+			}
+			if err == nil {
+				break
+			}
+			// a nonexistent domain is not retried by the fallback resolvers
+			var de *net.DNSError
+			if errors.As(err, &de) && de.IsNotFound || ctx.Err() != nil {
+				break
+			}
+		}
+
+		now := timeNow()
+
+		if err != nil {
+			var de *net.DNSError
+			if !errors.As(err, &de) || !de.IsNotFound {
+				return &ResolverCacheEntry{Err: err}, nil
+			}
+			e := &ResolverCacheEntry{Err: err, Expires: now.Add(r.NegativeTTL)}
+			if r.LRUCache != nil && r.NegativeTTL > 0 {
+				r.LRUCache.Set(key, e, r.NegativeTTL)
+			}
+			return e, nil
+		}
+
+		if cacheDuration > 0 {
+			ttl = cacheDuration
+		} else {
+			if r.MinTTL > 0 {
+				ttl = max(ttl, r.MinTTL)
+			}
+			if r.MaxTTL > 0 {
+				ttl = min(ttl, r.MaxTTL)
+			}
+		}
+
+		e := &ResolverCacheEntry{IPs: ips, Expires: now.Add(ttl)}
+		if r.LRUCache != nil && ttl > 0 && len(ips) > 0 {
+			r.LRUCache.Set(key, e, ttl+r.StaleTTL)
+		}
+
+		log.Debug().Msgf("lookupIP(%#v) return %+v", host, ips)
+		return e, nil
+	}
+
+	if r.Singleflight == nil {
+		e, _ := fn()
+		return e
+	}
+
+	e, _, _ := r.Singleflight.Do(key, fn)
+	return e
+}
+
+// unpoison discards the poisoned answer of resolver and retries over the default resolver, the poisoned ips are removed anyway.
+func (r *Resolver) unpoison(ctx context.Context, resolver *net.Resolver, network, host string, ips []netip.Addr, ttl time.Duration) ([]netip.Addr, time.Duration, error) {
+	ips, poisoned := r.Poisoned.Filter(ips)
+	if !poisoned {
+		return ips, ttl, nil
+	}
+
+	poisonedExpvar.Add("answers", 1)
+	log.Warn().Str("host", host).Str("network", network).Msg("discard poisoned dns answer")
+
+	if resolver != r.Resolver {
+		poisonedExpvar.Add("retries", 1)
+		secure, secureTTL, err := r.exchange(ctx, r.Resolver, network, host)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ips, poisoned = r.Poisoned.Filter(secure); poisoned {
+			poisonedExpvar.Add("answers", 1)
+		}
+		ttl = secureTTL
+	}
+
+	if len(ips) == 0 {
+		return nil, 0, &net.DNSError{Err: "poisoned answer", Name: host, IsTemporary: true}
+	}
+
+	return ips, ttl, nil
+}
+
+// exchange queries A and AAAA records by the dial function of resolver, so that ttls of records are known.
+// The system resolver and names in hosts file are looked up by net.Resolver with CacheDuration as ttl.
+func (r *Resolver) exchange(ctx context.Context, resolver *net.Resolver, network, host string) ([]netip.Addr, time.Duration, error) {
+	_, inHosts := systemHosts.Load().Lookup(host)
+	if resolver.Dial == nil || inHosts || !strings.Contains(host, ".") || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		ips, err := resolver.LookupNetIP(ctx, network, host)
+		return ips, r.CacheDuration, err
+	}
+
+	var types []dnsmessage.Type
+	switch network {
+	case "ip4":
+		types = []dnsmessage.Type{dnsmessage.TypeA}
+	case "ip6":
+		types = []dnsmessage.Type{dnsmessage.TypeAAAA}
+	default:
+		types = []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	}
+
+	type exchangeResult struct {
+		IPs       []netip.Addr
+		TTL       time.Duration
+		Err       error
+		Truncated bool
+	}
+
+	results := make([]exchangeResult, len(types))
+
+	var wg sync.WaitGroup
+	for i, qtype := range types {
+		wg.Add(1)
+		go func(i int, qtype dnsmessage.Type) {
+			defer wg.Done()
+
+			name, err := dnsmessage.NewName(host + ".")
+			if err != nil {
+				results[i].Err = &net.DNSError{Err: err.Error(), Name: host}
+				return
+			}
+
+			id := uint16(fastrandn(65536))
+			b := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{ID: id, RecursionDesired: true})
+			b.StartQuestions()
+			b.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET})
+			b.StartAdditionals()
+			var rh dnsmessage.ResourceHeader
+			rh.SetEDNS0(1232, dnsmessage.RCodeSuccess, false)
+			b.OPTResource(rh, dnsmessage.OPTResource{})
+			query, _ := b.Finish()
+
+			resp, err := dnsExchange(ctx, resolver.Dial, query)
+			if err != nil {
+				results[i].Err = &net.DNSError{Err: err.Error(), Name: host, IsTemporary: true}
+				return
+			}
+
+			var p dnsmessage.Parser
+			header, err := p.Start(resp)
+			if err != nil || header.ID != id {
+				results[i].Err = &net.DNSError{Err: "server misbehaving", Name: host, IsTemporary: true}
+				return
+			}
+
+			switch {
+			case header.Truncated:
+				results[i].Truncated = true
+				return
+			case header.RCode == dnsmessage.RCodeNameError:
+				results[i].Err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+				return
+			case header.RCode != dnsmessage.RCodeSuccess:
+				results[i].Err = &net.DNSError{Err: "server misbehaving: " + header.RCode.String(), Name: host, IsTemporary: true}
+				return
+			}
+
+			p.SkipAllQuestions()
+			answers, _ := p.AllAnswers()
+			for _, rr := range answers {
+				var ip netip.Addr
+				switch body := rr.Body.(type) {
+				case *dnsmessage.AResource:
+					ip = netip.AddrFrom4(body.A)
+				case *dnsmessage.AAAAResource:
+					ip = netip.AddrFrom16(body.AAAA)
+				default:
+					continue
+				}
+				ttl := time.Duration(rr.Header.TTL) * time.Second
+				if len(results[i].IPs) == 0 || ttl < results[i].TTL {
+					results[i].TTL = ttl
+				}
+				results[i].IPs = append(results[i].IPs, ip)
+			}
+
+			if len(results[i].IPs) == 0 {
+				results[i].Err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+			}
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	var ips []netip.Addr
+	var ttl time.Duration
+	var err error
+	for _, result := range results {
+		if result.Truncated {
+			// net.Resolver retries truncated responses over tcp
+			ips, err := resolver.LookupNetIP(ctx, network, host)
+			return ips, r.CacheDuration, err
+		}
+		if result.Err != nil {
+			var de *net.DNSError
+			if err == nil || errors.As(err, &de) && de.IsNotFound {
+				err = result.Err
+			}
+			continue
+		}
+		if len(ips) == 0 || result.TTL < ttl {
+			ttl = result.TTL
+		}
+		ips = append(ips, result.IPs...)
+	}
+
+	if len(ips) == 0 {
+		return nil, 0, err
+	}
+
+	return ips, ttl, nil
+}
+
+// dnsExchange sends a dns query by dial function of net.Resolver and returns the response.
+func dnsExchange(ctx context.Context, dial func(ctx context.Context, network, address string) (net.Conn, error), query []byte) ([]byte, error) {
+	conn, err := dial(ctx, "udp", "")
 	if err != nil {
 		return nil, err
 	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// like net.Resolver, a packet connection sends messages without length prefix
+	if _, ok := conn.(net.PacketConn); ok {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+		return nil, err
+	}
+
+	var b [2]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, binary.BigEndian.Uint16(b[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// NewResolverDialer returns the Dial function of net.Resolver for a dns server url, e.g. udp://1.1.1.1, tls://1.1.1.1 and https://1.1.1.1/dns-query
+// DoH servers could be a comma separated list, e.g. https://1.1.1.1/dns-query?method=get&strategy=parallel,https://8.8.8.8/dns-query
+// Each DoH server has its own options and transport, and the strategy and timeout of the first one apply to the list.
+// The udp, tcp and tls servers could egress through a dialer of dialers, e.g. udp://1.1.1.1?dialer=socks, it is looked up on dialing.
+func NewResolverDialer(dnsServer string, dialers map[string]Dialer) (func(ctx context.Context, network, address string) (net.Conn, error), error) {
+	var urls []*url.URL
+	for _, server := range strings.Split(dnsServer, ",") {
+		if !strings.Contains(server, "://") {
+			server = "udp://" + server
+		}
+		u, err := url.Parse(server)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, errors.New("no scheme or host")
+		}
+		urls = append(urls, u)
+	}
+
+	u := urls[0]
+
+	switch u.Scheme {
+	case "https", "http2", "h2", "doh", "http3", "h3":
+		doh := newDoHResolverDialer(u)
+		for _, v := range urls[1:] {
+			upstream := newDoHResolverDialer(v)
+			if upstream == nil {
+				return nil, errors.New("multiple servers are only supported by DoH")
+			}
+			doh.Upstreams = append(doh.Upstreams, upstream)
+		}
+		return doh.DialContext, nil
+	default:
+		if len(urls) > 1 {
+			return nil, errors.New("multiple servers are only supported by DoH")
+		}
+	}
+
+	var dialer Dialer = &net.Dialer{
+		Timeout: 2 * time.Second,
+	}
+	if name := u.Query().Get("dialer"); name != "" {
+		dialer = &resolverDialer{name, dialers}
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		var addr = u.Host
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+		return func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, u.Scheme, addr)
+		}, nil
+	case "tls", "dot":
+		var addr = u.Host
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			addr = net.JoinHostPort(addr, "853")
+		}
+		if _, ok := dialer.(*resolverDialer); ok {
+			tlsConfig := &tls.Config{
+				ServerName:         u.Hostname(),
+				ClientSessionCache: tls.NewLRUClientSessionCache(128),
+			}
+			return func(ctx context.Context, _, _ string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, "tcp", addr)
+				if err != nil {
+					return nil, err
+				}
+				tconn := tls.Client(conn, tlsConfig)
+				if err := tconn.HandshakeContext(ctx); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return tconn, nil
+			}, nil
+		}
+		tlsDialer := &tls.Dialer{
+			NetDialer: &net.Dialer{
+				Timeout: 2 * time.Second,
+			},
+			Config: &tls.Config{
+				ServerName:         u.Hostname(),
+				ClientSessionCache: tls.NewLRUClientSessionCache(128),
+			},
+		}
+		return func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return tlsDialer.DialContext(ctx, "tcp", addr)
+		}, nil
+	}
+
+	return nil, errors.New("unsupported scheme " + u.Scheme)
+}
+
+// newDoHResolverDialer returns a DoH dialer with the options of u, or nil if u is not a DoH server.
+func newDoHResolverDialer(u *url.URL) *DoHResolverDialer {
+	var transport http.RoundTripper
+	switch u.Scheme {
+	case "https", "http2", "h2", "doh":
+		transport = &http2.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: u.Query().Get("insecure") == "1",
+				ClientSessionCache: tls.NewLRUClientSessionCache(128),
+			},
+		}
+	case "http3", "h3":
+		transport = &http3.RoundTripper{
+			DisableCompression: false,
+			EnableDatagrams:    false,
+			TLSClientConfig: &tls.Config{
+				NextProtos:         []string{"h3"},
+				InsecureSkipVerify: u.Query().Get("insecure") == "1",
+				ClientSessionCache: tls.NewLRUClientSessionCache(128),
+			},
+			QUICConfig: &quic.Config{
+				DisablePathMTUDiscovery: false,
+				EnableDatagrams:         false,
+				MaxIncomingUniStreams:   200,
+				MaxIncomingStreams:      200,
+			},
+		}
+	default:
+		return nil
+	}
+
+	return &DoHResolverDialer{
+		EndPoint:  dohEndPoint(u.String()),
+		UserAgent: u.Query().Get("user_agent"),
+		UseGET:    strings.EqualFold(u.Query().Get("method"), "GET"),
+		Padding:   u.Query().Get("padding") != "0",
+		Parallel:  u.Query().Get("strategy") == "parallel",
+		Timeout:   time.Duration(first(strconv.Atoi(u.Query().Get("timeout")))) * time.Second,
+		Transport: transport,
+	}
+}
+
+// resolverDialer looks up the named dialer on dialing, because dialers are created after resolver.
+type resolverDialer struct {
+	name    string
+	dialers map[string]Dialer
+}
+
+func (d *resolverDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer, ok := d.dialers[d.name]
+	if !ok {
+		return nil, errors.New("dns: dialer " + d.name + " not exists")
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// dohEndPoint returns the https url of a DoH server, the options of resolver are removed from query.
+func dohEndPoint(server string) string {
+	u, err := url.Parse(server)
+	if err != nil {
+		return server
+	}
+
+	switch u.Scheme {
+	case "http2", "h2", "doh", "http3", "h3":
+		u.Scheme = "https"
+	}
 
-	if r.LRUCache != nil && r.CacheDuration > 0 && len(ips) > 0 {
-		r.LRUCache.Set(host, ips, r.CacheDuration)
+	q := u.Query()
+	for _, key := range []string{"user_agent", "method", "padding", "strategy", "timeout", "insecure"} {
+		q.Del(key)
 	}
+	u.RawQuery = q.Encode()
 
-	log.Debug().Msgf("lookupIP(%#v) return %+v", host, ips)
-	return ips, nil
+	return u.String()
 }
@@ -3,29 +3,276 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/binary"
 	"errors"
+	"expvar"
 	"io"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 var _ Dialer = (*DoHResolverDialer)(nil)
 
 type DoHResolverDialer struct {
 	EndPoint  string
+	Upstreams []*DoHResolverDialer // more endpoints with their own options, they are queried in round robin or in parallel
 	UserAgent string
 	Transport http.RoundTripper
+	UseGET    bool // send queries by GET with ?dns= base64url, so that they are cacheable by http caches
+	Padding   bool // pad queries with EDNS(0) padding option, see RFC 8467
+	Parallel  bool // query all endpoints in parallel, the fastest answer wins
+	Timeout   time.Duration
+
+	once  sync.Once
+	stats []*dohEndpointStats
+	next  atomic.Uint32
+}
+
+// dohEndpointStats is published as expvar doh_resolver, see /debug/vars
+type dohEndpointStats struct {
+	mu       sync.Mutex
+	dialer   *DoHResolverDialer
+	EndPoint string
+	Requests int64
+	Errors   int64
+	Latency  time.Duration // moving average of latency
+}
+
+var dohExpvar = expvar.NewMap("doh_resolver")
+
+func (d *DoHResolverDialer) init() {
+	d.once.Do(func() {
+		var dialers []*DoHResolverDialer
+		if d.EndPoint != "" {
+			dialers = append(dialers, d)
+		}
+		dialers = append(dialers, d.Upstreams...)
+
+		for _, dialer := range dialers {
+			s := &dohEndpointStats{dialer: dialer, EndPoint: dialer.EndPoint}
+			d.stats = append(d.stats, s)
+			dohExpvar.Set(s.EndPoint, expvar.Func(func() any {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				return map[string]any{
+					"requests":   s.Requests,
+					"errors":     s.Errors,
+					"latency_ms": s.Latency.Milliseconds(),
+				}
+			}))
+		}
+	})
 }
 
 func (d *DoHResolverDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	return &dohConn{d, nil}, nil
+	d.init()
+	if len(d.stats) == 0 {
+		return nil, errors.New("doh resolver: empty endpoint")
+	}
+	return &dohConn{dialer: d, ctx: ctx}, nil
+}
+
+// Exchange sends a dns message to endpoints and returns the first answer.
+func (d *DoHResolverDialer) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	d.init()
+
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if !d.Parallel || len(d.stats) == 1 {
+		var err error
+		n := int(d.next.Add(1) - 1)
+		for i := range d.stats {
+			var resp []byte
+			if resp, err = d.query(ctx, d.stats[(n+i)%len(d.stats)], msg); err == nil {
+				return resp, nil
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, err
+	}
+
+	type queryResult struct {
+		Resp []byte
+		Err  error
+	}
+
+	lane := make(chan queryResult, len(d.stats))
+	for _, s := range d.stats {
+		go func(s *dohEndpointStats) {
+			resp, err := d.query(ctx, s, msg)
+			lane <- queryResult{resp, err}
+		}(s)
+	}
+
+	var err error
+	for range d.stats {
+		r := <-lane
+		if r.Err == nil {
+			return r.Resp, nil
+		}
+		err = r.Err
+	}
+
+	return nil, err
+}
+
+func (d *DoHResolverDialer) query(ctx context.Context, s *dohEndpointStats, msg []byte) (data []byte, err error) {
+	start := timeNow()
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.Requests++
+		if err != nil {
+			// an answer lost in a parallel race is not an error of endpoint
+			if !errors.Is(err, context.Canceled) {
+				s.Errors++
+			}
+			return
+		}
+		if latency := timeNow().Sub(start); s.Latency == 0 {
+			s.Latency = latency
+		} else {
+			s.Latency = (s.Latency*7 + latency) / 8
+		}
+	}()
+
+	// the options of endpoint
+	o := s.dialer
+
+	if o.Padding {
+		msg = dnsPadding(msg)
+	}
+
+	id := binary.BigEndian.Uint16(msg)
+
+	var req *http.Request
+	if o.UseGET {
+		// the id should be 0 in GET requests for cacheability, see RFC 8484 section 4.1
+		query := make([]byte, len(msg))
+		copy(query, msg)
+		query[0], query[1] = 0, 0
+
+		sep := "?"
+		if strings.Contains(s.EndPoint, "?") {
+			sep = "&"
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, s.EndPoint+sep+"dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, s.EndPoint, bytes.NewReader(msg))
+		if req != nil {
+			req.Header.Set("content-type", "application/dns-message")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("accept", "application/dns-message")
+	if o.UserAgent != "" {
+		req.Header.Set("user-agent", o.UserAgent)
+	}
+
+	var tr = o.Transport
+	if tr == nil {
+		tr = http.DefaultTransport
+	}
+
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// the response may be chunked without content-length
+	data, err = io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("proxy: read from " + s.EndPoint + " error: " + resp.Status + ": " + string(data[:min(len(data), 1024)]))
+	}
+
+	if len(data) < 12 {
+		return nil, errors.New("proxy: read from " + s.EndPoint + " error: dns message too short")
+	}
+
+	binary.BigEndian.PutUint16(data, id)
+
+	return data, nil
+}
+
+// dnsPadding pads a dns query to a multiple of 128 bytes, see RFC 8467 section 4.1
+func dnsPadding(msg []byte) []byte {
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		return msg
+	}
+
+	i := -1
+	for j, rr := range m.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			i = j
+			break
+		}
+	}
+	if i < 0 {
+		var rh dnsmessage.ResourceHeader
+		rh.SetEDNS0(1232, dnsmessage.RCodeSuccess, false)
+		m.Additionals = append(m.Additionals, dnsmessage.Resource{Header: rh, Body: &dnsmessage.OPTResource{}})
+		i = len(m.Additionals) - 1
+	}
+
+	opt, ok := m.Additionals[i].Body.(*dnsmessage.OPTResource)
+	if !ok {
+		return msg
+	}
+
+	const paddingOption = 12
+
+	options := opt.Options[:0]
+	for _, o := range opt.Options {
+		if o.Code != paddingOption {
+			options = append(options, o)
+		}
+	}
+	opt.Options = options
+
+	b, err := m.Pack()
+	if err != nil {
+		return msg
+	}
+
+	// 4 bytes of option code and length
+	opt.Options = append(opt.Options, dnsmessage.Option{Code: paddingOption, Data: make([]byte, (128-(len(b)+4)%128)%128)})
+
+	if b, err = m.Pack(); err != nil {
+		return msg
+	}
+
+	return b
 }
 
 type dohConn struct {
-	dialer *DoHResolverDialer
-	buffer *bytes.Buffer
+	dialer   *DoHResolverDialer
+	ctx      context.Context
+	deadline time.Time
+	buffer   *bytes.Buffer
 }
 
 func (c *dohConn) Read(b []byte) (n int, err error) {
@@ -44,50 +291,25 @@ func (c *dohConn) Write(b []byte) (n int, err error) {
 	if int(binary.BigEndian.Uint16(b))+2 != len(b) {
 		return 0, errors.New("dns message head size mismath")
 	}
-
-	req, err := http.NewRequest(http.MethodPost, c.dialer.EndPoint, bytes.NewReader(b[2:]))
-	if err != nil {
-		return 0, err
+	if len(b) < 2+12 {
+		return 0, errors.New("dns message too short")
 	}
 
-	req.Header.Set("content-type", "application/dns-message")
-	if c.dialer.UserAgent != "" {
-		req.Header.Set("user-agent", c.dialer.UserAgent)
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
 	}
 
-	var tr = c.dialer.Transport
-	if tr == nil {
-		tr = http.DefaultTransport
-	}
-
-	ctx, cancel := context.WithTimeout(req.Context(), 5*time.Second)
-	defer cancel()
-
-	resp, err := tr.RoundTrip(req.WithContext(ctx))
+	data, err := c.dialer.Exchange(ctx, b[2:])
 	if err != nil {
 		return 0, err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK || resp.ContentLength <= 0 {
-		var errmsg string
-		if resp.Body != nil {
-			data := make([]byte, 1024)
-			if n, err := resp.Body.Read(data); err != nil {
-				errmsg = err.Error()
-			} else {
-				errmsg = string(data[:n])
-			}
-		}
-		return 0, errors.New("proxy: read from " + c.dialer.EndPoint + " error: " + resp.Status + ": " + errmsg)
-	}
 
 	c.buffer = new(bytes.Buffer)
-	binary.Write(c.buffer, binary.BigEndian, uint16(resp.ContentLength))
-	_, err = io.Copy(c.buffer, resp.Body)
-	if err != nil {
-		return 0, err
-	}
+	binary.Write(c.buffer, binary.BigEndian, uint16(len(data)))
+	c.buffer.Write(data)
 
 	return len(b), nil
 }
@@ -105,13 +327,15 @@ func (c *dohConn) RemoteAddr() (addr net.Addr) {
 }
 
 func (c *dohConn) SetDeadline(t time.Time) error {
-	return &net.OpError{Op: "set", Net: "http2", Source: nil, Addr: nil, Err: errors.New("deadline not supported")}
+	c.deadline = t
+	return nil
 }
 
 func (c *dohConn) SetReadDeadline(t time.Time) error {
-	return &net.OpError{Op: "set", Net: "http2", Source: nil, Addr: nil, Err: errors.New("deadline not supported")}
+	return nil
 }
 
 func (c *dohConn) SetWriteDeadline(t time.Time) error {
-	return &net.OpError{Op: "set", Net: "http2", Source: nil, Addr: nil, Err: errors.New("deadline not supported")}
+	c.deadline = t
+	return nil
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"sync"
+)
+
+// FakeIP allocates addresses from reserved prefixes for domains, so that transparent proxies could recover domains from destination addresses.
+type FakeIP struct {
+	Prefix4 netip.Prefix // e.g. 198.18.0.0/15
+	Prefix6 netip.Prefix // e.g. fc00::/18, optional
+	// Filter is the domain suffixes which are resolved to real addresses.
+	Filter []string
+	// Size is the number of domains which are remembered, default to 65536.
+	Size int
+
+	mu    sync.Mutex
+	pool4 fakeIPPool
+	pool6 fakeIPPool
+}
+
+// fakeIPPool maps domains to addresses of a prefix, the least recently used address is recycled if the pool is full.
+type fakeIPPool struct {
+	names map[string]*list.Element
+	addrs map[netip.Addr]*list.Element
+	lru   list.List // of *fakeIPEntry, the most recently used one is at front
+	next  uint64
+}
+
+type fakeIPEntry struct {
+	ip     netip.Addr
+	domain string
+}
+
+// Match reports whether domain should be answered by fake addresses.
+func (f *FakeIP) Match(domain string) bool {
+	if f == nil {
+		return false
+	}
+	return !(&ResolverRule{Domains: f.Filter}).Match(domain, nil)
+}
+
+// Allocate returns the fake address of domain in network ip4 or ip6, the address is stable while the domain is remembered.
+func (f *FakeIP) Allocate(network, domain string) (netip.Addr, bool) {
+	prefix, pool := f.Prefix4, &f.pool4
+	if network == "ip6" {
+		prefix, pool = f.Prefix6, &f.pool6
+	}
+	if !prefix.IsValid() {
+		return netip.Addr{}, false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if pool.names == nil {
+		pool.names = make(map[string]*list.Element)
+		pool.addrs = make(map[netip.Addr]*list.Element)
+	}
+
+	if e, ok := pool.names[domain]; ok {
+		pool.lru.MoveToFront(e)
+		return e.Value.(*fakeIPEntry).ip, true
+	}
+
+	size := f.Size
+	if size == 0 {
+		size = 65536
+	}
+
+	var e *list.Element
+	if pool.lru.Len() < min(size, fakeIPPoolSize(prefix)-1) {
+		// the network address is skipped
+		pool.next++
+		e = pool.lru.PushFront(&fakeIPEntry{ip: fakeIPAdd(prefix.Masked().Addr(), pool.next)})
+		pool.addrs[e.Value.(*fakeIPEntry).ip] = e
+	} else {
+		e = pool.lru.Back()
+		delete(pool.names, e.Value.(*fakeIPEntry).domain)
+		pool.lru.MoveToFront(e)
+	}
+
+	entry := e.Value.(*fakeIPEntry)
+	entry.domain = domain
+	pool.names[domain] = e
+
+	return entry.ip, true
+}
+
+// Contains reports whether ip is in the fake prefixes.
+func (f *FakeIP) Contains(ip netip.Addr) bool {
+	if f == nil {
+		return false
+	}
+	ip = ip.Unmap()
+	return f.Prefix4.IsValid() && f.Prefix4.Contains(ip) || f.Prefix6.IsValid() && f.Prefix6.Contains(ip)
+}
+
+// Resolve returns the domain of host if it is a fake address, otherwise host is returned.
+func (f *FakeIP) Resolve(host string) (string, error) {
+	if f == nil {
+		return host, nil
+	}
+
+	ip, err := netip.ParseAddr(host)
+	if err != nil || !f.Contains(ip) {
+		return host, nil
+	}
+
+	ip = ip.Unmap()
+	pool := &f.pool4
+	if !ip.Is4() {
+		pool = &f.pool6
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if e, ok := pool.addrs[ip]; ok {
+		pool.lru.MoveToFront(e)
+		return e.Value.(*fakeIPEntry).domain, nil
+	}
+
+	return "", errors.New("fakeip: unknown fake address " + host)
+}
+
+func fakeIPPoolSize(prefix netip.Prefix) int {
+	return 1 << min(prefix.Addr().BitLen()-prefix.Bits(), 24)
+}
+
+func fakeIPAdd(ip netip.Addr, n uint64) netip.Addr {
+	b := ip.As16()
+	binary.BigEndian.PutUint64(b[8:], binary.BigEndian.Uint64(b[8:])+n)
+	if ip.Is4() {
+		return netip.AddrFrom16(b).Unmap()
+	}
+	return netip.AddrFrom16(b)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/netip"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+// systemHosts is the hosts file which net.Resolver consults before dns lookups.
+var systemHosts = func() *FileLoader[ResolverHosts] {
+	filename := "/etc/hosts"
+	if runtime.GOOS == "windows" {
+		filename = filepath.Join(os.Getenv("SystemRoot"), "System32", "drivers", "etc", "hosts")
+	}
+	return &FileLoader[ResolverHosts]{
+		Filename:     filename,
+		Unmarshal:    ParseHostsFile,
+		PollDuration: 15 * time.Second,
+	}
+}()
+
+// ResolverHosts is a static mapping of hostnames to addresses, a name may be a wildcard, e.g. *.svc.example.org
+type ResolverHosts struct {
+	names     map[string][]netip.Addr
+	wildcards []string
+}
+
+func (h *ResolverHosts) Add(name string, ips ...netip.Addr) {
+	if h.names == nil {
+		h.names = make(map[string][]netip.Addr)
+	}
+
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if _, ok := h.names[name]; !ok && strings.ContainsAny(name, "*?[") {
+		h.wildcards = append(h.wildcards, name)
+		// the longest pattern is matched first
+		slices.SortStableFunc(h.wildcards, func(a, b string) int { return len(b) - len(a) })
+	}
+
+	h.names[name] = append(h.names[name], ips...)
+}
+
+// Lookup returns the addresses of host, and whether host is in the mapping.
+func (h *ResolverHosts) Lookup(host string) ([]netip.Addr, bool) {
+	if h == nil || len(h.names) == 0 {
+		return nil, false
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ips, ok := h.names[host]; ok {
+		return ips, true
+	}
+
+	for _, pattern := range h.wildcards {
+		if ok, _ := path.Match(pattern, host); ok {
+			return h.names[pattern], true
+		}
+	}
+
+	return nil, false
+}
+
+// ParseHostsFile parses data of hosts file format into v, which must be a *ResolverHosts. It is the Unmarshal of FileLoader.
+func ParseHostsFile(data []byte, v any) error {
+	h, ok := v.(*ResolverHosts)
+	if !ok {
+		return errors.New("hosts: invalid type of value")
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		ip, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+
+		for _, name := range fields[1:] {
+			h.Add(name, ip)
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"errors"
+	"expvar"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/phuslu/log"
+)
+
+// poisonedIPsTxt is the default source of PoisonedIPs.
+//
+//go:embed poisoned_ips.txt
+var poisonedIPsTxt []byte
+
+// PoisonedIPs is a set of addresses which are known in poisoned dns answers, e.g. the answers of GFW.
+type PoisonedIPs struct {
+	// Source is a file or an url of ips and cidrs, one per line. The embedded poisoned_ips.txt is used if it is empty.
+	Source string
+
+	file *FileLoader[poisonedIPSet]
+	set  atomic.Pointer[poisonedIPSet]
+}
+
+type poisonedIPSet struct {
+	addrs    map[netip.Addr]struct{}
+	prefixes []netip.Prefix
+}
+
+// poisonedExpvar is published as expvar dns_poisoned, see /debug/vars
+var poisonedExpvar = expvar.NewMap("dns_poisoned")
+
+func (p *PoisonedIPs) Load() error {
+	switch {
+	case p.Source == "":
+		set, err := parsePoisonedIPs(poisonedIPsTxt)
+		if err != nil {
+			return err
+		}
+		p.set.Store(set)
+	case strings.HasPrefix(p.Source, "http://") || strings.HasPrefix(p.Source, "https://"):
+		if err := p.fetch(); err != nil {
+			return err
+		}
+		go func() {
+			for range time.Tick(12 * time.Hour) {
+				if err := p.fetch(); err != nil {
+					log.Error().Err(err).Str("dns_poisoned_ips", p.Source).Msg("reload dns_poisoned_ips error")
+				}
+			}
+		}()
+	default:
+		// the file is reloaded on change
+		p.file = &FileLoader[poisonedIPSet]{
+			Filename:     p.Source,
+			Unmarshal:    unmarshalPoisonedIPs,
+			PollDuration: time.Minute,
+			ErrorLogger:  log.DefaultLogger.Std("", 0),
+		}
+		if p.file.Load() == nil {
+			return errors.New("poisoned: load " + p.Source + " error")
+		}
+	}
+
+	poisonedExpvar.Set("size", expvar.Func(func() any {
+		if set := p.load(); set != nil {
+			return len(set.addrs) + len(set.prefixes)
+		}
+		return 0
+	}))
+
+	return nil
+}
+
+func (p *PoisonedIPs) fetch() error {
+	data, err := ReadFile(p.Source)
+	if err != nil {
+		return err
+	}
+
+	set, err := parsePoisonedIPs(data)
+	if err != nil {
+		return err
+	}
+
+	p.set.Store(set)
+
+	return nil
+}
+
+func (p *PoisonedIPs) load() *poisonedIPSet {
+	if p.file != nil {
+		return p.file.Load()
+	}
+	return p.set.Load()
+}
+
+// unmarshalPoisonedIPs is the Unmarshal of FileLoader[poisonedIPSet].
+func unmarshalPoisonedIPs(data []byte, v any) error {
+	set, err := parsePoisonedIPs(data)
+	if err != nil {
+		return err
+	}
+	*v.(*poisonedIPSet) = *set
+	return nil
+}
+
+// parsePoisonedIPs parses ips and cidrs of data, blank lines and # comments are ignored.
+func parsePoisonedIPs(data []byte) (*poisonedIPSet, error) {
+	set := &poisonedIPSet{addrs: make(map[netip.Addr]struct{})}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		if !strings.Contains(line, "/") {
+			ip, err := netip.ParseAddr(line)
+			if err != nil {
+				return nil, err
+			}
+			set.addrs[ip.Unmap()] = struct{}{}
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(line)
+		if err != nil {
+			return nil, err
+		}
+		if prefix.IsSingleIP() {
+			set.addrs[prefix.Addr().Unmap()] = struct{}{}
+		} else {
+			set.prefixes = append(set.prefixes, prefix.Masked())
+		}
+	}
+
+	return set, scanner.Err()
+}
+
+// Contains reports whether ip is poisoned.
+func (p *PoisonedIPs) Contains(ip netip.Addr) bool {
+	if p == nil {
+		return false
+	}
+
+	set := p.load()
+	if set == nil {
+		return false
+	}
+
+	ip = ip.Unmap()
+	if _, ok := set.addrs[ip]; ok {
+		return true
+	}
+
+	return slices.ContainsFunc(set.prefixes, func(prefix netip.Prefix) bool { return prefix.Contains(ip) })
+}
+
+// Filter returns the ips which are not poisoned, and whether any ip is poisoned.
+func (p *PoisonedIPs) Filter(ips []netip.Addr) ([]netip.Addr, bool) {
+	if !slices.ContainsFunc(ips, p.Contains) {
+		return ips, false
+	}
+
+	var clean []netip.Addr
+	for _, ip := range ips {
+		if !p.Contains(ip) {
+			clean = append(clean, ip)
+		}
+	}
+
+	return clean, true
+}
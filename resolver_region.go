@@ -4,45 +4,80 @@ import (
 	"context"
 	"errors"
 	"net"
+	"net/netip"
 
 	"github.com/oschwald/maxminddb-golang"
 )
 
 type RegionResolver struct {
-	Resolver      *Resolver
-	MaxmindReader *maxminddb.Reader
+	Resolver *Resolver
+	// CityReader, ASNReader and ISPReader are maxmind databases by type, they are reloaded on file change.
+	CityReader *FileLoader[maxminddb.Reader]
+	ASNReader  *FileLoader[maxminddb.Reader]
+	ISPReader  *FileLoader[maxminddb.Reader]
 }
 
-func (r *RegionResolver) LookupCity(ctx context.Context, ip net.IP) (string, string, string, error) {
-	if r.MaxmindReader == nil {
-		return "", "", "", errors.New("no maxmind database found")
+// UnmarshalMaxmindDB is the Unmarshal of FileLoader[maxminddb.Reader].
+func UnmarshalMaxmindDB(data []byte, v any) error {
+	db, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return err
 	}
+	*v.(*maxminddb.Reader) = *db
+	return nil
+}
 
-	if ip == nil {
-		return "", "", "", errors.New("invalid ip address")
+func loadMaxmindDB(loader *FileLoader[maxminddb.Reader]) (*maxminddb.Reader, error) {
+	if loader == nil {
+		return nil, errors.New("no maxmind database found")
 	}
+	db := loader.Load()
+	if db == nil {
+		return nil, errors.New("no maxmind database loaded: " + loader.Filename)
+	}
+	return db, nil
+}
 
-	var record struct {
-		Country struct {
-			GeoNameID uint   `maxminddb:"geoname_id"`
-			ISOCode   string `maxminddb:"iso_code"`
-		} `maxminddb:"country"`
-		City struct {
-			GeoNameID uint `maxminddb:"geoname_id"`
-			Names     struct {
-				EN string `maxminddb:"en"`
-			} `maxminddb:"names"`
-		} `maxminddb:"city"`
-		Subdivisions []struct {
-			GeoNameID uint   `maxminddb:"geoname_id"`
-			IsoCode   string `maxminddb:"iso_code"`
-			Names     struct {
-				EN string `maxminddb:"en"`
-			} `maxminddb:"names"`
-		} `maxminddb:"subdivisions"`
+type regionCityRecord struct {
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+	Country struct {
+		GeoNameID uint   `maxminddb:"geoname_id"`
+		ISOCode   string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		GeoNameID uint `maxminddb:"geoname_id"`
+		Names     struct {
+			EN string `maxminddb:"en"`
+		} `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Subdivisions []struct {
+		GeoNameID uint   `maxminddb:"geoname_id"`
+		IsoCode   string `maxminddb:"iso_code"`
+		Names     struct {
+			EN string `maxminddb:"en"`
+		} `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+}
+
+func (r *RegionResolver) lookupCity(ip net.IP) (record regionCityRecord, err error) {
+	db, err := loadMaxmindDB(r.CityReader)
+	if err != nil {
+		return
+	}
+
+	if ip == nil {
+		err = errors.New("invalid ip address")
+		return
 	}
 
-	err := r.MaxmindReader.Lookup(ip, &record)
+	err = db.Lookup(ip, &record)
+	return
+}
+
+func (r *RegionResolver) LookupCity(ctx context.Context, ip net.IP) (string, string, string, error) {
+	record, err := r.lookupCity(ip)
 
 	var region string
 	if len(record.Subdivisions) != 0 {
@@ -52,167 +87,74 @@ func (r *RegionResolver) LookupCity(ctx context.Context, ip net.IP) (string, str
 	return record.Country.ISOCode, region, record.City.Names.EN, err
 }
 
-func IsBogusChinaIP(ip net.IP) (ok bool) {
-	ip4 := ip.To4()
-	if ip4 == nil {
-		return false
+// LookupContinent returns the continent code of ip, e.g. AS, EU and NA.
+func (r *RegionResolver) LookupContinent(ctx context.Context, ip net.IP) (string, error) {
+	record, err := r.lookupCity(ip)
+	return record.Continent.Code, err
+}
+
+// LookupASN returns the autonomous system number and organization of ip, by the ASN database or the ISP database.
+func (r *RegionResolver) LookupASN(ctx context.Context, ip net.IP) (uint, string, error) {
+	if ip == nil {
+		return 0, "", errors.New("invalid ip address")
+	}
+
+	var record struct {
+		Number       uint   `maxminddb:"autonomous_system_number"`
+		Organization string `maxminddb:"autonomous_system_organization"`
+	}
+
+	db, err := loadMaxmindDB(r.ASNReader)
+	if err != nil {
+		if db, err = loadMaxmindDB(r.ISPReader); err != nil {
+			return 0, "", err
+		}
+	}
+
+	err = db.Lookup(ip, &record)
+
+	return record.Number, record.Organization, err
+}
+
+// LookupISP returns the isp name of ip by the ISP database, the organization of ASN database is the fallback.
+func (r *RegionResolver) LookupISP(ctx context.Context, ip net.IP) (string, error) {
+	if ip == nil {
+		return "", errors.New("invalid ip address")
 	}
 
-	n := ((uint(ip4[0])<<8+uint(ip4[1]))<<8+uint(ip4[2]))<<8 + uint(ip4[3])
+	db, err := loadMaxmindDB(r.ISPReader)
+	if err != nil {
+		_, org, err := r.LookupASN(ctx, ip)
+		return org, err
+	}
 
-	_, ok = bogusChinaIP[n]
-	return
+	var record struct {
+		ISP string `maxminddb:"isp"`
+	}
+
+	err = db.Lookup(ip, &record)
+
+	return record.ISP, err
 }
 
-var bogusChinaIP = map[uint]bool{
-	((10<<8+10)<<8+10)<<8 + 10:     true,
-	((101<<8+226)<<8+10)<<8 + 8:    true,
-	((104<<8+239)<<8+213)<<8 + 7:   true,
-	((110<<8+249)<<8+209)<<8 + 42:  true,
-	((111<<8+11)<<8+208)<<8 + 2:    true,
-	((111<<8+175)<<8+221)<<8 + 58:  true,
-	((112<<8+132)<<8+230)<<8 + 179: true,
-	((113<<8+11)<<8+194)<<8 + 190:  true,
-	((113<<8+12)<<8+83)<<8 + 4:     true,
-	((113<<8+12)<<8+83)<<8 + 5:     true,
-	((114<<8+112)<<8+163)<<8 + 232: true,
-	((114<<8+112)<<8+163)<<8 + 254: true,
-	((120<<8+192)<<8+83)<<8 + 163:  true,
-	((120<<8+209)<<8+138)<<8 + 64:  true,
-	((123<<8+125)<<8+81)<<8 + 12:   true,
-	((123<<8+126)<<8+249)<<8 + 238: true,
-	((123<<8+129)<<8+254)<<8 + 11:  true,
-	((123<<8+129)<<8+254)<<8 + 12:  true,
-	((123<<8+129)<<8+254)<<8 + 13:  true,
-	((123<<8+129)<<8+254)<<8 + 14:  true,
-	((123<<8+129)<<8+254)<<8 + 15:  true,
-	((123<<8+129)<<8+254)<<8 + 16:  true,
-	((123<<8+129)<<8+254)<<8 + 17:  true,
-	((123<<8+129)<<8+254)<<8 + 18:  true,
-	((123<<8+129)<<8+254)<<8 + 19:  true,
-	((124<<8+232)<<8+132)<<8 + 94:  true,
-	((125<<8+211)<<8+213)<<8 + 130: true,
-	((125<<8+211)<<8+213)<<8 + 131: true,
-	((125<<8+211)<<8+213)<<8 + 132: true,
-	((125<<8+211)<<8+213)<<8 + 133: true,
-	((125<<8+211)<<8+213)<<8 + 134: true,
-	((125<<8+76)<<8+239)<<8 + 244:  true,
-	((125<<8+76)<<8+239)<<8 + 245:  true,
-	((127<<8+0)<<8+0)<<8 + 2:       true,
-	((180<<8+153)<<8+103)<<8 + 224: true,
-	((180<<8+168)<<8+41)<<8 + 175:  true,
-	((183<<8+207)<<8+232)<<8 + 253: true,
-	((183<<8+221)<<8+242)<<8 + 172: true,
-	((183<<8+221)<<8+250)<<8 + 11:  true,
-	((183<<8+224)<<8+40)<<8 + 24:   true,
-	((198<<8+105)<<8+254)<<8 + 11:  true,
-	((202<<8+100)<<8+220)<<8 + 54:  true,
-	((202<<8+100)<<8+68)<<8 + 117:  true,
-	((202<<8+102)<<8+110)<<8 + 203: true,
-	((202<<8+102)<<8+110)<<8 + 204: true,
-	((202<<8+102)<<8+110)<<8 + 205: true,
-	((202<<8+106)<<8+1)<<8 + 2:     true,
-	((202<<8+106)<<8+199)<<8 + 34:  true,
-	((202<<8+106)<<8+199)<<8 + 35:  true,
-	((202<<8+106)<<8+199)<<8 + 36:  true,
-	((202<<8+106)<<8+199)<<8 + 37:  true,
-	((202<<8+106)<<8+199)<<8 + 38:  true,
-	((202<<8+98)<<8+24)<<8 + 121:   true,
-	((202<<8+98)<<8+24)<<8 + 122:   true,
-	((202<<8+98)<<8+24)<<8 + 123:   true,
-	((202<<8+98)<<8+24)<<8 + 124:   true,
-	((202<<8+98)<<8+24)<<8 + 125:   true,
-	((202<<8+99)<<8+254)<<8 + 230:  true,
-	((202<<8+99)<<8+254)<<8 + 231:  true,
-	((202<<8+99)<<8+254)<<8 + 232:  true,
-	((211<<8+136)<<8+113)<<8 + 1:   true,
-	((211<<8+137)<<8+130)<<8 + 101: true,
-	((211<<8+138)<<8+102)<<8 + 198: true,
-	((211<<8+138)<<8+34)<<8 + 204:  true,
-	((211<<8+138)<<8+74)<<8 + 132:  true,
-	((211<<8+139)<<8+136)<<8 + 73:  true,
-	((211<<8+94)<<8+66)<<8 + 147:   true,
-	((211<<8+98)<<8+70)<<8 + 195:   true,
-	((211<<8+98)<<8+70)<<8 + 226:   true,
-	((211<<8+98)<<8+70)<<8 + 227:   true,
-	((211<<8+98)<<8+71)<<8 + 195:   true,
-	((218<<8+28)<<8+144)<<8 + 36:   true,
-	((218<<8+28)<<8+144)<<8 + 37:   true,
-	((218<<8+28)<<8+144)<<8 + 38:   true,
-	((218<<8+28)<<8+144)<<8 + 39:   true,
-	((218<<8+28)<<8+144)<<8 + 40:   true,
-	((218<<8+28)<<8+144)<<8 + 41:   true,
-	((218<<8+28)<<8+144)<<8 + 42:   true,
-	((218<<8+30)<<8+64)<<8 + 194:   true,
-	((218<<8+68)<<8+250)<<8 + 117:  true,
-	((218<<8+68)<<8+250)<<8 + 118:  true,
-	((218<<8+68)<<8+250)<<8 + 119:  true,
-	((218<<8+68)<<8+250)<<8 + 120:  true,
-	((218<<8+68)<<8+250)<<8 + 121:  true,
-	((218<<8+93)<<8+250)<<8 + 18:   true,
-	((219<<8+146)<<8+13)<<8 + 36:   true,
-	((220<<8+165)<<8+8)<<8 + 172:   true,
-	((220<<8+165)<<8+8)<<8 + 174:   true,
-	((220<<8+250)<<8+64)<<8 + 18:   true,
-	((220<<8+250)<<8+64)<<8 + 19:   true,
-	((220<<8+250)<<8+64)<<8 + 20:   true,
-	((220<<8+250)<<8+64)<<8 + 21:   true,
-	((220<<8+250)<<8+64)<<8 + 22:   true,
-	((220<<8+250)<<8+64)<<8 + 225:  true,
-	((220<<8+250)<<8+64)<<8 + 226:  true,
-	((220<<8+250)<<8+64)<<8 + 227:  true,
-	((220<<8+250)<<8+64)<<8 + 228:  true,
-	((220<<8+250)<<8+64)<<8 + 23:   true,
-	((220<<8+250)<<8+64)<<8 + 24:   true,
-	((220<<8+250)<<8+64)<<8 + 25:   true,
-	((220<<8+250)<<8+64)<<8 + 26:   true,
-	((220<<8+250)<<8+64)<<8 + 27:   true,
-	((220<<8+250)<<8+64)<<8 + 28:   true,
-	((220<<8+250)<<8+64)<<8 + 29:   true,
-	((220<<8+250)<<8+64)<<8 + 30:   true,
-	((221<<8+179)<<8+46)<<8 + 190:  true,
-	((221<<8+179)<<8+46)<<8 + 194:  true,
-	((221<<8+192)<<8+153)<<8 + 41:  true,
-	((221<<8+192)<<8+153)<<8 + 42:  true,
-	((221<<8+192)<<8+153)<<8 + 43:  true,
-	((221<<8+192)<<8+153)<<8 + 44:  true,
-	((221<<8+192)<<8+153)<<8 + 45:  true,
-	((221<<8+192)<<8+153)<<8 + 46:  true,
-	((221<<8+192)<<8+153)<<8 + 49:  true,
-	((221<<8+204)<<8+244)<<8 + 36:  true,
-	((221<<8+204)<<8+244)<<8 + 37:  true,
-	((221<<8+204)<<8+244)<<8 + 38:  true,
-	((221<<8+204)<<8+244)<<8 + 39:  true,
-	((221<<8+204)<<8+244)<<8 + 40:  true,
-	((221<<8+204)<<8+244)<<8 + 41:  true,
-	((221<<8+8)<<8+69)<<8 + 27:     true,
-	((222<<8+221)<<8+5)<<8 + 204:   true,
-	((222<<8+221)<<8+5)<<8 + 252:   true,
-	((222<<8+221)<<8+5)<<8 + 253:   true,
-	((223<<8+82)<<8+248)<<8 + 117:  true,
-	((243<<8+185)<<8+187)<<8 + 3:   true,
-	((243<<8+185)<<8+187)<<8 + 30:  true,
-	((243<<8+185)<<8+187)<<8 + 39:  true,
-	((249<<8+129)<<8+46)<<8 + 48:   true,
-	((253<<8+157)<<8+14)<<8 + 165:  true,
-	((255<<8+255)<<8+255)<<8 + 255: true,
-	((42<<8+123)<<8+125)<<8 + 237:  true,
-	((60<<8+19)<<8+29)<<8 + 21:     true,
-	((60<<8+19)<<8+29)<<8 + 22:     true,
-	((60<<8+19)<<8+29)<<8 + 23:     true,
-	((60<<8+19)<<8+29)<<8 + 24:     true,
-	((60<<8+19)<<8+29)<<8 + 25:     true,
-	((60<<8+19)<<8+29)<<8 + 26:     true,
-	((60<<8+19)<<8+29)<<8 + 27:     true,
-	((60<<8+191)<<8+124)<<8 + 236:  true,
-	((60<<8+191)<<8+124)<<8 + 252:  true,
-	((61<<8+131)<<8+208)<<8 + 210:  true,
-	((61<<8+131)<<8+208)<<8 + 211:  true,
-	((61<<8+139)<<8+8)<<8 + 101:    true,
-	((61<<8+139)<<8+8)<<8 + 102:    true,
-	((61<<8+139)<<8+8)<<8 + 103:    true,
-	((61<<8+139)<<8+8)<<8 + 104:    true,
-	((61<<8+183)<<8+1)<<8 + 186:    true,
-	((61<<8+191)<<8+206)<<8 + 4:    true,
-	((61<<8+54)<<8+28)<<8 + 6:      true,
+// IPType returns the type of ip address, e.g. loopback, private, linklocal, multicast, unspecified, cgnat and public.
+func IPType(ip netip.Addr) string {
+	ip = ip.Unmap()
+	switch {
+	case !ip.IsValid():
+		return ""
+	case ip.IsLoopback():
+		return "loopback"
+	case ip.IsPrivate():
+		return "private"
+	case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast():
+		return "linklocal"
+	case ip.IsMulticast():
+		return "multicast"
+	case ip.IsUnspecified():
+		return "unspecified"
+	case netip.MustParsePrefix("100.64.0.0/10").Contains(ip):
+		return "cgnat"
+	}
+	return "public"
 }
@@ -2,8 +2,24 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/phuslu/geosite"
+	"github.com/phuslu/lru"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 func TestDoHResolver(t *testing.T) {
@@ -31,3 +47,478 @@ func TestDoHResolver(t *testing.T) {
 		}
 	}
 }
+
+func TestDnsPadding(t *testing.T) {
+	for _, host := range []string{"a.org.", "www.example.org.", "a-long-label-of-a-domain-name.which-is-used-by-padding-test.example.org."} {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1, RecursionDesired: true})
+		b.StartQuestions()
+		b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(host), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+		query, _ := b.Finish()
+
+		msg := dnsPadding(query)
+		if len(msg)%128 != 0 {
+			t.Errorf("dnsPadding(%#v) must return a multiple of 128 bytes, not %d", host, len(msg))
+		}
+		if msg = dnsPadding(msg); len(msg)%128 != 0 {
+			t.Errorf("dnsPadding(dnsPadding(%#v)) must return a multiple of 128 bytes, not %d", host, len(msg))
+		}
+
+		var m dnsmessage.Message
+		if err := m.Unpack(msg); err != nil || m.Header.ID != 1 || len(m.Questions) != 1 || len(m.Additionals) != 1 {
+			t.Errorf("dnsPadding(%#v) must return a valid query, not %+v err=%+v", host, m, err)
+		}
+	}
+}
+
+func TestDoHResolverDialerGET(t *testing.T) {
+	var requests []string
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var query []byte
+		if req.Method == http.MethodGet {
+			query, _ = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+		} else {
+			query, _ = io.ReadAll(req.Body)
+		}
+		var m dnsmessage.Message
+		if err := m.Unpack(query); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		requests = append(requests, fmt.Sprintf("%s %s %d", req.Method, req.URL.Path, m.Header.ID))
+		mu.Unlock()
+		m.Header.Response = true
+		resp, _ := m.Pack()
+		rw.Header().Set("content-type", "application/dns-message")
+		rw.Write(resp)
+	}))
+	defer srv.Close()
+
+	d := &DoHResolverDialer{
+		EndPoint:  srv.URL + "/get",
+		UseGET:    true,
+		Upstreams: []*DoHResolverDialer{{EndPoint: srv.URL + "/post"}},
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 0x1234, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName("example.org."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	query, _ := b.Finish()
+
+	// endpoints are queried in round robin
+	for range 2 {
+		resp, err := d.Exchange(context.Background(), query)
+		if err != nil || binary.BigEndian.Uint16(resp) != 0x1234 {
+			t.Fatalf("DoHResolverDialer.Exchange must return the id of query, not %x err=%+v", resp, err)
+		}
+	}
+
+	if s := fmt.Sprint(requests); s != "[GET /get 0 POST /post 4660]" {
+		t.Errorf("DoHResolverDialer must send GET with id 0 and POST with the id of query, not %s", s)
+	}
+}
+
+func TestDoHResolverDialerInsecure(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		query, _ := io.ReadAll(req.Body)
+		var m dnsmessage.Message
+		if err := m.Unpack(query); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.Header.Response = true
+		resp, _ := m.Pack()
+		rw.Header().Set("content-type", "application/dns-message")
+		rw.Write(resp)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 0x1234, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName("example.org."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	query, _ := b.Finish()
+
+	// the certificate of test server is self-signed
+	for _, c := range []struct {
+		Server  string
+		Success bool
+	}{
+		{srv.URL + "/dns-query?insecure=1", true},
+		{"h2" + strings.TrimPrefix(srv.URL, "https") + "/dns-query?insecure=1", true},
+		{srv.URL + "/dns-query", false},
+	} {
+		u, _ := url.Parse(c.Server)
+		_, err := newDoHResolverDialer(u).Exchange(context.Background(), query)
+		if (err == nil) != c.Success {
+			t.Errorf("DoHResolverDialer(%#v).Exchange must return success=%v, err=%+v", c.Server, c.Success, err)
+		}
+	}
+}
+
+func TestResolverRuleMatch(t *testing.T) {
+	rule := &ResolverRule{
+		Domains: []string{"example.org"},
+		Geosite: []string{"cn", "apple@cn"},
+	}
+
+	f := &Functions{
+		GeoSite:      &geosite.DomainListCommunity{},
+		GeoSiteCache: lru.NewTTLCache[string, *string](128),
+	}
+	if err := f.loadGeoSiteData(context.Background(), []byte(geosite.InlineTarball)); err != nil {
+		t.Fatalf("Functions.loadGeoSiteData(geosite.InlineTarball) error: %+v", err)
+	}
+
+	cases := []struct {
+		Host  string
+		Match bool
+	}{
+		{"www.gov.cn", true},
+		{"example.org", true},
+		{"www.example.org", true},
+		{"badexample.org", false},
+		{"baidu.com", true},
+		{"www.qq.com", true},
+		{"www.apple.com", true},
+		{"apple.com", false},
+		{"google.com", false},
+	}
+
+	for _, c := range cases {
+		if match := rule.Match(c.Host, f.geosite); match != c.Match {
+			t.Errorf("ResolverRule.Match(%#v) must return %v, not %v", c.Host, c.Match, match)
+		}
+	}
+}
+
+// fakeDNSDial returns a dial function of net.Resolver, which answers queries over pipes by answer.
+func fakeDNSDial(answer func(q dnsmessage.Question) (dnsmessage.RCode, []dnsmessage.Resource), queries *atomic.Int32) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+
+			var b [2]byte
+			if _, err := io.ReadFull(server, b[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(b[:]))
+			if _, err := io.ReadFull(server, query); err != nil {
+				return
+			}
+			queries.Add(1)
+
+			var msg dnsmessage.Message
+			if err := msg.Unpack(query); err != nil {
+				return
+			}
+			msg.Header.Response = true
+			msg.Header.RCode, msg.Answers = answer(msg.Questions[0])
+			msg.Additionals = nil
+
+			resp, _ := msg.Pack()
+			server.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+		}()
+		return client, nil
+	}
+}
+
+func TestResolverCache(t *testing.T) {
+	answer := func(q dnsmessage.Question) (dnsmessage.RCode, []dnsmessage.Resource) {
+		if q.Name.String() != "a.example.org." {
+			return dnsmessage.RCodeNameError, nil
+		}
+		switch q.Type {
+		case dnsmessage.TypeA:
+			return dnsmessage.RCodeSuccess, []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 1},
+				Body:   &dnsmessage.AResource{A: [4]byte{1, 2, 3, 4}},
+			}}
+		case dnsmessage.TypeAAAA:
+			return dnsmessage.RCodeSuccess, []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 7200},
+				Body:   &dnsmessage.AAAAResource{AAAA: netip.MustParseAddr("fd00::1").As16()},
+			}}
+		}
+		return dnsmessage.RCodeSuccess, nil
+	}
+
+	var queries atomic.Int32
+	r := &Resolver{
+		Resolver:    &net.Resolver{PreferGo: true, Dial: fakeDNSDial(answer, &queries)},
+		LRUCache:    lru.NewTTLCache[string, *ResolverCacheEntry](128),
+		MinTTL:      10 * time.Second,
+		MaxTTL:      time.Hour,
+		NegativeTTL: time.Minute,
+		StaleTTL:    time.Hour,
+	}
+
+	var elapsed atomic.Int64
+	start := time.Now()
+	timeNow = func() time.Time { return start.Add(time.Duration(elapsed.Load())) }
+	defer func() { timeNow = time.Now }()
+
+	cases := []struct {
+		Elapsed time.Duration
+		Network string
+		Host    string
+		IPs     string
+		TTL     time.Duration
+		Err     bool
+		Queries int32
+	}{
+		// the ttl of record is clamped to MinTTL
+		{0, "ip4", "a.example.org", "[1.2.3.4]", 10 * time.Second, false, 1},
+		{5 * time.Second, "ip4", "a.example.org", "[1.2.3.4]", 5 * time.Second, false, 1},
+		// records of networks are cached separately, and the ttl is clamped to MaxTTL
+		{5 * time.Second, "ip6", "a.example.org", "[fd00::1]", time.Hour, false, 2},
+		{5 * time.Second, "ip", "a.example.org", "[1.2.3.4 fd00::1]", 10 * time.Second, false, 4},
+		// nonexistent domains are cached for NegativeTTL
+		{5 * time.Second, "ip4", "nx.example.org", "[]", 0, true, 5},
+		{6 * time.Second, "ip4", "nx.example.org", "[]", 59 * time.Second, true, 5},
+		// expired records are served and refreshed in background
+		{20 * time.Second, "ip4", "a.example.org", "[1.2.3.4]", 30 * time.Second, false, 6},
+		{20 * time.Second, "ip4", "a.example.org", "[1.2.3.4]", 10 * time.Second, false, 6},
+	}
+
+	for _, c := range cases {
+		elapsed.Store(int64(c.Elapsed))
+		ips, ttl, err := r.LookupNetIPWithTTL(context.Background(), c.Network, c.Host)
+		if (err != nil) != c.Err || fmt.Sprint(ips) != c.IPs || ttl != c.TTL {
+			t.Errorf("LookupNetIPWithTTL(%#v, %#v) at %v must return %v %v %v, not %v %v %+v", c.Network, c.Host, c.Elapsed, c.IPs, c.TTL, c.Err, ips, ttl, err)
+		}
+		// wait for the refreshing in background
+		fresh := func() bool {
+			key := c.Network + ":" + c.Host
+			if c.Network == "ip" {
+				key = c.Host
+			}
+			e, _ := r.LRUCache.Get(key)
+			return e != nil && e.Expires.After(timeNow())
+		}
+		for i := 0; i < 100 && (queries.Load() < c.Queries || !fresh()); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := queries.Load(); n != c.Queries {
+			t.Errorf("LookupNetIPWithTTL(%#v, %#v) at %v must send %d queries in total, not %d", c.Network, c.Host, c.Elapsed, c.Queries, n)
+		}
+	}
+}
+
+func TestResolverHosts(t *testing.T) {
+	data := []byte(`
+# static hosts
+10.0.0.1    db.example.org   db
+10.0.0.2    db.example.org
+fd00::1     *.svc.example.org # wildcard
+10.1.0.1    *.example.org
+bad-ip      foo.example.org
+`)
+
+	var hosts ResolverHosts
+	if err := ParseHostsFile(data, &hosts); err != nil {
+		t.Fatalf("ParseHostsFile error: %+v", err)
+	}
+
+	r := &Resolver{Hosts: &hosts}
+
+	cases := []struct {
+		Network string
+		Host    string
+		IPs     string
+		Found   bool
+	}{
+		{"ip", "db.example.org", "[10.0.0.1 10.0.0.2]", true},
+		{"ip", "DB.example.org.", "[10.0.0.1 10.0.0.2]", true},
+		{"ip", "db", "[10.0.0.1]", true},
+		{"ip", "a.svc.example.org", "[fd00::1]", true},
+		{"ip6", "a.svc.example.org", "[fd00::1]", true},
+		{"ip4", "a.svc.example.org", "[]", true},
+		{"ip", "foo.example.org", "[10.1.0.1]", true},
+		{"ip", "example.org", "[]", false},
+	}
+
+	for _, c := range cases {
+		ips, found := r.lookupHosts(c.Network, c.Host)
+		if found != c.Found || fmt.Sprint(ips) != c.IPs {
+			t.Errorf("lookupHosts(%#v, %#v) must return %v %v, not %v %v", c.Network, c.Host, c.IPs, c.Found, ips, found)
+		}
+	}
+}
+
+func TestFakeIP(t *testing.T) {
+	f := &FakeIP{
+		Prefix4: netip.MustParsePrefix("198.18.0.0/30"),
+		Prefix6: netip.MustParsePrefix("fc00::/120"),
+		Filter:  []string{"lan"},
+	}
+
+	if f.Match("nas.lan") || !f.Match("example.org") {
+		t.Errorf("FakeIP.Match must respect filter %v", f.Filter)
+	}
+
+	a, _ := f.Allocate("ip4", "a.example.org")
+	b, _ := f.Allocate("ip4", "b.example.org")
+	if a.String() != "198.18.0.1" || b.String() != "198.18.0.2" {
+		t.Errorf("FakeIP.Allocate must return sequential addresses, not %v %v", a, b)
+	}
+	if ip, _ := f.Allocate("ip4", "a.example.org"); ip != a {
+		t.Errorf("FakeIP.Allocate must return stable address %v, not %v", a, ip)
+	}
+	if ip, _ := f.Allocate("ip6", "a.example.org"); ip.String() != "fc00::1" {
+		t.Errorf("FakeIP.Allocate must return fc00::1, not %v", ip)
+	}
+
+	for host, name := range map[string]string{"198.18.0.2": "b.example.org", "fc00::1": "a.example.org", "1.1.1.1": "1.1.1.1", "example.org": "example.org"} {
+		if s, err := f.Resolve(host); err != nil || s != name {
+			t.Errorf("FakeIP.Resolve(%#v) must return %#v, not %#v %v", host, name, s, err)
+		}
+	}
+
+	// the pool of /30 has 3 addresses, the least recently used one is recycled
+	f.Allocate("ip4", "c.example.org")
+	f.Allocate("ip4", "a.example.org")
+	if ip, _ := f.Allocate("ip4", "d.example.org"); ip != b {
+		t.Errorf("FakeIP.Allocate must recycle %v, not %v", b, ip)
+	}
+	if s, _ := f.Resolve(b.String()); s != "d.example.org" {
+		t.Errorf("FakeIP.Resolve(%#v) must return d.example.org, not %#v", b.String(), s)
+	}
+	if ip, _ := f.Allocate("ip4", "a.example.org"); ip != a {
+		t.Errorf("FakeIP.Allocate must keep recently used address %v, not %v", a, ip)
+	}
+	if _, err := f.Resolve("198.18.0.0"); err == nil {
+		t.Errorf("FakeIP.Resolve must return error for unknown fake address")
+	}
+}
+
+func TestIPType(t *testing.T) {
+	cases := []struct {
+		IP   string
+		Type string
+	}{
+		{"127.0.0.1", "loopback"},
+		{"::1", "loopback"},
+		{"::ffff:127.0.0.1", "loopback"},
+		{"10.0.0.1", "private"},
+		{"172.16.0.1", "private"},
+		{"192.168.1.1", "private"},
+		{"fd00::1", "private"},
+		{"169.254.1.1", "linklocal"},
+		{"fe80::1", "linklocal"},
+		{"224.0.0.1", "linklocal"},
+		{"239.1.1.1", "multicast"},
+		{"ff0e::1", "multicast"},
+		{"0.0.0.0", "unspecified"},
+		{"::", "unspecified"},
+		{"100.64.0.1", "cgnat"},
+		{"100.127.255.255", "cgnat"},
+		{"100.128.0.1", "public"},
+		{"1.1.1.1", "public"},
+		{"2606:4700:4700::1111", "public"},
+	}
+
+	for _, c := range cases {
+		if typ := IPType(netip.MustParseAddr(c.IP)); typ != c.Type {
+			t.Errorf("IPType(%#v) must return %#v, not %#v", c.IP, c.Type, typ)
+		}
+	}
+
+	if typ := IPType(netip.Addr{}); typ != "" {
+		t.Errorf("IPType(netip.Addr{}) must return empty string, not %#v", typ)
+	}
+}
+
+func TestPoisonedIPs(t *testing.T) {
+	set, err := parsePoisonedIPs([]byte(`
+# poisoned addresses
+1.2.3.4
+::ffff:5.6.7.8 # mapped
+10.0.0.0/8
+192.0.2.1/32
+2001:db8::/32
+`))
+	if err != nil {
+		t.Fatalf("parsePoisonedIPs error: %+v", err)
+	}
+	if len(set.addrs) != 3 || len(set.prefixes) != 2 {
+		t.Errorf("parsePoisonedIPs must return 3 addrs and 2 prefixes, not %v %v", set.addrs, set.prefixes)
+	}
+
+	for _, data := range []string{"1.2.3", "10.0.0.0/33"} {
+		if _, err := parsePoisonedIPs([]byte(data)); err == nil {
+			t.Errorf("parsePoisonedIPs(%#v) must return error", data)
+		}
+	}
+
+	p := &PoisonedIPs{}
+	p.set.Store(set)
+
+	cases := []struct {
+		IPs      string
+		Clean    string
+		Poisoned bool
+	}{
+		{"[]", "[]", false},
+		{"[1.1.1.1 2606:4700::1111]", "[1.1.1.1 2606:4700::1111]", false},
+		{"[1.2.3.4]", "[]", true},
+		{"[5.6.7.8 1.1.1.1]", "[1.1.1.1]", true},
+		{"[::ffff:10.1.2.3 192.0.2.1 192.0.2.2]", "[192.0.2.2]", true},
+		{"[2001:db8::1 2606:4700::1111]", "[2606:4700::1111]", true},
+	}
+
+	for _, c := range cases {
+		var ips []netip.Addr
+		for _, s := range strings.Fields(strings.Trim(c.IPs, "[]")) {
+			ips = append(ips, netip.MustParseAddr(s))
+		}
+		clean, poisoned := p.Filter(ips)
+		if fmt.Sprint(clean) != c.Clean || poisoned != c.Poisoned {
+			t.Errorf("PoisonedIPs.Filter(%v) must return %v %v, not %v %v", c.IPs, c.Clean, c.Poisoned, clean, poisoned)
+		}
+	}
+
+	// the embedded poisoned_ips.txt is the default source
+	p = &PoisonedIPs{}
+	if err := p.Load(); err != nil || !p.Contains(netip.MustParseAddr("243.185.187.39")) {
+		t.Errorf("PoisonedIPs.Load must load the embedded poisoned_ips.txt, err=%+v", err)
+	}
+	for addr := range p.set.Load().addrs {
+		if addr.IsPrivate() || addr.IsLoopback() {
+			t.Errorf("embedded poisoned_ips.txt must not contain private or loopback address %v", addr)
+		}
+	}
+
+	// answers of trusted rules are not checked
+	answer := func(q dnsmessage.Question) (dnsmessage.RCode, []dnsmessage.Resource) {
+		if q.Type != dnsmessage.TypeA {
+			return dnsmessage.RCodeSuccess, nil
+		}
+		return dnsmessage.RCodeSuccess, []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+			Body:   &dnsmessage.AResource{A: [4]byte{10, 1, 2, 3}},
+		}}
+	}
+	var queries atomic.Int32
+	lan := &net.Resolver{PreferGo: true, Dial: fakeDNSDial(answer, &queries)}
+	r := &Resolver{
+		Resolver: lan,
+		Rules:    []ResolverRule{{Domains: []string{"corp.internal"}, Resolvers: []*net.Resolver{lan}, Trusted: true}},
+		Poisoned: &PoisonedIPs{},
+	}
+	r.Poisoned.set.Store(set)
+	for _, c := range []struct {
+		Host string
+		IPs  string
+	}{
+		{"gitlab.corp.internal", "[10.1.2.3]"},
+		{"gitlab.example.org", "[]"},
+	} {
+		if ips, _ := r.LookupNetIP(context.Background(), "ip4", c.Host); fmt.Sprint(ips) != c.IPs {
+			t.Errorf("Resolver.LookupNetIP(%#v) must return %v, not %v", c.Host, c.IPs, ips)
+		}
+	}
+}
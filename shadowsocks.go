@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"lukechampine.com/blake3"
+)
+
+type ShadowsocksCipher struct {
+	Method   string
+	KeySize  int
+	SaltSize int
+	SIP022   bool
+	NewAEAD  func(key []byte) (cipher.AEAD, error)
+}
+
+var ShadowsocksCiphers = map[string]*ShadowsocksCipher{
+	"aes-128-gcm":                   {"aes-128-gcm", 16, 16, false, newAESGCM},
+	"aes-256-gcm":                   {"aes-256-gcm", 32, 32, false, newAESGCM},
+	"chacha20-ietf-poly1305":        {"chacha20-ietf-poly1305", 32, 32, false, chacha20poly1305.New},
+	"2022-blake3-aes-128-gcm":       {"2022-blake3-aes-128-gcm", 16, 16, true, newAESGCM},
+	"2022-blake3-aes-256-gcm":       {"2022-blake3-aes-256-gcm", 32, 32, true, newAESGCM},
+	"2022-blake3-chacha20-poly1305": {"2022-blake3-chacha20-poly1305", 32, 32, true, chacha20poly1305.New},
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+const (
+	shadowsocksMaxPayload     = 0x3fff
+	shadowsocks2022MaxPayload = 0xffff
+
+	shadowsocks2022ClientStream byte = 0
+	shadowsocks2022ServerStream byte = 1
+	shadowsocks2022MaxTimeDiff       = 30 * time.Second
+)
+
+// Key returns the pre-shared key, the 2022 methods take a base64 encoded key and the others take a password.
+func (c *ShadowsocksCipher) Key(password string) ([]byte, error) {
+	if c.SIP022 {
+		key, err := base64.StdEncoding.DecodeString(password)
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != c.KeySize {
+			return nil, fmt.Errorf("shadowsocks: %s requires a %d bytes key", c.Method, c.KeySize)
+		}
+		return key, nil
+	}
+
+	// EVP_BytesToKey with md5
+	var key, prev []byte
+	for len(key) < c.KeySize {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:c.KeySize], nil
+}
+
+func (c *ShadowsocksCipher) sessionAEAD(key, salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, c.KeySize)
+	if c.SIP022 {
+		blake3.DeriveKey(subkey, "shadowsocks 2022 session subkey", slices.Concat(key, salt))
+	} else {
+		if _, err := io.ReadFull(hkdf.New(sha1.New, key, salt, []byte("ss-subkey")), subkey); err != nil {
+			return nil, err
+		}
+	}
+	return c.NewAEAD(subkey)
+}
+
+func (c *ShadowsocksCipher) maxPayload() int {
+	if c.SIP022 {
+		return shadowsocks2022MaxPayload
+	}
+	return shadowsocksMaxPayload
+}
+
+// ShadowsocksConn is an AEAD (SIP004/SIP022) encrypted stream, use ShadowsocksClient or ShadowsocksServer to create it.
+type ShadowsocksConn struct {
+	net.Conn
+	Cipher *ShadowsocksCipher
+	Key    []byte
+
+	// salt of the request stream, the 2022 response header echoes it
+	RequestSalt []byte
+
+	raead  cipher.AEAD
+	rnonce [12]byte
+	rbuf   []byte
+	rdata  []byte
+
+	wmu    sync.Mutex
+	waead  cipher.AEAD
+	wnonce [12]byte
+}
+
+func shadowsocksIncNonce(nonce *[12]byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func (c *ShadowsocksConn) seal(dst, plaintext []byte) []byte {
+	dst = c.waead.Seal(dst, c.wnonce[:], plaintext, nil)
+	shadowsocksIncNonce(&c.wnonce)
+	return dst
+}
+
+func (c *ShadowsocksConn) readSealed(n int) ([]byte, error) {
+	size := n + c.raead.Overhead()
+	if cap(c.rdata) < size {
+		c.rdata = make([]byte, size)
+	}
+	data := c.rdata[:size]
+	if _, err := io.ReadFull(c.Conn, data); err != nil {
+		return nil, err
+	}
+	plaintext, err := c.raead.Open(data[:0], c.rnonce[:], data, nil)
+	if err != nil {
+		return nil, errors.New("shadowsocks: failed to decrypt chunk")
+	}
+	shadowsocksIncNonce(&c.rnonce)
+	return plaintext, nil
+}
+
+func (c *ShadowsocksConn) readChunk() error {
+	b, err := c.readSealed(2)
+	if err != nil {
+		return err
+	}
+	b, err = c.readSealed(int(binary.BigEndian.Uint16(b)))
+	if err != nil {
+		return err
+	}
+	c.rbuf = b
+	return nil
+}
+
+func (c *ShadowsocksConn) Read(b []byte) (int, error) {
+	if c.raead == nil {
+		if err := c.readResponseHeader(); err != nil {
+			return 0, err
+		}
+	}
+
+	for len(c.rbuf) == 0 {
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+
+	return n, nil
+}
+
+// readResponseHeader reads the salt (and the 2022 fixed header) of response stream on client side.
+func (c *ShadowsocksConn) readResponseHeader() error {
+	salt := make([]byte, c.Cipher.SaltSize)
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return err
+	}
+
+	aead, err := c.Cipher.sessionAEAD(c.Key, salt)
+	if err != nil {
+		return err
+	}
+	c.raead = aead
+
+	if !c.Cipher.SIP022 {
+		return nil
+	}
+
+	b, err := c.readSealed(1 + 8 + c.Cipher.SaltSize + 2)
+	if err != nil {
+		return err
+	}
+	if b[0] != shadowsocks2022ServerStream {
+		return errors.New("shadowsocks: bad response stream type")
+	}
+	if err := shadowsocks2022CheckTimestamp(b[1:9]); err != nil {
+		return err
+	}
+	if !bytes.Equal(b[9:9+c.Cipher.SaltSize], c.RequestSalt) {
+		return errors.New("shadowsocks: mismatched request salt")
+	}
+
+	b, err = c.readSealed(int(binary.BigEndian.Uint16(b[9+c.Cipher.SaltSize:])))
+	if err != nil {
+		return err
+	}
+	c.rbuf = b
+
+	return nil
+}
+
+func (c *ShadowsocksConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var buf []byte
+	p := b
+
+	if c.waead == nil {
+		// first write of server side, sends salt and response header
+		salt := make([]byte, c.Cipher.SaltSize)
+		rand.Read(salt)
+
+		aead, err := c.Cipher.sessionAEAD(c.Key, salt)
+		if err != nil {
+			return 0, err
+		}
+		c.waead = aead
+
+		buf = append(buf, salt...)
+		if c.Cipher.SIP022 {
+			n := min(len(p), c.Cipher.maxPayload())
+			header := []byte{shadowsocks2022ServerStream}
+			header = binary.BigEndian.AppendUint64(header, uint64(time.Now().Unix()))
+			header = append(header, c.RequestSalt...)
+			header = binary.BigEndian.AppendUint16(header, uint16(n))
+			buf = c.seal(buf, header)
+			buf = c.seal(buf, p[:n])
+			p = p[n:]
+		}
+	}
+
+	for len(p) > 0 {
+		n := min(len(p), c.Cipher.maxPayload())
+		buf = c.seal(buf, []byte{byte(n >> 8), byte(n)})
+		buf = c.seal(buf, p[:n])
+		p = p[n:]
+	}
+
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func shadowsocks2022CheckTimestamp(b []byte) error {
+	ts := time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+	if d := time.Since(ts); d > shadowsocks2022MaxTimeDiff || d < -shadowsocks2022MaxTimeDiff {
+		return errors.New("shadowsocks: bad timestamp " + ts.String())
+	}
+	return nil
+}
+
+// ShadowsocksClient sends the request salt and target address, the response stream is read lazily.
+func ShadowsocksClient(conn net.Conn, c *ShadowsocksCipher, key []byte, addr string) (*ShadowsocksConn, error) {
+	target, err := AppendSocksAddr(nil, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, c.SaltSize)
+	rand.Read(salt)
+
+	aead, err := c.sessionAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &ShadowsocksConn{
+		Conn:        conn,
+		Cipher:      c,
+		Key:         key,
+		RequestSalt: salt,
+		waead:       aead,
+	}
+
+	buf := slices.Clone(salt)
+	if c.SIP022 {
+		// no initial payload, so padding is required
+		padding := 1 + int(fastrandn(900))
+		target = binary.BigEndian.AppendUint16(target, uint16(padding))
+		target = append(target, make([]byte, padding)...)
+
+		header := []byte{shadowsocks2022ClientStream}
+		header = binary.BigEndian.AppendUint64(header, uint64(time.Now().Unix()))
+		header = binary.BigEndian.AppendUint16(header, uint16(len(target)))
+		buf = sc.seal(buf, header)
+		buf = sc.seal(buf, target)
+	} else {
+		buf = sc.seal(buf, []byte{byte(len(target) >> 8), byte(len(target))})
+		buf = sc.seal(buf, target)
+	}
+
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+
+	return sc, nil
+}
+
+// ShadowsocksServer reads the request header, the key is picked from keys by trial decryption.
+// It returns the connection, the index of matched key and the target address.
+func ShadowsocksServer(conn net.Conn, c *ShadowsocksCipher, keys [][]byte) (*ShadowsocksConn, int, string, error) {
+	salt := make([]byte, c.SaltSize)
+	if _, err := io.ReadFull(conn, salt); err != nil {
+		return nil, -1, "", err
+	}
+
+	size := 2
+	if c.SIP022 {
+		size = 1 + 8 + 2
+	}
+
+	sealed := make([]byte, size+16)
+	if _, err := io.ReadFull(conn, sealed); err != nil {
+		return nil, -1, "", err
+	}
+
+	var zero [12]byte
+	var header []byte
+	index := -1
+	for i, key := range keys {
+		aead, err := c.sessionAEAD(key, salt)
+		if err != nil {
+			return nil, -1, "", err
+		}
+		if header, err = aead.Open(nil, zero[:], sealed, nil); err == nil {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, -1, "", errors.New("shadowsocks: no matched key")
+	}
+
+	sc := &ShadowsocksConn{
+		Conn:        conn,
+		Cipher:      c,
+		Key:         keys[index],
+		RequestSalt: salt,
+	}
+	sc.raead, _ = c.sessionAEAD(sc.Key, salt)
+	shadowsocksIncNonce(&sc.rnonce)
+
+	if !c.SIP022 {
+		b, err := sc.readSealed(int(binary.BigEndian.Uint16(header)))
+		if err != nil {
+			return nil, index, "", err
+		}
+		sc.rbuf = b
+
+		addr, err := ReadSocksAddr(sc)
+		if err != nil {
+			return nil, index, "", err
+		}
+
+		return sc, index, addr, nil
+	}
+
+	if header[0] != shadowsocks2022ClientStream {
+		return nil, index, "", errors.New("shadowsocks: bad request stream type")
+	}
+	if err := shadowsocks2022CheckTimestamp(header[1:9]); err != nil {
+		return nil, index, "", err
+	}
+
+	b, err := sc.readSealed(int(binary.BigEndian.Uint16(header[9:])))
+	if err != nil {
+		return nil, index, "", err
+	}
+
+	r := bytes.NewReader(b)
+	addr, err := ReadSocksAddr(r)
+	if err != nil {
+		return nil, index, "", err
+	}
+
+	var padding [2]byte
+	if _, err := io.ReadFull(r, padding[:]); err != nil {
+		return nil, index, "", err
+	}
+	if _, err := r.Seek(int64(binary.BigEndian.Uint16(padding[:])), io.SeekCurrent); err != nil {
+		return nil, index, "", err
+	}
+	sc.rbuf = b[len(b)-r.Len():]
+
+	return sc, index, addr, nil
+}
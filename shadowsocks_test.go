@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestShadowsocksConn(t *testing.T) {
+	for method, c := range ShadowsocksCiphers {
+		password := "foobar"
+		if c.SIP022 {
+			key := make([]byte, c.KeySize)
+			rand.Read(key)
+			password = base64.StdEncoding.EncodeToString(key)
+		}
+
+		key, err := c.Key(password)
+		if err != nil {
+			t.Fatalf("%s Key(%#v) error: %+v", method, password, err)
+		}
+		wrong, _ := c.Key(base64.StdEncoding.EncodeToString(make([]byte, c.KeySize)))
+
+		payload := make([]byte, 100*1024)
+		rand.Read(payload)
+
+		c1, c2 := net.Pipe()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			sc, err := ShadowsocksClient(c1, c, key, "example.org:443")
+			if err != nil {
+				t.Errorf("%s ShadowsocksClient error: %+v", method, err)
+				return
+			}
+			sc.Write(payload)
+			data := make([]byte, len(payload))
+			if _, err := io.ReadFull(sc, data); err != nil || !bytes.Equal(data, payload) {
+				t.Errorf("%s read response mismatched, err=%+v", method, err)
+			}
+		}()
+
+		sc, index, addr, err := ShadowsocksServer(c2, c, [][]byte{wrong, key})
+		if err != nil || index != 1 || addr != "example.org:443" {
+			t.Fatalf("%s ShadowsocksServer return index=%d addr=%#v err=%+v", method, index, addr, err)
+		}
+
+		data := make([]byte, len(payload))
+		if _, err := io.ReadFull(sc, data); err != nil || !bytes.Equal(data, payload) {
+			t.Fatalf("%s read payload mismatched, err=%+v", method, err)
+		}
+
+		sc.Write(payload)
+		<-done
+
+		c1.Close()
+		c2.Close()
+	}
+}
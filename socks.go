@@ -1,6 +1,11 @@
 package main
 
 import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
 	"strconv"
 )
 
@@ -17,6 +22,7 @@ type SocksCommand byte
 const (
 	_                      SocksCommand = iota
 	SocksCommandConnectTCP              = 1
+	SocksCommandBind                    = 2
 	SocksCommandConnectUDP              = 3
 )
 
@@ -96,3 +102,71 @@ func (s Socks5Status) String() string {
 	}
 	return "socks5 status: errno 0x" + strconv.FormatInt(int64(s), 16)
 }
+
+// AppendSocksAddr appends addr in socks5 address format.
+func AppendSocksAddr(buf []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xffff {
+		return nil, errors.New("invalid port number: " + portStr)
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip.Is4() {
+			buf = append(buf, Socks5IPv4Address)
+		} else {
+			buf = append(buf, Socks5IPv6Address)
+		}
+		buf = append(buf, ip.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("destination hostname too long: " + host)
+		}
+		buf = append(buf, Socks5DomainName, byte(len(host)))
+		buf = append(buf, host...)
+	}
+
+	return append(buf, byte(port>>8), byte(port)), nil
+}
+
+func ReadSocksAddr(r io.Reader) (string, error) {
+	var b [256]byte
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch b[0] {
+	case Socks5IPv4Address:
+		if _, err := io.ReadFull(r, b[:4]); err != nil {
+			return "", err
+		}
+		host = netip.AddrFrom4([4]byte(b[:4])).String()
+	case Socks5IPv6Address:
+		if _, err := io.ReadFull(r, b[:16]); err != nil {
+			return "", err
+		}
+		host = netip.AddrFrom16([16]byte(b[:16])).String()
+	case Socks5DomainName:
+		if _, err := io.ReadFull(r, b[:1]); err != nil {
+			return "", err
+		}
+		n := int(b[0])
+		if _, err := io.ReadFull(r, b[:n]); err != nil {
+			return "", err
+		}
+		host = string(b[:n])
+	default:
+		return "", errors.New("unknown address type " + strconv.Itoa(int(b[0])))
+	}
+
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(b[:2])))), nil
+}
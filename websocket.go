@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	WebsocketOpContinuation byte = 0x0
+	WebsocketOpText         byte = 0x1
+	WebsocketOpBinary       byte = 0x2
+	WebsocketOpClose        byte = 0x8
+	WebsocketOpPing         byte = 0x9
+	WebsocketOpPong         byte = 0xa
+)
+
+func WebsocketAcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func NewWebsocketKey() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return base64.StdEncoding.EncodeToString(b[:])
+}
+
+// WebsocketConn implements RFC 6455 framing over a connection which has finished the opening handshake.
+// Writes are sent as binary frames, the frames from client side are masked.
+type WebsocketConn struct {
+	net.Conn
+	Client bool
+
+	wmu    sync.Mutex
+	closed bool
+
+	remaining int64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+}
+
+func (c *WebsocketConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		op, length, err := c.readHeader()
+		if err != nil {
+			return 0, err
+		}
+
+		switch op {
+		case WebsocketOpContinuation, WebsocketOpText, WebsocketOpBinary:
+			c.remaining = length
+		case WebsocketOpPing, WebsocketOpPong, WebsocketOpClose:
+			if length > 125 {
+				return 0, errors.New("websocket: control frame too long")
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(c.Conn, payload); err != nil {
+				return 0, err
+			}
+			c.unmask(payload)
+			switch op {
+			case WebsocketOpPing:
+				if err := c.WriteFrame(WebsocketOpPong, payload); err != nil {
+					return 0, err
+				}
+			case WebsocketOpClose:
+				if len(payload) >= 2 {
+					c.WriteFrame(WebsocketOpClose, payload[:2])
+				} else {
+					c.WriteFrame(WebsocketOpClose, nil)
+				}
+				return 0, io.EOF
+			}
+		default:
+			return 0, errors.New("websocket: unknown opcode")
+		}
+	}
+
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+
+	n, err := c.Conn.Read(b)
+	c.unmask(b[:n])
+	c.remaining -= int64(n)
+
+	return n, err
+}
+
+func (c *WebsocketConn) readHeader() (op byte, length int64, err error) {
+	var b [8]byte
+	if _, err = io.ReadFull(c.Conn, b[:2]); err != nil {
+		return
+	}
+
+	op = b[0] & 0x0f
+	c.masked = b[1]&0x80 != 0
+	length = int64(b[1] & 0x7f)
+
+	switch length {
+	case 126:
+		if _, err = io.ReadFull(c.Conn, b[:2]); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if _, err = io.ReadFull(c.Conn, b[:8]); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint64(b[:8]) & (1<<63 - 1))
+	}
+
+	if c.masked {
+		if _, err = io.ReadFull(c.Conn, c.mask[:]); err != nil {
+			return
+		}
+	}
+	c.maskPos = 0
+
+	return
+}
+
+func (c *WebsocketConn) unmask(b []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+func (c *WebsocketConn) Write(b []byte) (int, error) {
+	if err := c.WriteFrame(WebsocketOpBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *WebsocketConn) WriteFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+
+	buf := make([]byte, 0, 14+len(payload))
+	buf = append(buf, 0x80|op)
+
+	var maskbit byte
+	if c.Client {
+		maskbit = 0x80
+	}
+
+	switch n := len(payload); {
+	case n <= 125:
+		buf = append(buf, maskbit|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, maskbit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, maskbit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+
+	if c.Client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		buf = append(buf, mask[:]...)
+		i := len(buf)
+		buf = append(buf, payload...)
+		for j := range payload {
+			buf[i+j] ^= mask[j&3]
+		}
+	} else {
+		buf = append(buf, payload...)
+	}
+
+	_, err := c.Conn.Write(buf)
+
+	if op == WebsocketOpClose {
+		c.closed = true
+	}
+
+	return err
+}
+
+func (c *WebsocketConn) Close() error {
+	c.WriteFrame(WebsocketOpClose, []byte{0x03, 0xe8}) // 1000 normal closure
+	return c.Conn.Close()
+}